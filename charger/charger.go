@@ -4,9 +4,10 @@ import (
 	"bufio"
 	"encoding/json"
 	"fmt"
-	"math/rand"
+	"math"
 	"net"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -22,13 +23,65 @@ var (
 	ID                  = os.Getenv("ID")   // Pode ser alterado para ponto_2, ponto_3, etc.
 	Port                = os.Getenv("PORT") // Porta específica para esse ponto de recarga
 	latitude, longitude float64
-	waitingQueue        []string   // Fila de espera para carros
-	queueMutex          sync.Mutex // Mutex para proteger acesso concorrente à fila
+	localizacao         Localizacao   // Nome, endereço e conectores do ponto
+	waitingQueue        []entradaFila // Fila de espera para carros
+	queueMutex          sync.Mutex    // Mutex para proteger acesso concorrente à fila
+	maxFila             = lerInteiroEnv("MAX_FILA", 5)
+	potenciaKW          = float64(lerInteiroEnv("POTENCIA_KW", 50))
+	intervaloTelemetria = time.Duration(lerInteiroEnv("INTERVALO_TELEMETRIA_S", 2)) * time.Second
+
+	// Sessão em andamento medida por este ponto; protegida por queueMutex
+	sessaoAtual *sessaoCarregamento
+
+	// Vagas preparadas por uma reserva de rota e ainda não confirmadas (transacaoID -> reserva)
+	reservasPreparadas = make(map[string]reservaPreparada)
+	// Transações já confirmadas, para responder de novo a um CONFIRMAR_RESERVA
+	// repetido e para desfazer a reserva se a rota for cancelada (transacaoID -> reserva)
+	reservasConfirmadas = make(map[string]reservaPreparada)
 )
 
+const (
+	// Tempo que uma vaga preparada fica retida aguardando CONFIRMAR_RESERVA,
+	// se o servidor não informar outro em "validade_s"
+	validadePreparacao    = 30 * time.Second
+	validadePreparacaoMax = 10 * time.Minute
+	// Por quanto tempo uma transação confirmada é lembrada
+	memoriaConfirmacao = 30 * time.Minute
+)
+
+type sessaoCarregamento struct {
+	carroID string
+	inicio  time.Time
+	bateria bateriaVeiculo
+
+	// Alocações de potência recebidas do servidor, em ordem de início
+	alocacoes []alocacaoPotencia
+
+	// Limites pedidos pelo carro e instante em que são atingidos; o medidor
+	// para ali mesmo que o servidor demore a finalizar a sessão
+	socAlvo      float64
+	energiaMax   float64
+	fimLimite    time.Time
+	motivoLimite string
+}
+
+type reservaPreparada struct {
+	carroID string
+	timer   *time.Timer
+}
+
+// Posição na fila de espera. Reservas de rota guardam a transação que as
+// criou, para que um cancelamento retire exatamente a vaga daquela transação.
+type entradaFila struct {
+	carroID     string
+	transacaoID string // Vazio em reservas feitas diretamente no ponto
+}
+
 func main() {
-	// Gera a posição aleatória apenas uma vez na inicialização
-	latitude, longitude = gerarPosicaoAleatoria()
+	// Posição fixa, lida da configuração ou gerada a partir do ID
+	localizacao = carregarLocalizacao()
+	latitude, longitude = *localizacao.Latitude, *localizacao.Longitude
+	fmt.Printf("Ponto %s em (%.5f, %.5f)\n", ID, latitude, longitude)
 
 	// Inicializa o listener na porta especificada
 	// Garante que a porta tenha o formato ":6001"
@@ -85,6 +138,22 @@ func handleServerRequest(conn net.Conn) {
 	case "ENCERRAR_RESERVA":
 		fmt.Println("RECEBIDO ENCERRAR RESERVA")
 		handleEncerrarReserva(conn, msg.Content)
+	case "INICIAR_SESSAO":
+		handleIniciarSessao(conn, msg.Content)
+	case "FINALIZAR_SESSAO":
+		handleFinalizarSessao(conn, msg.Content)
+	case "LIMITAR_POTENCIA":
+		handleLimitarPotencia(conn, msg.Content)
+	case "ACOMPANHAR_SESSAO":
+		handleAcompanharSessao(conn, msg.Content)
+	case "PREPARAR_RESERVA":
+		handlePrepararReserva(conn, msg.Content)
+	case "CONFIRMAR_RESERVA":
+		handleConfirmarReserva(conn, msg.Content)
+	case "CANCELAR_RESERVA":
+		handleCancelarReserva(conn, msg.Content)
+	case "DESISTIR_RESERVA":
+		handleDesistirReserva(conn, msg.Content)
 	default:
 		fmt.Println("Comando não reconhecido:", msg.Action)
 	}
@@ -93,16 +162,18 @@ func handleServerRequest(conn net.Conn) {
 func handleListarPontos(conn net.Conn) {
 	fmt.Printf("Servidor solicitou informações do %s.\n", ID)
 
-	// Criando resposta em JSON com a posição fixa gerada na inicialização
+	// Criando resposta em JSON com a posição fixa definida na inicialização
 	responseData := Message{
 		Action: "INFORMACOES_DO_PONTO",
 		Content: map[string]interface{}{
-			"ID":        ID,
-			"latitude":  latitude,
-			"longitude": longitude,
-			"fila":      getWaitingQueue(), // Mostra o estado atual da fila
+			"ID":          ID,
+			"latitude":    latitude,
+			"longitude":   longitude,
+			"potencia_kw": potenciaKW,
+			"fila":        getWaitingQueue(), // Mostra o estado atual da fila
 		},
 	}
+	localizacao.preencher(responseData.Content)
 
 	sendResponse(conn, responseData)
 }
@@ -117,7 +188,15 @@ func handleReservarPonto(conn net.Conn, content map[string]interface{}) {
 
 	// Adiciona o carro à fila de espera
 	queueMutex.Lock()
-	waitingQueue = append(waitingQueue, carID)
+	if filaCheia() {
+		queueMutex.Unlock()
+		sendResponse(conn, Message{
+			Action:  "ERRO",
+			Content: map[string]interface{}{"mensagem": "Fila do ponto está cheia"},
+		})
+		return
+	}
+	waitingQueue = append(waitingQueue, entradaFila{carroID: carID})
 	currentPosition := len(waitingQueue)
 	queueMutex.Unlock()
 
@@ -142,7 +221,7 @@ func handleVerificarPrioridade(conn net.Conn, request Message) {
 	carroID := request.Content["carroID"].(string)
 
 	var acao string
-	if len(waitingQueue) > 0 && waitingQueue[0] == carroID {
+	if len(waitingQueue) > 0 && waitingQueue[0].carroID == carroID {
 		acao = "PRIMEIRO_DA_FILA"
 	} else {
 		acao = "NAO_EH_PRIORITARIO"
@@ -197,7 +276,7 @@ func handleEncerrarReserva(conn net.Conn, content map[string]interface{}) {
 		return
 	}
 
-	primeiro := strings.TrimSpace(waitingQueue[0])
+	primeiro := strings.TrimSpace(waitingQueue[0].carroID)
 	requisitado := strings.TrimSpace(carID)
 
 	fmt.Printf("Comparando carroID recebido (%q | %v) com o primeiro da fila (%q | %v)\n",
@@ -209,28 +288,445 @@ func handleEncerrarReserva(conn net.Conn, content map[string]interface{}) {
 		responseData.Content["mensagem"] = "Reserva encerrada com sucesso"
 		fmt.Printf("Reserva do carro %s encerrada no ponto %s\n", carID, ID)
 	} else {
-		fmt.Printf("Tentativa de encerrar reserva do carro %s falhou - não está na posição 0 (era %s)\n", carID, waitingQueue[0])
+		fmt.Printf("Tentativa de encerrar reserva do carro %s falhou - não está na posição 0 (era %s)\n", carID, primeiro)
 	}
 
-	fmt.Println("Fila de espera atual:", waitingQueue)
+	fmt.Println("Fila de espera atual:", carrosNaFila())
 	sendResponse(conn, responseData)
 }
 
+// Começa a medir a sessão do carro que está no início da fila
+func handleIniciarSessao(conn net.Conn, content map[string]interface{}) {
+	carID, _ := content["carroID"].(string)
+
+	queueMutex.Lock()
+	defer queueMutex.Unlock()
+
+	var erro string
+	switch {
+	case sessaoAtual != nil:
+		erro = "Ponto já possui uma sessão em andamento"
+	case len(waitingQueue) == 0 || waitingQueue[0].carroID != carID:
+		erro = "Carro não é o primeiro da fila"
+	}
+	if erro != "" {
+		sendResponse(conn, Message{Action: "ERRO", Content: map[string]interface{}{"mensagem": erro}})
+		return
+	}
+
+	// Carros que não informam a bateria são carregados na potência máxima
+	bateria := bateriaVeiculo{}
+	bateria.capacidadeKWh, _ = content["capacidade_kwh"].(float64)
+	bateria.potenciaMaxKW, _ = content["potencia_max_kw"].(float64)
+	bateria.socInicial, _ = content["soc"].(float64)
+	bateria.socInicial = math.Max(0, math.Min(bateria.socInicial, 100))
+
+	sessao := &sessaoCarregamento{carroID: carID, inicio: time.Now(), bateria: bateria}
+	sessao.socAlvo, _ = content["soc_alvo"].(float64)
+	sessao.energiaMax, _ = content["energia_max_kwh"].(float64)
+	// Ponto que divide a ligação à rede com outros já começa na potência alocada
+	if alocada, ok := content["potencia_alocada_kw"].(float64); ok {
+		sessao.alocacoes = []alocacaoPotencia{{aPartirDe: 0, kw: math.Max(0, alocada)}}
+	}
+	sessao.programarLimite(sessao.inicio)
+	sessaoAtual = sessao
+	fmt.Printf("Sessão do carro %s iniciada no ponto %s\n", carID, ID)
+	if !sessao.fimLimite.IsZero() {
+		fmt.Printf("Sessão será encerrada pelo ponto em %s (%s)\n", sessao.fimLimite.Sub(sessao.inicio).Round(time.Second), sessao.motivoLimite)
+	}
+
+	resposta := Message{
+		Action: "SESSAO_INICIADA",
+		Content: map[string]interface{}{
+			"ID":              ID,
+			"carroID":         carID,
+			"inicio":          sessao.inicio,
+			"potencia_kw":     bateria.potenciaEm(bateria.socInicial, sessao.limiteEm(0)),
+			"potencia_max_kw": bateria.potenciaLimite(),
+		},
+	}
+	if bateria.capacidadeKWh > 0 {
+		resposta.Content["soc"] = bateria.socInicial
+	}
+	sendResponse(conn, resposta)
+}
+
+// Encerra a medição e informa os valores que serão usados na cobrança
+func handleFinalizarSessao(conn net.Conn, content map[string]interface{}) {
+	carID, _ := content["carroID"].(string)
+
+	queueMutex.Lock()
+	defer queueMutex.Unlock()
+
+	if sessaoAtual == nil || sessaoAtual.carroID != carID {
+		sendResponse(conn, Message{
+			Action:  "ERRO",
+			Content: map[string]interface{}{"mensagem": "Nenhuma sessão ativa para este carro"},
+		})
+		return
+	}
+
+	agora := time.Now()
+	fim := sessaoAtual.instanteFinal(agora)
+	ocioso := sessaoAtual.ociosidade(agora)
+	duracao := fim.Sub(sessaoAtual.inicio)
+	bateria := sessaoAtual.bateria
+	motivo := ""
+	if fim.Equal(sessaoAtual.fimLimite) {
+		motivo = sessaoAtual.motivoLimite
+	}
+	energia, soc := sessaoAtual.carregar(duracao)
+	inicio := sessaoAtual.inicio
+	sessaoAtual = nil
+	fmt.Printf("Sessão do carro %s encerrada: %.0fs, %.3f kWh\n", carID, duracao.Seconds(), energia)
+
+	resposta := Message{
+		Action: "SESSAO_FINALIZADA",
+		Content: map[string]interface{}{
+			"ID":               ID,
+			"carroID":          carID,
+			"inicio":           inicio,
+			"fim":              fim,
+			"duracao_segundos": duracao.Seconds(),
+			"energia_kwh":      energia,
+			"ocioso_segundos":  ocioso.Seconds(),
+		},
+	}
+	if bateria.capacidadeKWh > 0 {
+		resposta.Content["soc_inicial"] = bateria.socInicial
+		resposta.Content["soc_final"] = soc
+	}
+	if motivo != "" {
+		resposta.Content["motivo"] = motivo
+	}
+	sendResponse(conn, resposta)
+}
+
+// Aplica a potência alocada pelo servidor à sessão em andamento, a partir de
+// agora. Potência negativa remove a alocação.
+func handleLimitarPotencia(conn net.Conn, content map[string]interface{}) {
+	carID, _ := content["carroID"].(string)
+	alocada, ok := content["potencia_kw"].(float64)
+
+	queueMutex.Lock()
+	defer queueMutex.Unlock()
+
+	if sessaoAtual == nil || sessaoAtual.carroID != carID || !ok {
+		sendResponse(conn, Message{
+			Action:  "ERRO",
+			Content: map[string]interface{}{"mensagem": "Nenhuma sessão ativa para este carro"},
+		})
+		return
+	}
+
+	agora := sessaoAtual.instanteFinal(time.Now())
+	sessaoAtual.alocacoes = append(sessaoAtual.alocacoes, alocacaoPotencia{aPartirDe: agora.Sub(sessaoAtual.inicio), kw: alocada})
+	sessaoAtual.programarLimite(agora)
+	fmt.Printf("Potência da sessão do carro %s limitada a %.1f kW\n", carID, alocada)
+
+	sendResponse(conn, Message{
+		Action: "POTENCIA_LIMITADA",
+		Content: map[string]interface{}{
+			"ID":          ID,
+			"carroID":     carID,
+			"potencia_kw": sessaoAtual.limiteEm(agora.Sub(sessaoAtual.inicio)),
+		},
+	})
+}
+
+// Envia leituras do medidor a cada intervaloTelemetria enquanto durar a sessão
+// do carro, na mesma conexão, e avisa quando ela terminar. Quando o limite
+// pedido pelo carro é atingido, envia LIMITE_ATINGIDO uma única vez para que o
+// servidor finalize a sessão.
+func handleAcompanharSessao(conn net.Conn, content map[string]interface{}) {
+	carID, _ := content["carroID"].(string)
+	fmt.Printf("Servidor acompanhando a sessão do carro %s\n", carID)
+
+	limiteAvisado := false
+	for {
+		// A leitura e o limite são lidos com queueMutex travado, pois
+		// LIMITAR_POTENCIA altera as alocações e reprograma o limite
+		queueMutex.Lock()
+		sessao := sessaoAtual
+		if sessao == nil || sessao.carroID != carID {
+			queueMutex.Unlock()
+			enviarLeitura(conn, Message{
+				Action:  "SESSAO_ENCERRADA",
+				Content: map[string]interface{}{"ID": ID, "carroID": carID},
+			})
+			return
+		}
+		agora := time.Now()
+		leitura := sessao.leitura(agora)
+		fimLimite, motivoLimite := sessao.fimLimite, sessao.motivoLimite
+		queueMutex.Unlock()
+
+		espera := intervaloTelemetria
+		if !fimLimite.IsZero() && !limiteAvisado {
+			if !agora.Before(fimLimite) {
+				fmt.Printf("Sessão do carro %s atingiu o limite %s\n", carID, motivoLimite)
+				leitura.Action = "LIMITE_ATINGIDO"
+				leitura.Content["motivo"] = motivoLimite
+				limiteAvisado = true
+			} else if falta := fimLimite.Sub(agora); falta < espera {
+				espera = falta // Acorda no instante do limite
+			}
+		}
+		if err := enviarLeitura(conn, leitura); err != nil {
+			fmt.Printf("Acompanhamento da sessão do carro %s interrompido: %v\n", carID, err)
+			return
+		}
+		time.Sleep(espera)
+	}
+}
+
+// Como sendResponse, mas sem registrar cada leitura e devolvendo o erro de escrita
+func enviarLeitura(conn net.Conn, msg Message) error {
+	jsonMsg, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(conn, string(jsonMsg))
+	return err
+}
+
+// Primeira fase da reserva de rota: retém uma vaga sem colocar o carro na fila
+func handlePrepararReserva(conn net.Conn, content map[string]interface{}) {
+	carID, okCarro := content["carroID"].(string)
+	transacaoID, okTx := content["transacaoID"].(string)
+	if !okCarro || !okTx {
+		fmt.Println("Erro: campos 'carroID' ou 'transacaoID' ausentes ou inválidos")
+		return
+	}
+
+	responseData := Message{
+		Action: "RESERVA_PREPARADA",
+		Content: map[string]interface{}{
+			"ID":          ID,
+			"carroID":     carID,
+			"transacaoID": transacaoID,
+		},
+	}
+
+	queueMutex.Lock()
+	defer queueMutex.Unlock()
+
+	if _, existe := reservasPreparadas[transacaoID]; !existe {
+		if filaCheia() {
+			responseData.Action = "RESERVA_RECUSADA"
+			responseData.Content["mensagem"] = "Fila do ponto está cheia"
+			sendResponse(conn, responseData)
+			return
+		}
+		validade := validadePreparacao
+		if segundos, ok := content["validade_s"].(float64); ok && segundos > 0 {
+			validade = time.Duration(segundos * float64(time.Second))
+			if validade > validadePreparacaoMax {
+				validade = validadePreparacaoMax
+			}
+		}
+		reservasPreparadas[transacaoID] = reservaPreparada{
+			carroID: carID,
+			timer:   time.AfterFunc(validade, func() { expirarPreparacao(transacaoID) }),
+		}
+		fmt.Printf("Vaga preparada para o carro %s (transação %s, válida por %s)\n", carID, transacaoID, validade)
+	}
+
+	sendResponse(conn, responseData)
+}
+
+// Segunda fase: a vaga preparada vira uma posição real na fila. Repetir a
+// confirmação de uma transação já confirmada devolve a mesma reserva, para
+// que o servidor possa insistir quando a resposta se perder.
+func handleConfirmarReserva(conn net.Conn, content map[string]interface{}) {
+	transacaoID, _ := content["transacaoID"].(string)
+
+	queueMutex.Lock()
+	if confirmada, existe := reservasConfirmadas[transacaoID]; existe {
+		currentPosition := posicaoDaTransacao(transacaoID)
+		queueMutex.Unlock()
+		sendResponse(conn, respostaReservaConfirmada(confirmada.carroID, transacaoID, currentPosition))
+		return
+	}
+	reserva, existe := reservasPreparadas[transacaoID]
+	if !existe {
+		queueMutex.Unlock()
+		sendResponse(conn, Message{
+			Action: "RESERVA_RECUSADA",
+			Content: map[string]interface{}{
+				"ID":          ID,
+				"transacaoID": transacaoID,
+				"mensagem":    "Preparação não encontrada ou expirada",
+			},
+		})
+		return
+	}
+	reserva.timer.Stop()
+	delete(reservasPreparadas, transacaoID)
+	waitingQueue = append(waitingQueue, entradaFila{carroID: reserva.carroID, transacaoID: transacaoID})
+	currentPosition := len(waitingQueue)
+	reservasConfirmadas[transacaoID] = reservaPreparada{
+		carroID: reserva.carroID,
+		timer:   time.AfterFunc(memoriaConfirmacao, func() { esquecerConfirmacao(transacaoID) }),
+	}
+	queueMutex.Unlock()
+
+	fmt.Printf("Carro %s adicionado à fila do ponto %s pela transação %s. Posição na fila: %d\n", reserva.carroID, ID, transacaoID, currentPosition)
+
+	sendResponse(conn, respostaReservaConfirmada(reserva.carroID, transacaoID, currentPosition))
+}
+
+func respostaReservaConfirmada(carroID, transacaoID string, posicao int) Message {
+	return Message{
+		Action: "RESERVA_CONFIRMADA",
+		Content: map[string]interface{}{
+			"ID":           ID,
+			"carroID":      carroID,
+			"transacaoID":  transacaoID,
+			"posicao_fila": posicao,
+			"latitude":     latitude,
+			"longitude":    longitude,
+		},
+	}
+}
+
+// Libera a vaga preparada ou, se a transação já foi confirmada, retira o
+// carro da fila (a rota foi desfeita em outro ponto). Cancelar uma transação
+// desconhecida não é erro.
+func handleCancelarReserva(conn net.Conn, content map[string]interface{}) {
+	transacaoID, _ := content["transacaoID"].(string)
+
+	queueMutex.Lock()
+	if reserva, existe := reservasPreparadas[transacaoID]; existe {
+		reserva.timer.Stop()
+		delete(reservasPreparadas, transacaoID)
+		fmt.Printf("Preparação da transação %s cancelada\n", transacaoID)
+	}
+	if confirmada, existe := reservasConfirmadas[transacaoID]; existe {
+		confirmada.timer.Stop()
+		delete(reservasConfirmadas, transacaoID)
+		if removerPosicao(posicaoDaTransacao(transacaoID)) {
+			fmt.Printf("Reserva do carro %s desfeita pela transação %s\n", confirmada.carroID, transacaoID)
+		}
+	}
+	queueMutex.Unlock()
+
+	sendResponse(conn, Message{
+		Action: "RESERVA_CANCELADA",
+		Content: map[string]interface{}{
+			"ID":          ID,
+			"transacaoID": transacaoID,
+		},
+	})
+}
+
+// Retira da fila um carro que desistiu da reserva antes de carregar, por
+// exemplo por ter ficado sem bateria no caminho
+func handleDesistirReserva(conn net.Conn, content map[string]interface{}) {
+	carroID, _ := content["carroID"].(string)
+
+	queueMutex.Lock()
+	removido := removerDaFila(carroID)
+	queueMutex.Unlock()
+
+	mensagem := "Carro não está na fila ou já está carregando"
+	if removido {
+		mensagem = "Reserva desfeita"
+		fmt.Printf("Carro %s desistiu da reserva no ponto %s\n", carroID, ID)
+	}
+	sendResponse(conn, Message{
+		Action: "RESERVA_DESISTIDA",
+		Content: map[string]interface{}{
+			"ID":       ID,
+			"carroID":  carroID,
+			"sucesso":  removido,
+			"mensagem": mensagem,
+		},
+	})
+}
+
+func expirarPreparacao(transacaoID string) {
+	queueMutex.Lock()
+	defer queueMutex.Unlock()
+
+	if _, existe := reservasPreparadas[transacaoID]; existe {
+		delete(reservasPreparadas, transacaoID)
+		fmt.Printf("Preparação da transação %s expirou sem confirmação\n", transacaoID)
+	}
+}
+
+func esquecerConfirmacao(transacaoID string) {
+	queueMutex.Lock()
+	defer queueMutex.Unlock()
+	delete(reservasConfirmadas, transacaoID)
+}
+
+// Posição do carro na fila a partir de 1, ou 0 se ele não estiver nela.
+// Deve ser chamada com queueMutex travado.
+func posicaoNaFila(carroID string) int {
+	for i, entrada := range waitingQueue {
+		if entrada.carroID == carroID {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// Posição da vaga criada pela transação, ou 0 se ela não estiver na fila.
+// Deve ser chamada com queueMutex travado.
+func posicaoDaTransacao(transacaoID string) int {
+	for i, entrada := range waitingQueue {
+		if entrada.transacaoID == transacaoID {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// Retira o carro da fila, salvo se estiver carregando. Deve ser chamada com
+// queueMutex travado.
+func removerDaFila(carroID string) bool {
+	return removerPosicao(posicaoNaFila(carroID))
+}
+
+// Retira a entrada da posição (a partir de 1), salvo se o carro dela estiver
+// carregando. Deve ser chamada com queueMutex travado.
+func removerPosicao(posicao int) bool {
+	if posicao == 0 || (posicao == 1 && sessaoAtual != nil && sessaoAtual.carroID == waitingQueue[0].carroID) {
+		return false
+	}
+	waitingQueue = append(waitingQueue[:posicao-1], waitingQueue[posicao:]...)
+	return true
+}
+
+// IDs dos carros na ordem da fila. Deve ser chamada com queueMutex travado.
+func carrosNaFila() []string {
+	carros := make([]string, len(waitingQueue))
+	for i, entrada := range waitingQueue {
+		carros[i] = entrada.carroID
+	}
+	return carros
+}
+
+// Considera também as vagas preparadas. Deve ser chamada com queueMutex travado.
+func filaCheia() bool {
+	return len(waitingQueue)+len(reservasPreparadas) >= maxFila
+}
+
+// Lê um inteiro de uma variável de ambiente, usando o padrão se ausente ou inválido
+func lerInteiroEnv(nome string, padrao int) int {
+	valor, err := strconv.Atoi(os.Getenv(nome))
+	if err != nil {
+		return padrao
+	}
+	return valor
+}
+
 // Função segura para obter cópia da fila de espera
 func getWaitingQueue() []string {
 	queueMutex.Lock()
 	defer queueMutex.Unlock()
 
 	// Retorna uma cópia da fila para evitar acesso concorrente
-	queueCopy := make([]string, len(waitingQueue))
-	copy(queueCopy, waitingQueue)
-	return queueCopy
-}
-
-// Função para gerar latitude e longitude aleatórias uma única vez
-func gerarPosicaoAleatoria() (float64, float64) {
-	rand.Seed(time.Now().UnixNano())
-	lat := rand.Float64()*180 - 90  // Gera um valor entre -90 e 90
-	lon := rand.Float64()*360 - 180 // Gera um valor entre -180 e 180
-	return lat, lon
+	return carrosNaFila()
 }
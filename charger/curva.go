@@ -0,0 +1,229 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// Acima deste SOC (%) a bateria sai da corrente constante (CC) e passa a
+	// tensão constante (CV), com a potência caindo até o fim da carga
+	socInicioCV = 80.0
+	// Potência mínima (fração da máxima) no fim da fase CV, para que a carga termine
+	fracaoMinimaCV = 0.05
+	// Passo da integração da curva de carga
+	passoCurva = time.Second
+	// Sessões com limite que nunca seria atingido não são encerradas pelo ponto
+	duracaoMaximaLimite = 24 * time.Hour
+)
+
+// Motivos de encerramento automático da sessão
+const (
+	limiteSocAlvo       = "SOC_ALVO"
+	limiteEnergiaMaxima = "ENERGIA_MAXIMA"
+)
+
+// Bateria do carro informada no início da sessão. Com capacidade zero (carro
+// que não informou a bateria) o ponto entrega sempre a potência máxima.
+type bateriaVeiculo struct {
+	capacidadeKWh float64
+	potenciaMaxKW float64 // Potência máxima aceita pelo carro
+	socInicial    float64 // Em %
+}
+
+// Potência alocada pelo servidor à sessão a partir de um instante (relativo
+// ao início), quando o ponto divide a ligação à rede com outros pontos do site.
+// Potência negativa remove a alocação.
+type alocacaoPotencia struct {
+	aPartirDe time.Duration
+	kw        float64
+}
+
+// Potência máxima da bateria no ponto: a menor entre a do ponto e a aceita pelo carro
+func (b bateriaVeiculo) potenciaLimite() float64 {
+	if b.potenciaMaxKW > 0 {
+		return math.Min(potenciaKW, b.potenciaMaxKW)
+	}
+	return potenciaKW
+}
+
+// Potência entregue com a bateria no SOC informado, seguindo a curva CC/CV a
+// partir da potência máxima disponível no momento
+func (b bateriaVeiculo) potenciaEm(soc, limite float64) float64 {
+	switch {
+	case b.capacidadeKWh <= 0 || soc < socInicioCV:
+		return limite
+	case soc >= 100:
+		return 0
+	}
+	fracao := (100 - soc) / (100 - socInicioCV)
+	return limite * math.Max(fracao, fracaoMinimaCV)
+}
+
+// Potência máxima disponível para a sessão em um instante: a da bateria no
+// ponto, reduzida pela alocação do site em vigor naquele instante
+func (s *sessaoCarregamento) limiteEm(decorrido time.Duration) float64 {
+	limite := s.bateria.potenciaLimite()
+	alocada := -1.0
+	for _, alocacao := range s.alocacoes {
+		if alocacao.aPartirDe > decorrido {
+			break
+		}
+		alocada = alocacao.kw
+	}
+	if alocada >= 0 {
+		return math.Min(limite, alocada)
+	}
+	return limite
+}
+
+// Potência alocada em vigor agora, limitada à da bateria no ponto; negativa
+// se não houver alocação
+func (s *sessaoCarregamento) alocacaoAtual() float64 {
+	if len(s.alocacoes) == 0 || s.alocacoes[len(s.alocacoes)-1].kw < 0 {
+		return -1
+	}
+	return math.Min(s.alocacoes[len(s.alocacoes)-1].kw, s.bateria.potenciaLimite())
+}
+
+// Integra a curva de carga por uma duração, devolvendo a energia entregue (kWh)
+// e o SOC final (%). O SOC só tem sentido se o carro informou a bateria.
+func (s *sessaoCarregamento) carregar(duracao time.Duration) (energia, soc float64) {
+	soc = s.bateria.socInicial
+	for decorrido := time.Duration(0); decorrido < duracao; decorrido += passoCurva {
+		passo := passoCurva
+		if restante := duracao - decorrido; restante < passo {
+			passo = restante
+		}
+		potencia := s.bateria.potenciaEm(soc, s.limiteEm(decorrido))
+		if potencia <= 0 {
+			continue // Bateria cheia ou sem potência alocada neste trecho
+		}
+		delta := potencia * passo.Hours()
+		if s.bateria.capacidadeKWh > 0 {
+			delta = math.Min(delta, (100-soc)/100*s.bateria.capacidadeKWh)
+			soc += delta / s.bateria.capacidadeKWh * 100
+		}
+		energia += delta
+	}
+	return energia, soc
+}
+
+// Tempo desde o início até a sessão atingir o SOC alvo ou a energia máxima
+// (zero desativa cada limite), supondo que a alocação atual se mantenha.
+// Devolve falso se nenhum limite for atingido.
+func (s *sessaoCarregamento) tempoAteLimite(socAlvo, energiaMax float64) (time.Duration, string, bool) {
+	if s.bateria.capacidadeKWh <= 0 {
+		socAlvo = 0 // Sem bateria informada não há SOC para comparar
+	}
+	if socAlvo <= 0 && energiaMax <= 0 {
+		return 0, "", false
+	}
+
+	energia, soc := 0.0, s.bateria.socInicial
+	for decorrido := time.Duration(0); decorrido < duracaoMaximaLimite; decorrido += passoCurva {
+		// Energia que falta para cada limite; a menor define o fim da sessão
+		falta, motivo := math.Inf(1), ""
+		if socAlvo > 0 {
+			falta, motivo = (socAlvo-soc)/100*s.bateria.capacidadeKWh, limiteSocAlvo
+		}
+		if energiaMax > 0 && energiaMax-energia < falta {
+			falta, motivo = energiaMax-energia, limiteEnergiaMaxima
+		}
+		if falta <= 0 {
+			return decorrido, motivo, true
+		}
+
+		potencia := s.bateria.potenciaEm(soc, s.limiteEm(decorrido))
+		if potencia <= 0 {
+			continue
+		}
+		delta := potencia * passoCurva.Hours()
+		if delta >= falta {
+			return decorrido + time.Duration(falta/potencia*float64(time.Hour)), motivo, true
+		}
+		energia += delta
+		if s.bateria.capacidadeKWh > 0 {
+			soc += delta / s.bateria.capacidadeKWh * 100
+		}
+	}
+	return 0, "", false
+}
+
+// Recalcula quando a sessão atinge o limite pedido pelo carro. Deve ser chamada
+// com queueMutex travado, no início e a cada mudança na alocação.
+func (s *sessaoCarregamento) programarLimite(agora time.Time) {
+	if !s.fimLimite.IsZero() && !s.fimLimite.After(agora) {
+		return // Limite já atingido: o medidor está parado
+	}
+	s.fimLimite, s.motivoLimite = time.Time{}, ""
+	if duracao, motivo, ok := s.tempoAteLimite(s.socAlvo, s.energiaMax); ok {
+		s.fimLimite = s.inicio.Add(duracao)
+		s.motivoLimite = motivo
+	}
+}
+
+// Instante em que o medidor para: agora, ou o fim pelo limite se já passou
+func (s *sessaoCarregamento) instanteFinal(agora time.Time) time.Time {
+	if !s.fimLimite.IsZero() && s.fimLimite.Before(agora) {
+		return s.fimLimite
+	}
+	return agora
+}
+
+// Instante em que o carro deixa de receber energia, mantida a alocação
+// atual: o limite pedido ou, sem limite, a bateria cheia. Zero se nenhum dos
+// dois for atingido.
+func (s *sessaoCarregamento) fimCarga() time.Time {
+	if !s.fimLimite.IsZero() {
+		return s.fimLimite
+	}
+	if s.bateria.capacidadeKWh > 0 {
+		if duracao, _, ok := s.tempoAteLimite(100, 0); ok {
+			return s.inicio.Add(duracao)
+		}
+	}
+	return time.Time{}
+}
+
+// Tempo que o carro passou conectado depois de parar de receber energia
+func (s *sessaoCarregamento) ociosidade(agora time.Time) time.Duration {
+	fim := s.fimCarga()
+	if fim.IsZero() || !fim.Before(agora) {
+		return 0
+	}
+	return agora.Sub(fim)
+}
+
+// Valores do medidor em um instante da sessão
+func (s *sessaoCarregamento) leitura(agora time.Time) Message {
+	ocioso := s.ociosidade(agora)
+	agora = s.instanteFinal(agora)
+	decorrido := agora.Sub(s.inicio)
+	energia, soc := s.carregar(decorrido)
+	leitura := Message{
+		Action: "LEITURA_MEDIDOR",
+		Content: map[string]interface{}{
+			"ID":                 ID,
+			"carroID":            s.carroID,
+			"instante":           agora,
+			"decorrido_segundos": decorrido.Seconds(),
+			"energia_kwh":        energia,
+			"potencia_kw":        s.bateria.potenciaEm(soc, s.limiteEm(decorrido)),
+			"intervalo_segundos": intervaloTelemetria.Seconds(),
+			"ocioso_segundos":    ocioso.Seconds(),
+		},
+	}
+	if s.bateria.capacidadeKWh > 0 {
+		leitura.Content["soc"] = soc
+	}
+	if alocada := s.alocacaoAtual(); alocada >= 0 {
+		leitura.Content["potencia_alocada_kw"] = alocada
+	}
+
+	// Previsão de término com a alocação atual
+	if fim := s.fimCarga(); !fim.IsZero() {
+		leitura.Content["tempo_restante_segundos"] = math.Max(0, fim.Sub(agora).Seconds())
+	}
+	return leitura
+}
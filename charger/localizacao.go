@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Região usada pelo gerador quando LOCALIZACAO_AREA não é informada (São Paulo)
+var areaPadrao = areaGeografica{LatMin: -23.80, LonMin: -46.85, LatMax: -23.40, LonMax: -46.35}
+
+// Localização e dados cadastrais do ponto, informados ao servidor em INFORMACOES_DO_PONTO
+type Localizacao struct {
+	Nome       string            `json:"nome,omitempty"`
+	Endereco   string            `json:"endereco,omitempty"`
+	Latitude   *float64          `json:"latitude,omitempty"`
+	Longitude  *float64          `json:"longitude,omitempty"`
+	Conectores []string          `json:"conectores,omitempty"`
+	Metadados  map[string]string `json:"metadados,omitempty"`
+}
+
+// Arquivo compartilhado pelos pontos, com a localização de cada um pelo ID
+type ConfiguracaoLocalizacoes struct {
+	Pontos map[string]Localizacao `json:"pontos"`
+}
+
+// Retângulo de coordenadas em que o gerador espalha os pontos
+type areaGeografica struct {
+	LatMin, LonMin, LatMax, LonMax float64
+}
+
+// Monta a localização do ponto, em ordem de prioridade: variáveis de
+// ambiente (LAT, LON, NOME, ENDERECO, CONECTORES), a entrada do ponto no
+// arquivo LOCALIZACAO_ARQUIVO (padrão pontos.json) e, para as coordenadas que
+// faltarem, o gerador com semente, que dá sempre a mesma posição ao mesmo ID
+func carregarLocalizacao() Localizacao {
+	caminho := os.Getenv("LOCALIZACAO_ARQUIVO")
+	if caminho == "" {
+		caminho = "pontos.json"
+	}
+	localizacao := lerLocalizacaoArquivo(caminho)
+
+	if lat, err := strconv.ParseFloat(os.Getenv("LAT"), 64); err == nil {
+		localizacao.Latitude = &lat
+	}
+	if lon, err := strconv.ParseFloat(os.Getenv("LON"), 64); err == nil {
+		localizacao.Longitude = &lon
+	}
+	if nome := os.Getenv("NOME"); nome != "" {
+		localizacao.Nome = nome
+	}
+	if endereco := os.Getenv("ENDERECO"); endereco != "" {
+		localizacao.Endereco = endereco
+	}
+	if conectores := os.Getenv("CONECTORES"); conectores != "" {
+		localizacao.Conectores = strings.Split(conectores, ",")
+	}
+
+	if localizacao.Latitude == nil || localizacao.Longitude == nil {
+		area, err := lerArea(os.Getenv("LOCALIZACAO_AREA"))
+		if err != nil {
+			fmt.Printf("LOCALIZACAO_AREA inválida (%v), usando a área padrão\n", err)
+			area = areaPadrao
+		}
+		lat, lon := gerarPosicao(area, int64(lerInteiroEnv("LOCALIZACAO_SEMENTE", 0)))
+		if localizacao.Latitude == nil {
+			localizacao.Latitude = &lat
+		}
+		if localizacao.Longitude == nil {
+			localizacao.Longitude = &lon
+		}
+		fmt.Printf("Posição do ponto %s gerada na área %+v\n", ID, area)
+	}
+	return localizacao
+}
+
+func lerLocalizacaoArquivo(caminho string) Localizacao {
+	dados, err := os.ReadFile(caminho)
+	if err != nil {
+		return Localizacao{}
+	}
+	var config ConfiguracaoLocalizacoes
+	if err := json.Unmarshal(dados, &config); err != nil {
+		fmt.Printf("Erro ao ler localizações de %s: %v\n", caminho, err)
+		return Localizacao{}
+	}
+	localizacao, existe := config.Pontos[ID]
+	if !existe {
+		fmt.Printf("Ponto %s não consta em %s\n", ID, caminho)
+		return Localizacao{}
+	}
+	fmt.Printf("Localização do ponto %s carregada de %s\n", ID, caminho)
+	return localizacao
+}
+
+// Lê a área no formato "latMin,lonMin,latMax,lonMax"; vazia usa a área padrão
+func lerArea(texto string) (areaGeografica, error) {
+	if strings.TrimSpace(texto) == "" {
+		return areaPadrao, nil
+	}
+	campos := strings.Split(texto, ",")
+	if len(campos) != 4 {
+		return areaGeografica{}, fmt.Errorf("esperado latMin,lonMin,latMax,lonMax")
+	}
+	var valores [4]float64
+	for i, campo := range campos {
+		valor, err := strconv.ParseFloat(strings.TrimSpace(campo), 64)
+		if err != nil {
+			return areaGeografica{}, err
+		}
+		valores[i] = valor
+	}
+	area := areaGeografica{LatMin: valores[0], LonMin: valores[1], LatMax: valores[2], LonMax: valores[3]}
+	if area.LatMin >= area.LatMax || area.LonMin >= area.LonMax || area.LatMin < -90 || area.LatMax > 90 || area.LonMin < -180 || area.LonMax > 180 {
+		return areaGeografica{}, fmt.Errorf("limites fora de ordem ou do globo")
+	}
+	return area, nil
+}
+
+// Posição dentro da área, derivada da semente e do ID do ponto: estável entre
+// reinícios e diferente para cada ponto
+func gerarPosicao(area areaGeografica, semente int64) (float64, float64) {
+	h := fnv.New64a()
+	h.Write([]byte(ID))
+	gerador := rand.New(rand.NewSource(semente ^ int64(h.Sum64())))
+	lat := area.LatMin + gerador.Float64()*(area.LatMax-area.LatMin)
+	lon := area.LonMin + gerador.Float64()*(area.LonMax-area.LonMin)
+	return lat, lon
+}
+
+// Dados cadastrais incluídos em INFORMACOES_DO_PONTO, além das coordenadas
+func (l Localizacao) preencher(content map[string]interface{}) {
+	if l.Nome != "" {
+		content["nome"] = l.Nome
+	}
+	if l.Endereco != "" {
+		content["endereco"] = l.Endereco
+	}
+	if len(l.Conectores) > 0 {
+		content["conectores"] = l.Conectores
+	}
+	if len(l.Metadados) > 0 {
+		content["metadados"] = l.Metadados
+	}
+}
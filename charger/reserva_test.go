@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Mensagem enviada ao ponto e a ação que se espera em resposta
+type passoReserva struct {
+	acao     string
+	conteudo map[string]interface{}
+	resposta string
+	espera   time.Duration // Pausa antes de enviar, para deixar preparações expirarem
+}
+
+// Envia a mensagem ao ponto como o servidor faria e devolve a resposta
+func enviarAoPonto(t *testing.T, msg Message) Message {
+	t.Helper()
+	cliente, servidor := net.Pipe()
+	defer cliente.Close()
+	go handleServerRequest(servidor)
+
+	cliente.SetDeadline(time.Now().Add(2 * time.Second))
+	dados, _ := json.Marshal(msg)
+	if _, err := fmt.Fprintln(cliente, string(dados)); err != nil {
+		t.Fatalf("%s: erro ao enviar: %v", msg.Action, err)
+	}
+	linha, err := bufio.NewReader(cliente).ReadString('\n')
+	if err != nil {
+		t.Fatalf("%s: erro ao ler resposta: %v", msg.Action, err)
+	}
+	var resposta Message
+	if err := json.Unmarshal([]byte(linha), &resposta); err != nil {
+		t.Fatalf("%s: resposta inválida: %v", msg.Action, err)
+	}
+	return resposta
+}
+
+func reiniciarFila() {
+	queueMutex.Lock()
+	defer queueMutex.Unlock()
+	for _, reserva := range reservasPreparadas {
+		reserva.timer.Stop()
+	}
+	for _, reserva := range reservasConfirmadas {
+		reserva.timer.Stop()
+	}
+	waitingQueue = nil
+	sessaoAtual = nil
+	reservasPreparadas = make(map[string]reservaPreparada)
+	reservasConfirmadas = make(map[string]reservaPreparada)
+}
+
+func preparar(carroID, transacaoID string, validade float64) passoReserva {
+	conteudo := map[string]interface{}{"carroID": carroID, "transacaoID": transacaoID}
+	if validade > 0 {
+		conteudo["validade_s"] = validade
+	}
+	return passoReserva{acao: "PREPARAR_RESERVA", conteudo: conteudo, resposta: "RESERVA_PREPARADA"}
+}
+
+func confirmar(transacaoID, resposta string) passoReserva {
+	return passoReserva{acao: "CONFIRMAR_RESERVA", conteudo: map[string]interface{}{"transacaoID": transacaoID}, resposta: resposta}
+}
+
+func cancelar(transacaoID string) passoReserva {
+	return passoReserva{acao: "CANCELAR_RESERVA", conteudo: map[string]interface{}{"transacaoID": transacaoID}, resposta: "RESERVA_CANCELADA"}
+}
+
+func reservarDireto(carroID string) passoReserva {
+	return passoReserva{acao: "RESERVAR_PONTO", conteudo: map[string]interface{}{"carroID": carroID}, resposta: "RESERVA_CONFIRMADA"}
+}
+
+// Exercita as duas fases da reserva de rota do lado do ponto: preparação,
+// confirmação, cancelamento e expiração de preparações não confirmadas
+func TestReservaDuasFases(t *testing.T) {
+	casos := []struct {
+		nome          string
+		maxFila       int
+		passos        []passoReserva
+		fila          []string
+		preparadas    int
+		posicaoFinal  int // Posição informada na última resposta, se maior que zero
+		transacaoFila string
+	}{
+		{
+			nome:   "preparar e confirmar",
+			passos: []passoReserva{preparar("A", "tx-1", 0), confirmar("tx-1", "RESERVA_CONFIRMADA")},
+			fila:   []string{"A"},
+		},
+		{
+			nome:         "confirmação repetida devolve a mesma posição",
+			passos:       []passoReserva{reservarDireto("B"), preparar("A", "tx-1", 0), confirmar("tx-1", "RESERVA_CONFIRMADA"), confirmar("tx-1", "RESERVA_CONFIRMADA")},
+			fila:         []string{"B", "A"},
+			posicaoFinal: 2,
+		},
+		{
+			nome:   "cancelar libera a vaga preparada",
+			passos: []passoReserva{preparar("A", "tx-1", 0), cancelar("tx-1"), confirmar("tx-1", "RESERVA_RECUSADA")},
+			fila:   []string{},
+		},
+		{
+			nome:   "cancelar depois de confirmar retira o carro da fila",
+			passos: []passoReserva{preparar("A", "tx-1", 0), confirmar("tx-1", "RESERVA_CONFIRMADA"), cancelar("tx-1")},
+			fila:   []string{},
+		},
+		{
+			nome: "cancelar retira só a vaga da transação",
+			passos: []passoReserva{
+				reservarDireto("A"), reservarDireto("B"),
+				preparar("A", "tx-1", 0), confirmar("tx-1", "RESERVA_CONFIRMADA"),
+				cancelar("tx-1"),
+			},
+			fila: []string{"A", "B"},
+		},
+		{
+			nome: "cancelar uma transação não afeta outra do mesmo carro",
+			passos: []passoReserva{
+				preparar("A", "tx-1", 0), confirmar("tx-1", "RESERVA_CONFIRMADA"),
+				preparar("A", "tx-2", 0), confirmar("tx-2", "RESERVA_CONFIRMADA"),
+				cancelar("tx-1"),
+			},
+			fila:          []string{"A"},
+			transacaoFila: "tx-2",
+		},
+		{
+			nome:    "vagas preparadas contam para a fila cheia",
+			maxFila: 1,
+			passos: []passoReserva{
+				preparar("A", "tx-1", 0),
+				{acao: "PREPARAR_RESERVA", conteudo: map[string]interface{}{"carroID": "B", "transacaoID": "tx-2"}, resposta: "RESERVA_RECUSADA"},
+			},
+			fila:       []string{},
+			preparadas: 1,
+		},
+		{
+			nome: "preparação expira sem confirmação",
+			passos: []passoReserva{
+				preparar("A", "tx-1", 0.05),
+				func() passoReserva {
+					p := confirmar("tx-1", "RESERVA_RECUSADA")
+					p.espera = 200 * time.Millisecond
+					return p
+				}(),
+			},
+			fila: []string{},
+		},
+	}
+
+	maxFilaOriginal := maxFila
+	defer func() { maxFila = maxFilaOriginal }()
+
+	for _, caso := range casos {
+		t.Run(caso.nome, func(t *testing.T) {
+			reiniciarFila()
+			defer reiniciarFila()
+			maxFila = maxFilaOriginal
+			if caso.maxFila > 0 {
+				maxFila = caso.maxFila
+			}
+
+			var ultima Message
+			for _, passo := range caso.passos {
+				time.Sleep(passo.espera)
+				ultima = enviarAoPonto(t, Message{Action: passo.acao, Content: passo.conteudo})
+				if ultima.Action != passo.resposta {
+					t.Fatalf("%s %v: resposta %s, esperada %s (%v)", passo.acao, passo.conteudo, ultima.Action, passo.resposta, ultima.Content)
+				}
+			}
+			if caso.posicaoFinal > 0 && ultima.Content["posicao_fila"] != float64(caso.posicaoFinal) {
+				t.Errorf("posição %v, esperada %d", ultima.Content["posicao_fila"], caso.posicaoFinal)
+			}
+
+			queueMutex.Lock()
+			defer queueMutex.Unlock()
+			if fila := carrosNaFila(); !reflect.DeepEqual(fila, caso.fila) {
+				t.Errorf("fila %v, esperada %v", fila, caso.fila)
+			}
+			if len(reservasPreparadas) != caso.preparadas {
+				t.Errorf("%d vagas preparadas, esperadas %d", len(reservasPreparadas), caso.preparadas)
+			}
+			if caso.transacaoFila != "" && posicaoDaTransacao(caso.transacaoFila) != 1 {
+				t.Errorf("vaga da transação %s não está no início da fila", caso.transacaoFila)
+			}
+		})
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"encoding/json"
 	"fmt"
+	"math"
 	"math/rand"
 	"net"
 	"os"
@@ -19,31 +20,49 @@ type Message struct {
 }
 
 type Carro struct {
-	ID             string      `json:"id"`
-	Porta          string      `json:"porta"`
-	Latitude       float64     `json:"latitude"`
-	Longitude      float64     `json:"longitude"`
-	Bateria        int         `json:"bateria"`
-	Historico      []Historico `json:"historico"`
-	EmFila         bool        `json:"em_fila"`
-	PontoReservado string      `json:"ponto_reservado"`
-	isCarregando   bool        `json:"is_carregando"`
+	ID             string       `json:"id"`
+	Porta          string       `json:"porta"`
+	Latitude       float64      `json:"latitude"`
+	Longitude      float64      `json:"longitude"`
+	Bateria        float64      `json:"bateria"` // Estado de carga (%)
+	CapacidadeKWh  float64      `json:"capacidade_kwh"`
+	PotenciaMaxKW  float64      `json:"potencia_max_kw"` // Potência máxima de recarga aceita
+	VelocidadeKmH  float64      `json:"velocidade_kmh"`
+	TemperaturaC   *float64     `json:"temperatura_c,omitempty"` // Temperatura ambiente, se conhecida
+	Rota           []Coordenada `json:"rota"`                    // Pontos de passagem ainda não alcançados
+	DestinoPonto   string       `json:"destino_ponto,omitempty"` // Ponto reservado para onde o carro está indo
+	OdometroKm     float64      `json:"odometro_km"`
+	Historico      []Historico  `json:"historico"`
+	EmFila         bool         `json:"em_fila"`
+	PontoReservado string       `json:"ponto_reservado"`
+	ReservasRota   []string     `json:"reservas_rota"` // Próximas paradas já reservadas
+	isCarregando   bool
 }
 
 type Historico struct {
 	ID                   string               `json:"historicoID"`
+	Recibo               string               `json:"recibo"`            // Número do recibo emitido pelo servidor
+	Disputa              string               `json:"disputa,omitempty"` // Situação da disputa da cobrança, se houver
 	SessaoDeCarregamento SessaoDeCarregamento `json:"sessao_de_carregamento"`
 	Pagamento            Pagamento            `json:"pagamento"`
 }
 
+// Horários e energia medidos pelo ponto de recarga e confirmados pelo servidor
 type SessaoDeCarregamento struct {
-	Inicio time.Time `json:"inicio"`
-	Fim    time.Time `json:"fim"`
+	Inicio     time.Time `json:"inicio"`
+	Fim        time.Time `json:"fim"`
+	EnergiaKWh float64   `json:"energia_kwh"`
 }
 
 type Pagamento struct {
-	Valor float64 `json:"valor"`
-	Pago  bool    `json:"status"`
+	Valor Dinheiro `json:"valor"`
+	Moeda string   `json:"moeda"`
+	Pago  bool     `json:"status"`
+	// Abatimento aprovado em disputa e valor já devolvido ao carro
+	Ajuste      Dinheiro `json:"ajuste,omitempty"`
+	Reembolsado Dinheiro `json:"reembolsado,omitempty"`
+	// Reaproveitada em novas tentativas, para que o servidor nunca cobre duas vezes
+	ChaveIdempotencia string `json:"chave_idempotencia"`
 }
 
 const (
@@ -51,6 +70,14 @@ const (
 	fazerReservaAction       = "RESERVAR_PONTO"
 	inicioCarregamentoAction = "INICIO_CARREGAMENTO"
 	fimCarregamentoAction    = "FIM_CARREGAMENTO"
+	planejarViagemAction     = "PLANEJAR_VIAGEM"
+	reservarRotaAction       = "RESERVAR_ROTA"
+)
+
+// Bateria dos carros simulados; o consumo está em consumo.go
+const (
+	capacidadeBateriaKWh = 60.0
+	potenciaMaxKW        = 100.0
 )
 
 var (
@@ -60,16 +87,28 @@ var (
 	alertaEnviado          bool
 	porta                  = os.Getenv("PORTA")
 	ultimosPontosRecebidos []map[string]interface{}
+	ultimoPlanoViagem      []string // IDs dos pontos de parada do último plano recebido
+	ultimoExtrato          []map[string]interface{}
+	sessoesSelecionadas    []string // Sessões do extrato escolhidas para pagamento
+	totalSelecionado       Dinheiro
+	moeda                  = "BRL"                    // Atualizada com a moeda informada pelo servidor
+	cupom                  string                     // Enviado na próxima reserva ou pagamento
+	limitesCarregamento    = map[string]interface{}{} // SOC alvo, energia e custo máximos da próxima sessão
+	somenteAlcancaveis     bool                       // Oculta da lista os pontos fora do alcance
 
 	carro = Carro{
-		ID:           "carro-" + os.Getenv("HOSTNAME") + "-" + strconv.Itoa(rand.Intn(1000)),
-		Porta:        porta,
-		Latitude:     rand.Float64()*180 - 90,
-		Longitude:    rand.Float64()*360 - 180,
-		Bateria:      100,
-		Historico:    []Historico{},
-		EmFila:       false,
-		isCarregando: false,
+		ID:            "carro-" + os.Getenv("HOSTNAME") + "-" + strconv.Itoa(rand.Intn(1000)),
+		Porta:         porta,
+		Latitude:      lerFloatEnv("LAT", rand.Float64()*180-90),
+		Longitude:     lerFloatEnv("LON", rand.Float64()*360-180),
+		Bateria:       100,
+		CapacidadeKWh: capacidadeBateriaKWh,
+		PotenciaMaxKW: potenciaMaxKW,
+		VelocidadeKmH: lerFloatEnv("VELOCIDADE_KMH", velocidadePadraoKmH),
+		TemperaturaC:  lerTemperaturaEnv(),
+		Historico:     []Historico{},
+		EmFila:        false,
+		isCarregando:  false,
 	}
 )
 
@@ -77,9 +116,141 @@ func main() {
 	go entradaUsuario(commandChan)   // Captura entrada do usuário
 	go monitorarBateria(commandChan) // Monitora a bateria
 
-	var modoReserva bool = false // Modo de reserva de ponto
+	var modoReserva bool = false  // Modo de reserva de ponto
+	var modoViagem bool = false   // Aguardando coordenadas do destino
+	var modoCarteira bool = false // Aguardando valor da recarga da carteira
+	var modoExtrato bool = false  // Aguardando escolha das sessões do extrato
+	var modoValorExtrato bool = false
+	var modoDisputa bool = false // Aguardando o motivo da disputa
+	var modoCupom bool = false   // Aguardando o código do cupom
+	var modoLimites bool = false // Aguardando os limites do carregamento
+	var modoRota bool = false    // Aguardando os pontos de passagem da rota
+	var modoVelocidade bool = false
 	mostrarMenu()
 	for cmd := range commandChan {
+		if modoVelocidade {
+			velocidade, err := strconv.ParseFloat(strings.TrimSpace(cmd), 64)
+			if err != nil || velocidade <= 0 {
+				fmt.Println("Velocidade inválida. Digite um valor positivo em km/h.")
+				continue
+			}
+			mutex.Lock()
+			carro.VelocidadeKmH = velocidade
+			fmt.Printf("Velocidade alterada para %.0f km/h (%.3f kWh/km, alcance de %.0f km).\n", velocidade, carro.consumoAtual(), carro.alcanceKm())
+			mutex.Unlock()
+			modoVelocidade = false
+			mostrarMenu()
+			continue
+		}
+		if modoRota {
+			rota, err := lerRota(cmd)
+			if err != nil {
+				fmt.Println("Rota inválida. Use o formato: latitude longitude; latitude longitude")
+				continue
+			}
+			mutex.Lock()
+			carro.Rota = rota
+			carro.DestinoPonto = ""
+			mutex.Unlock()
+			if len(rota) == 0 {
+				fmt.Println("Sem rota definida: o carro passeia por destinos aleatórios próximos.")
+			} else {
+				fmt.Printf("Rota com %d ponto(s) de passagem definida.\n", len(rota))
+			}
+			modoRota = false
+			mostrarMenu()
+			continue
+		}
+		if modoLimites {
+			limites, err := lerLimites(cmd)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			limitesCarregamento = limites
+			if len(limites) == 0 {
+				fmt.Println("Próximo carregamento sem limites: termina com 'F'.")
+			} else {
+				fmt.Println("Limites do próximo carregamento:", limites)
+			}
+			modoLimites = false
+			mostrarMenu()
+			continue
+		}
+		if modoCupom {
+			cupom = strings.ToUpper(strings.TrimSpace(cmd))
+			if cupom == "" {
+				fmt.Println("Cupom removido.")
+			} else {
+				fmt.Printf("Cupom %s será usado na próxima reserva ou pagamento.\n", cupom)
+			}
+			modoCupom = false
+			mostrarMenu()
+			continue
+		}
+		if modoDisputa {
+			if strings.TrimSpace(cmd) == "" {
+				fmt.Println("Disputa cancelada.")
+			} else if msg := abrirDisputaUltimaSessao(carro.Historico, carro.ID, cmd); msg != nil {
+				enviarMensagem(*msg)
+			}
+			modoDisputa = false
+			mostrarMenu()
+			continue
+		}
+		if modoValorExtrato {
+			valor := totalSelecionado
+			if cmd != "" {
+				var err error
+				valor, err = parseDinheiro(cmd)
+				if err != nil || valor <= 0 || valor > totalSelecionado {
+					fmt.Printf("Valor inválido. Digite até %s %s ou Enter para pagar tudo.\n", moeda, totalSelecionado)
+					continue
+				}
+			}
+			enviarMensagem(pagarTodas(carro.ID, sessoesSelecionadas, valor))
+			modoValorExtrato = false
+			mostrarMenu()
+			continue
+		}
+		if modoExtrato {
+			if cmd == "" {
+				fmt.Println("Pagamento cancelado.")
+				modoExtrato = false
+				mostrarMenu()
+				continue
+			}
+			if err := selecionarSessoesExtrato(cmd); err != nil {
+				fmt.Println(err)
+				continue
+			}
+			fmt.Printf("Valor a pagar (Enter para o total de %s %s):\n", moeda, totalSelecionado)
+			modoExtrato = false
+			modoValorExtrato = true
+			continue
+		}
+		if modoCarteira {
+			valor, err := parseDinheiro(cmd)
+			if err != nil || valor <= 0 {
+				fmt.Println("Valor inválido. Digite um valor positivo (ex: 50.00).")
+				continue
+			}
+			enviarMensagem(recarregarCarteira(carro.ID, valor))
+			modoCarteira = false
+			mostrarMenu()
+			continue
+		}
+		if modoViagem {
+			destinoLat, destinoLon, err := lerCoordenadas(cmd)
+			if err != nil {
+				fmt.Println("Coordenadas inválidas. Use o formato: latitude longitude")
+				continue
+			}
+			enviarMensagem(planejarViagem(carro, destinoLat, destinoLon))
+			modoViagem = false
+			mostrarMenu()
+			continue
+		}
 		if modoReserva {
 			escolha, err := strconv.Atoi(cmd)
 			if err != nil || escolha < 1 || escolha > len(ultimosPontosRecebidos) {
@@ -97,6 +268,9 @@ func main() {
 					"EmFila":  carro.EmFila,
 				},
 			}
+			if cupom != "" {
+				msg.Content["cupom"] = cupom
+			}
 			enviarMensagem(msg)
 			modoReserva = false
 			continue
@@ -115,6 +289,14 @@ func main() {
 			fmt.Println("Digite o número do ponto que deseja reservar:")
 			modoReserva = true
 
+		case "G":
+			if !carro.EmFila {
+				fmt.Println("Você precisa reservar um ponto antes de fazer o check-in.")
+				continue
+			}
+			fmt.Println("\n-> Fazendo check-in no ponto reservado...")
+			enviarMensagem(checkIn(carro))
+
 		case "I":
 			fmt.Println("\n-> Informando início do carregamento...")
 			enviarMensagem(inicioCarregamento(&carro))
@@ -131,9 +313,99 @@ func main() {
 			if msg := pagarUltimaPendenciaEmAberto(carro.Historico, carro.ID); msg != nil {
 				enviarMensagem(*msg)
 			}
+		case "E":
+			fmt.Println("\n-> Consultando extrato de pendências...")
+			enviarMensagem(Message{
+				Action:  "EXTRATO",
+				Content: map[string]interface{}{"carroID": carro.ID},
+			})
+			if len(ultimoExtrato) > 0 {
+				fmt.Println("Digite os números das sessões a pagar (ex: 1 3), 'T' para todas, ou Enter para cancelar:")
+				modoExtrato = true
+				continue
+			}
+		case "N":
+			fmt.Println("\n-> Buscando recibo da última sessão...")
+			if msg := reciboUltimaSessao(carro.Historico, carro.ID); msg != nil {
+				enviarMensagem(*msg)
+			}
+		case "D":
+			fmt.Println("Descreva o motivo da contestação da última sessão (Enter para cancelar):")
+			modoDisputa = true
+			continue
+		case "A":
+			fmt.Println("\n-> Consultando disputa da última sessão...")
+			if msg := consultarDisputaUltimaSessao(carro.Historico, carro.ID); msg != nil {
+				enviarMensagem(*msg)
+			}
+		case "M":
+			fmt.Println("\n-> Buscando extrato do mês...")
+			enviarMensagem(Message{
+				Action: "EXTRATO_MENSAL",
+				Content: map[string]interface{}{
+					"carroID": carro.ID,
+					"mes":     time.Now().Format("2006-01"),
+					"formato": "TEXTO",
+				},
+			})
+		case "X":
+			fmt.Println("\n-> Gerando PIX da última pendência...")
+			if msg := gerarPixUltimaPendencia(carro.Historico, carro.ID); msg != nil {
+				enviarMensagem(*msg)
+			}
+		case "C":
+			fmt.Println("Digite o valor a adicionar na carteira:")
+			modoCarteira = true
+			continue
+		case "S":
+			fmt.Println("\n-> Consultando saldo da carteira...")
+			enviarMensagem(Message{
+				Action:  "CONSULTAR_SALDO",
+				Content: map[string]interface{}{"carroID": carro.ID},
+			})
+		case "O":
+			fmt.Println("Digite os limites do carregamento (ex: soc 80, kwh 10, custo 25.00; combináveis) ou Enter para remover:")
+			modoLimites = true
+			continue
+		case "U":
+			fmt.Println("Digite o código do cupom (Enter para remover):")
+			modoCupom = true
+			continue
+		case "Q":
+			fmt.Println("\n-> Consultando plano de assinatura...")
+			enviarMensagem(Message{
+				Action:  "CONSULTAR_PLANO",
+				Content: map[string]interface{}{"carroID": carro.ID},
+			})
+		case "V":
+			fmt.Println("Digite a latitude e a longitude do destino (ex: -22.9068 -43.1729):")
+			modoViagem = true
+			continue
+		case "H":
+			somenteAlcancaveis = !somenteAlcancaveis
+			if somenteAlcancaveis {
+				fmt.Println("Pontos fora do alcance serão ocultados da lista.")
+			} else {
+				fmt.Println("Pontos fora do alcance voltarão a ser listados.")
+			}
+		case "K":
+			fmt.Println("Digite a velocidade do carro em km/h:")
+			modoVelocidade = true
+			continue
+		case "W":
+			fmt.Println("Digite os pontos de passagem da rota (ex: -23.5505 -46.6333; -22.9068 -43.1729) ou Enter para passear:")
+			modoRota = true
+			continue
+		case "T":
+			if len(ultimoPlanoViagem) == 0 {
+				fmt.Println("Você precisa planejar uma viagem com paradas antes de reservá-las.")
+				continue
+			}
+			fmt.Println("\n-> Reservando todas as paradas da viagem...")
+			enviarMensagem(reservarRota(carro, ultimoPlanoViagem))
 
 		default:
-			fmt.Println("\n-> Comando inválido. Use B, R, I, F ou P.")
+			fmt.Println("\n-> Comando inválido. Use B, R, G, I, F, O, P, E, N, M, D, A, X, C, S, U, Q, V, T, W, K ou H.")
 		}
 		mostrarMenu()
 	}
@@ -146,6 +418,9 @@ func handleServerResponse(r string) {
 
 	var response Message
 	err := json.Unmarshal([]byte(r), &response)
+	if codigo, ok := response.Content["moeda"].(string); ok {
+		moeda = codigo
+	}
 	if err != nil {
 		fmt.Println("Erro ao decodificar a resposta do servidor:", err)
 		return
@@ -158,12 +433,42 @@ func handleServerResponse(r string) {
 		fmt.Println("Pontos de recarga listados com sucesso!")
 	case "RESERVA_CONFIRMADA":
 		handleReservaConfirmada(response.Content)
+	case "CHECK_IN_CONFIRMADO":
+		handleCheckInConfirmado(response.Content)
 	case "CARREGAMENTO_INICIADO":
 		handleCarregamentoInciado(response.Content)
 	case "PAGAMENTO_CONFIRMADO":
 		handlePagamentoConfirmado(response, &carro.Historico)
+	case "CARTEIRA_RECARREGADA", "SALDO_CARTEIRA":
+		handleSaldoCarteira(response.Content)
+	case "EXTRATO":
+		handleExtrato(response.Content)
+	case "PAGAMENTOS_CONFIRMADOS":
+		handlePagamentosConfirmados(response.Content)
+	case "RECIBO", "EXTRATO_MENSAL":
+		fmt.Println()
+		fmt.Print(response.Content["texto"])
+	case "TELEMETRIA":
+		handleTelemetria(response.Content)
+	case "TELEMETRIA_ENCERRADA":
+		fmt.Printf("\nAcompanhamento da sessão %s encerrado.\n", response.Content["historicoID"])
+	case "PLANO":
+		handlePlano(response.Content)
+	case "DISPUTA_ABERTA", "DISPUTA":
+		handleDisputa(response.Content, &carro.Historico)
+	case "PIX_GERADO":
+		handlePixGerado(response.Content)
+	case "PLANO_VIAGEM":
+		handlePlanoViagem(response.Content)
+	case "RESERVA_ROTA_CONFIRMADA":
+		handleReservaRotaConfirmada(response.Content)
+	case "RESERVA_DESISTIDA":
+		fmt.Printf("Ponto %s: %v\n", response.Content["ID"], response.Content["mensagem"])
 	case "ERRO":
 		fmt.Println("Erro:", response.Content["mensagem"])
+		if response.Content["codigo"] == "DEBITO_PENDENTE" {
+			fmt.Printf("Total em aberto: %s %s. Pague suas pendências com 'P' ou 'X' para voltar a reservar.\n", moeda, lerDinheiro(response.Content["total_em_aberto"]))
+		}
 	default:
 		fmt.Println("Ação não reconhecida:", response.Action)
 	}
@@ -173,24 +478,106 @@ func handleCarregamentoInciado(content map[string]interface{}) {
 	fmt.Println("Carregamento iniciado com sucesso!")
 	carro.isCarregando = true
 	fmt.Println("ID do ponto de recarga:", content["pontoID"])
+	if potencia, ok := content["potencia_kw"].(float64); ok {
+		fmt.Printf("Potência de recarga: %.1f kW (bateria em %.0f%%)\n", potencia, carro.Bateria)
+	}
+	if alocada, ok := content["potencia_alocada_kw"].(float64); ok {
+		fmt.Printf("Potência alocada pelo site %s: %.1f kW\n", content["site"], alocada)
+	}
+
+	// A sessão é identificada pelo ID que o servidor usa na cobrança
+	novoHistorico := Historico{
+		ID: fmt.Sprint(content["historicoID"]),
+		SessaoDeCarregamento: SessaoDeCarregamento{
+			Inicio: time.Now(),
+		},
+	}
+	if inicio, err := time.Parse(time.RFC3339Nano, fmt.Sprint(content["inicio"])); err == nil {
+		novoHistorico.SessaoDeCarregamento.Inicio = inicio
+	}
+	carro.Historico = append(carro.Historico, novoHistorico)
+	fmt.Println("Sessão registrada no histórico:", novoHistorico.ID)
+
+	// As leituras do ponto chegam em outra conexão enquanto a sessão durar
+	go enviarMensagem(Message{
+		Action: "ACOMPANHAR_CARREGAMENTO",
+		Content: map[string]interface{}{
+			"carroID": carro.ID,
+			"pontoID": fmt.Sprint(content["pontoID"]),
+		},
+	})
+}
+
+// Reescreve a mesma linha do terminal a cada leitura do medidor
+func handleTelemetria(content map[string]interface{}) {
+	decorrido := time.Duration(lerFloat(content["decorrido_segundos"]) * float64(time.Second)).Round(time.Second)
+	linha := fmt.Sprintf("%.3f kWh | %.1f kW | %s", lerFloat(content["energia_kwh"]), lerFloat(content["potencia_kw"]), decorrido)
+	if alocada, ok := content["potencia_alocada_kw"].(float64); ok {
+		linha += fmt.Sprintf(" (site: %.1f kW)", alocada)
+	}
+	if custo, ok := content["custo_parcial"]; ok {
+		linha += fmt.Sprintf(" | %s %s", moeda, lerDinheiro(custo))
+	}
+	if restante, ok := content["tempo_restante_segundos"].(float64); ok {
+		linha += fmt.Sprintf(" | faltam %s", time.Duration(restante*float64(time.Second)).Round(time.Second))
+	}
+	if soc, ok := content["soc"].(float64); ok {
+		cheios := int(soc / 5)
+		linha = fmt.Sprintf("[%s%s] %5.1f%% | %s", strings.Repeat("#", cheios), strings.Repeat(".", 20-cheios), soc, linha)
+	}
+	fmt.Printf("\rCarregando %s   ", linha)
+}
+
+func lerFloat(valor interface{}) float64 {
+	numero, _ := valor.(float64)
+	return numero
 }
 
 func handleCarregamentoFinalizado(content map[string]interface{}) {
+	fmt.Println()
 	fmt.Println("Carregamento finalizado com sucesso!")
-	fmt.Println("Valor do pagamento:", content["valor"])
-	carro.adicionarPagamento(content["valor"].(float64))
+	if motivo, ok := content["motivo"].(string); ok {
+		fmt.Println("Encerrado automaticamente pelo limite:", motivo)
+	}
+	fmt.Printf("Duração: %.0fs, Energia: %.3f kWh\n", content["duracao_segundos"], content["energia_kwh"])
+	valor := lerDinheiro(content["valor"])
+	if descontos, ok := content["descontos"].([]interface{}); ok && len(descontos) > 0 {
+		fmt.Printf("Valor bruto: %s %s\n", moeda, lerDinheiro(content["valor_bruto"]))
+		for _, d := range descontos {
+			if desconto, ok := d.(map[string]interface{}); ok {
+				fmt.Printf("  %s: -%s %s\n", desconto["descricao"], moeda, lerDinheiro(desconto["valor"]))
+			}
+		}
+	}
+	fmt.Printf("Valor do pagamento: %s %s\n", moeda, valor)
+	fmt.Printf("Recibo nº %s (digite 'N' para visualizá-lo)\n", content["recibo"])
+	carro.registrarMedicao(content)
+	carro.adicionarPagamento(valor)
+	if debitado := lerDinheiro(content["debitado_carteira"]); debitado > 0 {
+		fmt.Printf("Debitado da carteira: %s %s\n", moeda, debitado)
+	}
+	if _, ok := content["valor_pendente"]; ok {
+		carro.atualizarPendencia(lerDinheiro(content["valor_pendente"]))
+	}
 	fmt.Println("Pagamento adicionado ao histórico do carro.")
 	carro.isCarregando = false
 	carro.EmFila = false
-	carro.Bateria = 100
+	carro.atualizarBateria(content)
+	avancarReservaRota(&carro)
 	fmt.Println(carro)
 }
 
 func handleReservaConfirmada(content map[string]interface{}) {
 	fmt.Println("Reserva confirmada com sucesso!")
+	if codigo, ok := content["cupom"].(string); ok {
+		fmt.Printf("Cupom %s será aplicado ao fim da sessão.\n", codigo)
+		cupom = ""
+	}
 	carro.EmFila = true
 	carro.PontoReservado = content["ID"].(string)
 	fmt.Println("Ponto reservado:", carro.PontoReservado)
+	registrarCoordenadasPonto(content["ID"], content)
+	seguirParaPonto(carro.PontoReservado)
 }
 
 func handleListaPontos(content map[string]interface{}) []map[string]interface{} {
@@ -198,6 +585,13 @@ func handleListaPontos(content map[string]interface{}) []map[string]interface{}
 	var pontosFormatados []map[string]interface{}
 
 	fmt.Println("\nLista de pontos de recarga disponíveis:")
+	if alcance, ok := content["alcance_km"].(float64); ok {
+		fmt.Printf("Alcance atual: %.0f km", alcance)
+		if ocultos := lerFloat(content["ocultos"]); ocultos > 0 {
+			fmt.Printf(" (%.0f ponto(s) fora do alcance ocultos)", ocultos)
+		}
+		fmt.Println()
+	}
 	for i, ponto := range pontosRaw {
 		pontoMap := ponto.(map[string]interface{})
 
@@ -216,7 +610,46 @@ func handleListaPontos(content map[string]interface{}) []map[string]interface{}
 			distancia,
 			int(tamanhoFilaFloat), // conversão segura
 		)
+		if tempo, ok := pontoMap["tempo_min"].(float64); ok {
+			fmt.Printf("   Pelas ruas: cerca de %.0f min de direção\n", tempo)
+		}
+		if nome, ok := pontoMap["nome"].(string); ok {
+			fmt.Printf("   %s", nome)
+			if endereco, ok := pontoMap["endereco"].(string); ok {
+				fmt.Printf(" - %s", endereco)
+			}
+			fmt.Println()
+		}
+		if conectores, ok := pontoMap["conectores"].([]interface{}); ok {
+			fmt.Printf("   Conectores: %v\n", conectores)
+		}
+		if tarifa, ok := pontoMap["tarifa"].(map[string]interface{}); ok {
+			fmt.Printf(
+				"   Tarifa %s: R$ %.2f/sessão + R$ %.2f/kWh + R$ %.2f/min, ociosidade R$ %.2f/min após %.0f min\n",
+				tarifa["nome"],
+				tarifa["taxa_sessao"],
+				tarifa["preco_kwh"],
+				tarifa["preco_minuto"],
+				tarifa["taxa_ociosidade_minuto"],
+				tarifa["tolerancia_ociosidade_minutos"],
+			)
+		}
+		if alcance, ok := pontoMap["alcance"].(map[string]interface{}); ok {
+			situacao := "fora do alcance"
+			if alcance["alcancavel"] == true {
+				situacao = "alcançável"
+			}
+			if soc, ok := alcance["soc_chegada"].(float64); ok {
+				fmt.Printf("   %s, chegada com %.0f%% de bateria\n", situacao, soc)
+			} else {
+				fmt.Printf("   %s, chegada com %.1f kWh\n", situacao, alcance["energia_chegada_kwh"])
+			}
+		}
+		if site, ok := pontoMap["site"].(string); ok {
+			fmt.Printf("   Site %s: até %.1f kW disponíveis agora\n", site, lerFloat(pontoMap["potencia_kw"]))
+		}
 
+		registrarCoordenadasPonto(pontoMap["ID"], pontoMap)
 		pontosFormatados = append(pontosFormatados, pontoMap)
 	}
 
@@ -228,14 +661,22 @@ func pagarUltimaPendenciaEmAberto(historico []Historico, carroID string) *Messag
 	// Percorre o histórico de trás para frente
 	for i := len(historico) - 1; i >= 0; i-- {
 		if !historico[i].Pagamento.Pago {
+			if historico[i].Pagamento.ChaveIdempotencia == "" {
+				historico[i].Pagamento.ChaveIdempotencia = fmt.Sprintf("%s-%s-%d", carroID, historico[i].ID, time.Now().UnixNano())
+			}
 			msg := Message{
 				Action: "PAGAR_PENDENCIA",
 				Content: map[string]interface{}{
-					"carroID":     carroID,
-					"historicoID": historico[i].ID,
-					"valor":       historico[i].Pagamento.Valor,
+					"carroID":            carroID,
+					"historicoID":        historico[i].ID,
+					"valor":              historico[i].Pagamento.Valor,
+					"moeda":              historico[i].Pagamento.Moeda,
+					"chave_idempotencia": historico[i].Pagamento.ChaveIdempotencia,
 				},
 			}
+			if cupom != "" {
+				msg.Content["cupom"] = cupom
+			}
 			return &msg
 		}
 	}
@@ -245,12 +686,223 @@ func pagarUltimaPendenciaEmAberto(historico []Historico, carroID string) *Messag
 	return nil
 }
 
+// Pede ao servidor o PIX copia e cola da pendência mais recente. Repetir o
+// comando depois de pagar no banco traz a confirmação do pagamento.
+func gerarPixUltimaPendencia(historico []Historico, carroID string) *Message {
+	for i := len(historico) - 1; i >= 0; i-- {
+		if !historico[i].Pagamento.Pago {
+			return &Message{
+				Action: "GERAR_PIX",
+				Content: map[string]interface{}{
+					"carroID":     carroID,
+					"historicoID": historico[i].ID,
+				},
+			}
+		}
+	}
+
+	fmt.Println("Nenhuma pendência em aberto para pagamento.")
+	return nil
+}
+
+// Contesta a cobrança da última sessão finalizada
+func abrirDisputaUltimaSessao(historico []Historico, carroID, motivo string) *Message {
+	for i := len(historico) - 1; i >= 0; i-- {
+		if historico[i].Recibo != "" {
+			return &Message{
+				Action: "ABRIR_DISPUTA",
+				Content: map[string]interface{}{
+					"carroID":     carroID,
+					"historicoID": historico[i].ID,
+					"motivo":      motivo,
+				},
+			}
+		}
+	}
+
+	fmt.Println("Nenhuma sessão finalizada para contestar.")
+	return nil
+}
+
+func consultarDisputaUltimaSessao(historico []Historico, carroID string) *Message {
+	for i := len(historico) - 1; i >= 0; i-- {
+		if historico[i].Disputa != "" {
+			return &Message{
+				Action: "CONSULTAR_DISPUTA",
+				Content: map[string]interface{}{
+					"carroID":     carroID,
+					"historicoID": historico[i].ID,
+				},
+			}
+		}
+	}
+
+	fmt.Println("Nenhuma contestação aberta.")
+	return nil
+}
+
+// Atualiza a sessão do histórico com o ajuste e os reembolsos informados
+// pelo servidor, para que os totais do carro e do servidor coincidam
+func handleDisputa(content map[string]interface{}, historico *[]Historico) {
+	disputa, _ := content["disputa"].(map[string]interface{})
+	historicoID, _ := content["historicoID"].(string)
+	fmt.Printf("Disputa %s da sessão %s: %s\n", disputa["id"], historicoID, disputa["status"])
+	if observacao, ok := disputa["observacao"].(string); ok {
+		fmt.Println("Observação do operador:", observacao)
+	}
+
+	for i := range *historico {
+		if (*historico)[i].ID != historicoID {
+			continue
+		}
+		sessao := &(*historico)[i]
+		saldo := lerDinheiro(content["saldo"])
+		sessao.Disputa = fmt.Sprint(disputa["status"])
+		sessao.Pagamento.Ajuste = lerDinheiro(content["ajuste"])
+		sessao.Pagamento.Reembolsado = lerDinheiro(content["total_reembolsado"])
+		if saldo > 0 {
+			sessao.Pagamento.Valor = saldo
+			sessao.Pagamento.Pago = false
+		} else {
+			sessao.Pagamento.Valor = 0
+			sessao.Pagamento.Pago = true
+		}
+
+		if sessao.Pagamento.Ajuste > 0 {
+			fmt.Printf("Ajuste aprovado: %s %s\n", moeda, sessao.Pagamento.Ajuste)
+		}
+		if sessao.Pagamento.Reembolsado > 0 {
+			fmt.Printf("Reembolsado: %s %s\n", moeda, sessao.Pagamento.Reembolsado)
+		}
+		if saldo < 0 {
+			fmt.Printf("A reembolsar: %s %s\n", moeda, -saldo)
+		} else {
+			fmt.Printf("Em aberto: %s %s\n", moeda, saldo)
+		}
+		return
+	}
+}
+
+// Pede em texto o recibo da última sessão já finalizada
+func reciboUltimaSessao(historico []Historico, carroID string) *Message {
+	for i := len(historico) - 1; i >= 0; i-- {
+		if historico[i].Recibo != "" {
+			return &Message{
+				Action: "RECIBO",
+				Content: map[string]interface{}{
+					"carroID":     carroID,
+					"historicoID": historico[i].ID,
+					"formato":     "TEXTO",
+				},
+			}
+		}
+	}
+
+	fmt.Println("Nenhuma sessão finalizada para emitir recibo.")
+	return nil
+}
+
+func handlePixGerado(content map[string]interface{}) {
+	fmt.Printf("\nPIX da sessão %s no valor de %s %s\n", content["historicoID"], moeda, lerDinheiro(content["valor"]))
+	fmt.Println("Copia e cola:")
+	fmt.Println(content["copia_e_cola"])
+	fmt.Println("Após pagar no seu banco, digite 'X' novamente para confirmar.")
+}
+
+func handleExtrato(content map[string]interface{}) {
+	sessoes, _ := content["sessoes"].([]interface{})
+	ultimoExtrato = nil
+
+	fmt.Println("\nExtrato de sessões em aberto:")
+	if len(sessoes) == 0 {
+		fmt.Println("Nenhuma pendência em aberto.")
+		return
+	}
+	for i, item := range sessoes {
+		sessao := item.(map[string]interface{})
+		ultimoExtrato = append(ultimoExtrato, sessao)
+		fmt.Printf(
+			"%d) Sessão: %s, Ponto: %s, Total: %s, Pago: %s, Em aberto: %s\n",
+			i+1,
+			sessao["historicoID"],
+			sessao["pontoID"],
+			lerDinheiro(sessao["valor_total"]),
+			lerDinheiro(sessao["valor_pago"]),
+			lerDinheiro(sessao["saldo"]),
+		)
+	}
+	fmt.Printf("Total em aberto: %s %s\n", moeda, lerDinheiro(content["total_em_aberto"]))
+}
+
+// Interpreta a escolha feita sobre o último extrato ("T" ou números das sessões)
+func selecionarSessoesExtrato(entrada string) error {
+	sessoesSelecionadas = nil
+	totalSelecionado = 0
+
+	if strings.ToUpper(entrada) == "T" {
+		for _, sessao := range ultimoExtrato {
+			totalSelecionado += lerDinheiro(sessao["saldo"])
+		}
+		return nil
+	}
+
+	for _, campo := range strings.Fields(entrada) {
+		escolha, err := strconv.Atoi(campo)
+		if err != nil || escolha < 1 || escolha > len(ultimoExtrato) {
+			return fmt.Errorf("Escolha inválida: %s. Use os números mostrados no extrato.", campo)
+		}
+		sessao := ultimoExtrato[escolha-1]
+		sessoesSelecionadas = append(sessoesSelecionadas, sessao["historicoID"].(string))
+		totalSelecionado += lerDinheiro(sessao["saldo"])
+	}
+	return nil
+}
+
+// Paga as sessões escolhidas (ou todas, se nenhuma) em uma única requisição
+func pagarTodas(carroID string, sessoes []string, valor Dinheiro) Message {
+	return Message{
+		Action: "PAGAR_TODAS",
+		Content: map[string]interface{}{
+			"carroID":            carroID,
+			"historicoIDs":       sessoes,
+			"valor":              valor,
+			"moeda":              moeda,
+			"chave_idempotencia": fmt.Sprintf("%s-lote-%d", carroID, time.Now().UnixNano()),
+		},
+	}
+}
+
+func handlePagamentosConfirmados(content map[string]interface{}) {
+	alocacoes, _ := content["alocacoes"].([]interface{})
+	fmt.Println("Pagamento confirmado! Transação:", content["transacaoID"])
+
+	for _, item := range alocacoes {
+		alocacao := item.(map[string]interface{})
+		historicoID := alocacao["historicoID"].(string)
+		valor := lerDinheiro(alocacao["valor"])
+		fmt.Printf("- Sessão %s: %s %s\n", historicoID, moeda, valor)
+
+		for i := range carro.Historico {
+			if carro.Historico[i].ID == historicoID {
+				pagamento := &carro.Historico[i].Pagamento
+				pagamento.Valor -= valor
+				pagamento.Pago = pagamento.Valor <= 0
+			}
+		}
+	}
+	fmt.Printf("Total ainda em aberto: %s %s\n", moeda, lerDinheiro(content["total_em_aberto"]))
+}
+
 func handlePagamentoConfirmado(msg Message, historico *[]Historico) {
 	historicoID, ok := msg.Content["historicoID"].(string)
 	if !ok {
 		fmt.Println("Erro: historicoID inválido ou ausente na resposta do servidor.")
 		return
 	}
+	if desconto, ok := msg.Content["desconto"].(map[string]interface{}); ok {
+		fmt.Printf("%s: -%s %s. Valor cobrado: %s %s\n", desconto["descricao"], moeda, lerDinheiro(desconto["valor"]), moeda, lerDinheiro(msg.Content["valor_cobrado"]))
+		cupom = ""
+	}
 
 	for i := range *historico {
 		if (*historico)[i].ID == historicoID {
@@ -267,39 +919,125 @@ func handlePagamentoConfirmado(msg Message, historico *[]Historico) {
 	fmt.Printf("Sessão %s não encontrada no histórico local.\n", historicoID)
 }
 
+func handlePlanoViagem(content map[string]interface{}) {
+	paradas, _ := content["paradas"].([]interface{})
+	ultimoPlanoViagem = nil
+	fmt.Printf("\nPlano de viagem (%.2f km em linha reta):\n", content["distancia_total"])
+	if len(paradas) == 0 {
+		fmt.Println("Nenhuma parada necessária.")
+	}
+	for i, p := range paradas {
+		parada := p.(map[string]interface{})
+		ultimoPlanoViagem = append(ultimoPlanoViagem, parada["pontoID"].(string))
+		registrarCoordenadasPonto(parada["pontoID"], parada)
+		fmt.Printf(
+			"%d) Ponto: %s, Trecho: %.2f km, Chegada: %.0f%%, Saída: %.0f%%, Recarga: %.0f min\n",
+			i+1,
+			parada["pontoID"],
+			parada["distancia_trecho"],
+			parada["soc_chegada"],
+			parada["soc_saida"],
+			parada["tempo_carregamento"],
+		)
+	}
+	fmt.Printf("Bateria estimada na chegada ao destino: %.0f%%\n", content["soc_chegada_destino"])
+	if len(ultimoPlanoViagem) > 0 {
+		fmt.Println("Digite 'T' para reservar todas as paradas de uma vez.")
+	}
+}
+
+func handleReservaRotaConfirmada(content map[string]interface{}) {
+	reservas, _ := content["reservas"].([]interface{})
+	fmt.Println("Reserva da rota confirmada! Transação:", content["transacaoID"])
+
+	carro.ReservasRota = nil
+	for _, r := range reservas {
+		reserva := r.(map[string]interface{})
+		fmt.Printf("- Ponto: %s, Posição na fila: %v\n", reserva["pontoID"], reserva["posicao_fila"])
+		carro.ReservasRota = append(carro.ReservasRota, reserva["pontoID"].(string))
+	}
+	avancarReservaRota(&carro)
+}
+
+// Passa a usar a próxima parada reservada da rota, se houver
+func avancarReservaRota(c *Carro) {
+	if len(c.ReservasRota) == 0 {
+		return
+	}
+	c.PontoReservado = c.ReservasRota[0]
+	c.ReservasRota = c.ReservasRota[1:]
+	c.EmFila = true
+	fmt.Println("Próxima parada reservada:", c.PontoReservado)
+	seguirParaPonto(c.PontoReservado)
+}
+
 // Mostra o menu de opções para o usuário
 func mostrarMenu() {
 	fmt.Println("\n--- MENU ---")
 	fmt.Println("B - Bateria crítica")
 	fmt.Println("R - Reservar ponto de recarga")
+	fmt.Println("G - Fazer check-in no ponto reservado")
 	fmt.Println("I - Iniciar carregamento")
 	fmt.Println("F - Finalizar carregamento")
+	fmt.Println("O - Definir SOC alvo, energia ou custo máximo do carregamento")
 	fmt.Println("P - Pagar última pendência")
+	fmt.Println("E - Extrato e pagamento de várias pendências")
+	fmt.Println("N - Ver recibo da última sessão")
+	fmt.Println("M - Ver extrato do mês")
+	fmt.Println("D - Contestar a cobrança da última sessão")
+	fmt.Println("A - Acompanhar a contestação da última sessão")
+	fmt.Println("X - Pagar última pendência com PIX")
+	fmt.Println("C - Adicionar saldo à carteira")
+	fmt.Println("S - Consultar saldo da carteira")
+	fmt.Println("U - Informar cupom de desconto")
+	fmt.Println("Q - Consultar plano de assinatura")
+	fmt.Println("V - Planejar viagem")
+	fmt.Println("T - Reservar todas as paradas da viagem")
+	fmt.Println("W - Definir rota do carro")
+	fmt.Println("K - Alterar velocidade do carro")
+	fmt.Println("H - Ocultar/mostrar pontos fora do alcance na lista")
 	fmt.Print("Escolha uma opção: ")
 }
 
-// Monitora a bateria e reduz ao longo do tempo
+// Movimenta o carro pela rota e descarrega a bateria conforme a distância
+// percorrida. Sem rota, o carro passeia por destinos aleatórios próximos.
 func monitorarBateria(commandChan chan<- string) {
 	for {
-		time.Sleep(5 * time.Second) // consumo de bateria
+		time.Sleep(intervaloSimulacao)
 		mutex.Lock()
-		carro.Bateria -= 10
-		if carro.Bateria < 10 {
-			carro.Bateria = 0
+		if carro.estacionado() { // A bateria não descarrega parada ou conectada ao ponto
+			mutex.Unlock()
+			continue
 		}
-
 		if carro.Bateria == 0 {
+			if !bateriaEsgotada {
+				fmt.Printf("\nBateria esgotada em (%.4f, %.4f). O carro está parado.\n", carro.Latitude, carro.Longitude)
+				bateriaEsgotada = true
+			}
 			mutex.Unlock()
 			continue
 		}
-		fmt.Printf("\nBateria - Nível atual: %d%%\n", carro.Bateria)
+		bateriaEsgotada = false
 
-		// envia alerta apenas uma vez quando a bateria chega a 20%
-		if carro.Bateria <= 20 && !alertaEnviado {
-			commandChan <- "B"
+		if len(carro.Rota) == 0 {
+			carro.Rota = []Coordenada{carro.destinoPasseio()}
+		}
+		duracao := time.Duration(float64(intervaloSimulacao) * aceleracaoSimulacao)
+		percorrido := carro.dirigir(duracao)
+		verificarDeslocamento()
+		fmt.Printf("\nBateria - Nível atual: %.1f%% | %.1f km percorridos a %.0f km/h (%.3f kWh/km), alcance de %.0f km\n",
+			carro.Bateria, percorrido, carro.VelocidadeKmH, carro.consumoAtual(), carro.alcanceKm())
+
+		// envia alerta apenas uma vez quando a bateria chega a 20%. O envio
+		// acontece fora do mutex, que o laço de comandos também usa.
+		alertar := carro.Bateria <= 20 && !alertaEnviado
+		if alertar {
 			alertaEnviado = true
 		}
 		mutex.Unlock()
+		if alertar {
+			commandChan <- "B"
+		}
 	}
 }
 
@@ -348,67 +1086,294 @@ func enviarMensagem(msg Message) {
 
 }
 
-// Cria uma mensagem JSON para listar pontos de recarga
+// Cria uma mensagem JSON para listar pontos de recarga, com a energia e o
+// consumo atuais para o servidor indicar quais estão ao alcance
 func listarPontos(carro Carro) Message {
 	return Message{
 		Action: listarPontosAction,
 		Content: map[string]interface{}{
-			"ID":        carro.ID,
-			"longitude": carro.Longitude,
-			"latitude":  carro.Latitude,
+			"ID":                  carro.ID,
+			"longitude":           carro.Longitude,
+			"latitude":            carro.Latitude,
+			"energia_kwh":         carro.Bateria / 100 * carro.CapacidadeKWh,
+			"capacidade_kwh":      carro.CapacidadeKWh,
+			"consumo_kwh_km":      carro.consumoAtual(),
+			"somente_alcancaveis": somenteAlcancaveis,
 		},
 	}
 }
 
-// Informa o início do carregamento
-// Informa o início do carregamento
-func inicioCarregamento(c *Carro) Message {
-	novoHistorico := Historico{
-		ID: fmt.Sprintf("sessao-%d", time.Now().Unix()),
-		SessaoDeCarregamento: SessaoDeCarregamento{
-			Inicio: time.Now(),
+// Lê os pontos de passagem separados por ";"; vazio remove a rota
+func lerRota(entrada string) ([]Coordenada, error) {
+	var rota []Coordenada
+	for _, trecho := range strings.Split(entrada, ";") {
+		if strings.TrimSpace(trecho) == "" {
+			continue
+		}
+		lat, lon, err := lerCoordenadas(trecho)
+		if err != nil {
+			return nil, err
+		}
+		rota = append(rota, Coordenada{Latitude: lat, Longitude: lon})
+	}
+	return rota, nil
+}
+
+// Cria uma mensagem JSON para planejar uma viagem até o destino
+func planejarViagem(carro Carro, destinoLat, destinoLon float64) Message {
+	return Message{
+		Action: planejarViagemAction,
+		Content: map[string]interface{}{
+			"ID":                carro.ID,
+			"latitude":          carro.Latitude,
+			"longitude":         carro.Longitude,
+			"destino_latitude":  destinoLat,
+			"destino_longitude": destinoLon,
+			"bateria":           carro.Bateria,
+			"capacidade_kwh":    carro.CapacidadeKWh,
+			"consumo_kwh_km":    carro.consumoAtual(),
+			"potencia_max_kw":   carro.PotenciaMaxKW,
 		},
 	}
+}
 
-	fmt.Println(novoHistorico.SessaoDeCarregamento.Inicio)
+// Cria uma mensagem JSON para reservar, de forma atômica, as paradas da viagem
+func reservarRota(carro Carro, pontos []string) Message {
+	return Message{
+		Action: reservarRotaAction,
+		Content: map[string]interface{}{
+			"ID":     carro.ID,
+			"pontos": pontos,
+		},
+	}
+}
 
-	c.Historico = append(c.Historico, novoHistorico)
+// Converte uma entrada no formato "latitude longitude"
+func lerCoordenadas(entrada string) (float64, float64, error) {
+	campos := strings.Fields(entrada)
+	if len(campos) != 2 {
+		return 0, 0, fmt.Errorf("esperado latitude e longitude")
+	}
+	lat, err := strconv.ParseFloat(campos[0], 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	lon, err := strconv.ParseFloat(campos[1], 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	return lat, lon, nil
+}
 
-	return Message{
+// Informa o início do carregamento. A sessão entra no histórico quando o servidor confirmar.
+func inicioCarregamento(c *Carro) Message {
+	msg := Message{
 		Action: "INICIO_CARREGAMENTO",
 		Content: map[string]interface{}{
 			"ID":      c.ID,
 			"pontoID": c.PontoReservado, // <- USANDO A RESERVA REAL
+			// Bateria usada pelo ponto para seguir a curva de carga
+			"capacidade_kwh":  c.CapacidadeKWh,
+			"potencia_max_kw": c.PotenciaMaxKW,
+			"soc":             c.Bateria,
 		},
 	}
+	// Com limites, a sessão termina sozinha e o resultado chega pela telemetria
+	for campo, valor := range limitesCarregamento {
+		msg.Content[campo] = valor
+	}
+	if _, ok := limitesCarregamento["custo_maximo"]; ok {
+		msg.Content["moeda"] = moeda
+	}
+	return msg
 }
 
-// Informa o fim do carregamento
-func fimCarregamento(c *Carro) Message {
-	c.Historico[len(c.Historico)-1].SessaoDeCarregamento.Fim = time.Now()
-
-	tempoDecorrido := calcularTempoDecorrido(
-		c.Historico[len(c.Historico)-1].SessaoDeCarregamento.Inicio,
-		c.Historico[len(c.Historico)-1].SessaoDeCarregamento.Fim,
-	)
+// Lê limites no formato "soc 80 kwh 10 custo 25.00"
+func lerLimites(entrada string) (map[string]interface{}, error) {
+	campos := strings.Fields(strings.ToLower(entrada))
+	limites := map[string]interface{}{}
+	if len(campos)%2 != 0 {
+		return nil, fmt.Errorf("Formato inválido. Use pares como 'soc 80' ou 'custo 25.00'.")
+	}
+	for i := 0; i < len(campos); i += 2 {
+		tipo, texto := campos[i], campos[i+1]
+		if tipo == "custo" {
+			valor, err := parseDinheiro(texto)
+			if err != nil || valor <= 0 {
+				return nil, fmt.Errorf("Custo inválido: %s", texto)
+			}
+			limites["custo_maximo"] = valor
+			continue
+		}
+		valor, err := strconv.ParseFloat(strings.Replace(texto, ",", ".", 1), 64)
+		if err != nil || valor <= 0 {
+			return nil, fmt.Errorf("Valor inválido: %s", texto)
+		}
+		switch tipo {
+		case "soc":
+			if valor > 100 {
+				return nil, fmt.Errorf("SOC alvo deve ser no máximo 100")
+			}
+			limites["soc_alvo"] = valor
+		case "kwh":
+			limites["energia_max_kwh"] = valor
+		default:
+			return nil, fmt.Errorf("Limite desconhecido: %s (use soc, kwh ou custo)", tipo)
+		}
+	}
+	return limites, nil
+}
 
+// Informa o fim do carregamento. Duração e energia são medidas pelo ponto.
+func fimCarregamento(c *Carro) Message {
 	return Message{
 		Action: fimCarregamentoAction,
 		Content: map[string]interface{}{
-			"ID":           c.ID,
-			"pontoID":      c.PontoReservado,
-			"tempo":        tempoDecorrido,
-			"isCarregando": c.isCarregando,
+			"ID":      c.ID,
+			"pontoID": c.PontoReservado,
 		},
 	}
 }
 
-func calcularTempoDecorrido(inicio, fim time.Time) float64 {
-	return fim.Sub(inicio).Seconds()
+// Substitui os horários locais da última sessão pelos medidos no ponto
+func (c *Carro) registrarMedicao(content map[string]interface{}) {
+	sessao := &c.Historico[len(c.Historico)-1].SessaoDeCarregamento
+	if inicio, err := time.Parse(time.RFC3339Nano, fmt.Sprint(content["inicio"])); err == nil {
+		sessao.Inicio = inicio
+	}
+	if fim, err := time.Parse(time.RFC3339Nano, fmt.Sprint(content["fim"])); err == nil {
+		sessao.Fim = fim
+	}
+	if energia, ok := content["energia_kwh"].(float64); ok {
+		sessao.EnergiaKWh = energia
+	}
+	if recibo, ok := content["recibo"].(string); ok {
+		c.Historico[len(c.Historico)-1].Recibo = recibo
+	}
+}
+
+// O nível da bateria ao fim da sessão vem da energia entregue pelo ponto
+func (c *Carro) atualizarBateria(content map[string]interface{}) {
+	if soc, ok := content["soc_final"].(float64); ok {
+		c.Bateria = soc
+	} else if energia, ok := content["energia_kwh"].(float64); ok && c.CapacidadeKWh > 0 {
+		c.Bateria = math.Min(100, c.Bateria+energia/c.CapacidadeKWh*100)
+	}
+	if c.Bateria > 20 {
+		alertaEnviado = false
+	}
+	fmt.Printf("Bateria após a recarga: %.1f%%\n", c.Bateria)
 }
 
-func (c *Carro) adicionarPagamento(valor float64) {
+func (c *Carro) adicionarPagamento(valor Dinheiro) {
 	c.Historico[len(c.Historico)-1].Pagamento.Valor = valor
+	c.Historico[len(c.Historico)-1].Pagamento.Moeda = moeda
 	c.Historico[len(c.Historico)-1].Pagamento.Pago = false
 	fmt.Println("Pagamento adicionado ao histórico do carro.")
 }
+
+// O que a carteira não cobriu é o valor que ainda precisa ser pago
+func (c *Carro) atualizarPendencia(pendente Dinheiro) {
+	pagamento := &c.Historico[len(c.Historico)-1].Pagamento
+	pagamento.Valor = pendente
+	pagamento.Pago = pendente <= 0
+	if pagamento.Pago {
+		fmt.Println("Sessão paga integralmente com a carteira.")
+	} else {
+		fmt.Printf("Valor pendente: %s %s\n", moeda, pendente)
+	}
+}
+
+func recarregarCarteira(carroID string, valor Dinheiro) Message {
+	return Message{
+		Action: "RECARREGAR_CARTEIRA",
+		Content: map[string]interface{}{
+			"carroID":            carroID,
+			"valor":              valor,
+			"moeda":              moeda,
+			"chave_idempotencia": fmt.Sprintf("%s-carteira-%d", carroID, time.Now().UnixNano()),
+		},
+	}
+}
+
+func handlePlano(content map[string]interface{}) {
+	franquia, ok := content["franquia"].(map[string]interface{})
+	if !ok {
+		fmt.Println("Nenhum plano de assinatura ativo.")
+		return
+	}
+	fmt.Printf("Plano %s (%s): %.0f min e %.3f kWh restantes no período\n", franquia["plano"], franquia["periodo"], franquia["minutos_restantes"], franquia["kwh_restantes"])
+	fmt.Printf("Já utilizados: %.1f min e %.3f kWh\n", franquia["minutos_usados"], franquia["kwh_usados"])
+}
+
+func handleSaldoCarteira(content map[string]interface{}) {
+	fmt.Printf("Saldo da carteira: %s %s (política: %s)\n", moeda, lerDinheiro(content["saldo"]), content["politica"])
+	if limite, ok := content["limite_negativo"]; ok {
+		fmt.Printf("Limite de saldo negativo: %s %s\n", moeda, lerDinheiro(limite))
+	}
+}
+
+// Valor monetário em unidades mínimas da moeda (centavos, no caso do real),
+// trocado com o servidor como texto decimal ("12.34") para não perder precisão
+type Dinheiro int64
+
+// Casas decimais das moedas conhecidas; as demais usam duas
+var casasDecimaisMoeda = map[string]int{"JPY": 0, "CLP": 0}
+
+func casasDecimais() int {
+	if casas, ok := casasDecimaisMoeda[moeda]; ok {
+		return casas
+	}
+	return 2
+}
+
+// Lê um valor digitado pelo usuário, com ponto ou vírgula ("12.34", "12,3")
+func parseDinheiro(texto string) (Dinheiro, error) {
+	texto = strings.Replace(strings.TrimSpace(texto), ",", ".", 1)
+	inteiro, fracao, _ := strings.Cut(texto, ".")
+	casas := casasDecimais()
+	if inteiro == "" || len(fracao) > casas || strings.ContainsAny(inteiro+fracao, "+-") {
+		return 0, fmt.Errorf("valor %q inválido", texto)
+	}
+	unidades, err := strconv.ParseInt(inteiro+fracao+strings.Repeat("0", casas-len(fracao)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("valor %q inválido", texto)
+	}
+	return Dinheiro(unidades), nil
+}
+
+// Valor monetário recebido do servidor: texto decimal ou, em servidores antigos, número
+func lerDinheiro(valor interface{}) Dinheiro {
+	switch v := valor.(type) {
+	case string:
+		negativo := strings.HasPrefix(v, "-")
+		d, _ := parseDinheiro(strings.TrimPrefix(v, "-"))
+		if negativo {
+			return -d
+		}
+		return d
+	case float64:
+		return Dinheiro(math.Round(v * math.Pow10(casasDecimais())))
+	default:
+		return 0
+	}
+}
+
+func (d Dinheiro) String() string {
+	casas := casasDecimais()
+	unidades := int64(d)
+	sinal := ""
+	if unidades < 0 {
+		sinal = "-"
+		unidades = -unidades
+	}
+	if casas == 0 {
+		return fmt.Sprintf("%s%d", sinal, unidades)
+	}
+	fator := int64(math.Pow10(casas))
+	return fmt.Sprintf("%s%d.%0*d", sinal, unidades/fator, casas, unidades%fator)
+}
+
+func (d Dinheiro) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Modelo de consumo dos carros simulados: a energia gasta por km depende da
+// velocidade (rolamento e arrasto aerodinâmico), dos sistemas auxiliares e,
+// se informada, da temperatura ambiente
+const (
+	consumoRolamentoKWhKm = 0.09 // Resistência ao rolamento, independente da velocidade
+	coeficienteArrasto    = 8e-6 // kWh/km por (km/h)²
+	potenciaAuxiliarKW    = 0.8  // Eletrônica embarcada, gasta em qualquer velocidade
+	velocidadeMinimaKmH   = 5.0  // Evita consumo por km infinito no trânsito parado
+
+	// Climatização (aquecimento ou ar-condicionado) por °C de diferença da referência
+	climatizacaoKWPorGrau = 0.12
+	temperaturaConforto   = 21.0
+	// Perda de eficiência da bateria por °C abaixo do limite de frio
+	perdaFrioPorGrau = 0.01
+	temperaturaFrio  = 10.0
+)
+
+// Simulação do deslocamento
+const (
+	raioTerraKm         = 6371.0
+	intervaloSimulacao  = 5 * time.Second // Intervalo real entre os passos da simulação
+	raioPasseioKm       = 30.0            // Distância máxima dos destinos do passeio aleatório
+	velocidadePadraoKmH = 80.0
+)
+
+var (
+	// Quantos segundos simulados passam a cada segundo real
+	aceleracaoSimulacao = lerFloatEnv("ACELERACAO_SIMULACAO", 60)
+	bateriaEsgotada     bool
+)
+
+type Coordenada struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// Energia gasta por km na velocidade e temperatura informadas. Sem temperatura,
+// a climatização e a perda no frio não são consideradas.
+func consumoEm(velocidadeKmH float64, temperaturaC *float64) float64 {
+	v := math.Max(velocidadeKmH, velocidadeMinimaKmH)
+	auxiliar := potenciaAuxiliarKW
+	eficiencia := 1.0
+	if temperaturaC != nil {
+		auxiliar += climatizacaoKWPorGrau * math.Abs(*temperaturaC-temperaturaConforto)
+		if *temperaturaC < temperaturaFrio {
+			eficiencia += perdaFrioPorGrau * (temperaturaFrio - *temperaturaC)
+		}
+	}
+	return (consumoRolamentoKWhKm + coeficienteArrasto*v*v + auxiliar/v) * eficiencia
+}
+
+func (c *Carro) consumoAtual() float64 {
+	return consumoEm(c.VelocidadeKmH, c.TemperaturaC)
+}
+
+// Distância que a energia restante na bateria permite percorrer agora
+func (c *Carro) alcanceKm() float64 {
+	return c.Bateria / 100 * c.CapacidadeKWh / c.consumoAtual()
+}
+
+// Dirige pela rota durante o tempo simulado, gastando a bateria conforme a
+// distância percorrida. Devolve os km percorridos.
+func (c *Carro) dirigir(duracao time.Duration) float64 {
+	consumo := c.consumoAtual()
+	distancia := math.Min(c.VelocidadeKmH*duracao.Hours(), c.alcanceKm())
+	percorrido := c.avancar(distancia)
+
+	c.Bateria -= percorrido * consumo / c.CapacidadeKWh * 100
+	if c.Bateria < 1e-6 {
+		c.Bateria = 0
+	}
+	c.OdometroKm += percorrido
+	return percorrido
+}
+
+// Move o carro até distanciaKm ao longo da rota, retirando os pontos de
+// passagem alcançados. Devolve quanto foi percorrido.
+func (c *Carro) avancar(distanciaKm float64) float64 {
+	percorrido := 0.0
+	for len(c.Rota) > 0 && percorrido < distanciaKm {
+		alvo := c.Rota[0]
+		trecho := calcularDistancia(c.Latitude, c.Longitude, alvo.Latitude, alvo.Longitude)
+		if trecho <= distanciaKm-percorrido {
+			c.Latitude, c.Longitude = alvo.Latitude, alvo.Longitude
+			c.Rota = c.Rota[1:]
+			percorrido += trecho
+			continue
+		}
+		c.Latitude, c.Longitude = pontoIntermediario(c.Latitude, c.Longitude, alvo.Latitude, alvo.Longitude, (distanciaKm-percorrido)/trecho)
+		percorrido = distanciaKm
+	}
+	return percorrido
+}
+
+// Destino aleatório a até raioPasseioKm da posição atual
+func (c *Carro) destinoPasseio() Coordenada {
+	distancia := rand.Float64() * raioPasseioKm / raioTerraKm
+	direcao := rand.Float64() * 2 * math.Pi
+	lat1 := c.Latitude * math.Pi / 180
+	lon1 := c.Longitude * math.Pi / 180
+	lat2 := math.Asin(math.Sin(lat1)*math.Cos(distancia) + math.Cos(lat1)*math.Sin(distancia)*math.Cos(direcao))
+	lon2 := lon1 + math.Atan2(math.Sin(direcao)*math.Sin(distancia)*math.Cos(lat1), math.Cos(distancia)-math.Sin(lat1)*math.Sin(lat2))
+	return Coordenada{Latitude: lat2 * 180 / math.Pi, Longitude: normalizarLongitude(lon2 * 180 / math.Pi)}
+}
+
+// Distância em km entre duas coordenadas (fórmula de Haversine)
+func calcularDistancia(lat1, lon1, lat2, lon2 float64) float64 {
+	dLat := (lat2 - lat1) * math.Pi / 180
+	dLon := (lon2 - lon1) * math.Pi / 180
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*math.Pi/180)*math.Cos(lat2*math.Pi/180)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return raioTerraKm * 2 * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+}
+
+// Ponto do arco de círculo máximo entre duas coordenadas, na fração informada do caminho
+func pontoIntermediario(lat1, lon1, lat2, lon2, fracao float64) (float64, float64) {
+	angulo := calcularDistancia(lat1, lon1, lat2, lon2) / raioTerraKm
+	if angulo == 0 {
+		return lat1, lon1
+	}
+	phi1, lambda1 := lat1*math.Pi/180, lon1*math.Pi/180
+	phi2, lambda2 := lat2*math.Pi/180, lon2*math.Pi/180
+	a := math.Sin((1-fracao)*angulo) / math.Sin(angulo)
+	b := math.Sin(fracao*angulo) / math.Sin(angulo)
+	x := a*math.Cos(phi1)*math.Cos(lambda1) + b*math.Cos(phi2)*math.Cos(lambda2)
+	y := a*math.Cos(phi1)*math.Sin(lambda1) + b*math.Cos(phi2)*math.Sin(lambda2)
+	z := a*math.Sin(phi1) + b*math.Sin(phi2)
+	lat := math.Atan2(z, math.Sqrt(x*x+y*y))
+	lon := math.Atan2(y, x)
+	return lat * 180 / math.Pi, lon * 180 / math.Pi
+}
+
+func normalizarLongitude(lon float64) float64 {
+	return math.Mod(lon+540, 360) - 180
+}
+
+func lerFloatEnv(nome string, padrao float64) float64 {
+	if valor, err := strconv.ParseFloat(os.Getenv(nome), 64); err == nil {
+		return valor
+	}
+	return padrao
+}
+
+// Temperatura ambiente em TEMPERATURA_C; nil se não configurada
+func lerTemperaturaEnv() *float64 {
+	valor, err := strconv.ParseFloat(os.Getenv("TEMPERATURA_C"), 64)
+	if err != nil {
+		return nil
+	}
+	return &valor
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Posição dos pontos de recarga informada pelo servidor em listas, reservas e planos de viagem
+var coordenadasPontos = make(map[string]Coordenada)
+
+func registrarCoordenadasPonto(pontoID interface{}, content map[string]interface{}) {
+	id, okID := pontoID.(string)
+	lat, okLat := content["latitude"].(float64)
+	lon, okLon := content["longitude"].(float64)
+	if okID && okLat && okLon {
+		coordenadasPontos[id] = Coordenada{Latitude: lat, Longitude: lon}
+	}
+}
+
+// Faz o carro dirigir até o ponto reservado, substituindo a rota atual
+func seguirParaPonto(pontoID string) {
+	destino, conhecido := coordenadasPontos[pontoID]
+	if !conhecido {
+		fmt.Printf("Posição do ponto %s desconhecida; liste os pontos para seguir até ele.\n", pontoID)
+		return
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	carro.Rota = []Coordenada{destino}
+	carro.DestinoPonto = pontoID
+
+	distancia := calcularDistancia(carro.Latitude, carro.Longitude, destino.Latitude, destino.Longitude)
+	tempo := time.Duration(distancia / carro.VelocidadeKmH * float64(time.Hour)).Round(time.Minute)
+	fmt.Printf("Seguindo para o ponto %s: %.1f km, cerca de %s a %.0f km/h.\n", pontoID, distancia, tempo, carro.VelocidadeKmH)
+	if alcance := carro.alcanceKm(); alcance < distancia {
+		fmt.Printf("Atenção: alcance de %.0f km não basta para chegar ao ponto.\n", alcance)
+	}
+}
+
+// Verifica, após cada passo da simulação, se o carro chegou ao ponto ou
+// ficou sem bateria no caminho. Deve ser chamada com mutex travado.
+func verificarDeslocamento() {
+	if carro.DestinoPonto == "" {
+		return
+	}
+	if len(carro.Rota) == 0 {
+		fmt.Printf("\nCarro chegou ao ponto %s (%.4f, %.4f). Fazendo check-in...\n",
+			carro.DestinoPonto, carro.Latitude, carro.Longitude)
+		carro.DestinoPonto = ""
+		go enviarMensagem(checkIn(carro))
+		return
+	}
+	if carro.Bateria == 0 {
+		destino := carro.Rota[len(carro.Rota)-1]
+		fmt.Printf("\nFalha no deslocamento: bateria esgotada a %.1f km do ponto %s.\n",
+			calcularDistancia(carro.Latitude, carro.Longitude, destino.Latitude, destino.Longitude), carro.DestinoPonto)
+		carro.Rota = nil
+		carro.DestinoPonto = ""
+		desistirReservas(&carro)
+	}
+}
+
+// Libera a reserva atual e as próximas paradas da rota, que o carro sem
+// bateria não vai alcançar. As mensagens são enviadas em segundo plano, pois
+// o mutex está travado. Deve ser chamada com mutex travado.
+func desistirReservas(c *Carro) {
+	if !c.EmFila || c.PontoReservado == "" {
+		return
+	}
+	pontos := append([]string{c.PontoReservado}, c.ReservasRota...)
+	c.EmFila = false
+	c.PontoReservado = ""
+	c.ReservasRota = nil
+	for _, pontoID := range pontos {
+		fmt.Printf("Desistindo da reserva no ponto %s.\n", pontoID)
+		go enviarMensagem(desistirReserva(c.ID, pontoID))
+	}
+}
+
+// Cria uma mensagem JSON para desfazer a reserva do carro no ponto
+func desistirReserva(carroID, pontoID string) Message {
+	return Message{
+		Action: "DESISTIR_RESERVA",
+		Content: map[string]interface{}{
+			"ID":      carroID,
+			"pontoID": pontoID,
+		},
+	}
+}
+
+// Cria uma mensagem JSON de check-in no ponto reservado, com a posição atual
+func checkIn(c Carro) Message {
+	return Message{
+		Action: "CHECK_IN",
+		Content: map[string]interface{}{
+			"ID":        c.ID,
+			"pontoID":   c.PontoReservado,
+			"latitude":  c.Latitude,
+			"longitude": c.Longitude,
+		},
+	}
+}
+
+func handleCheckInConfirmado(content map[string]interface{}) {
+	registro, _ := content["check_in"].(map[string]interface{})
+	fmt.Printf("Check-in confirmado no ponto %s (%.0f m do ponto), posição na fila: %v.\n",
+		content["pontoID"], lerFloat(registro["distancia_m"]), content["posicao_na_fila"])
+	if validoAte, err := time.Parse(time.RFC3339Nano, fmt.Sprint(content["valido_ate"])); err == nil {
+		fmt.Printf("Inicie o carregamento com 'I' até %s.\n", validoAte.Local().Format("15:04"))
+	}
+}
+
+// O carro fica parado enquanto carrega ou aguarda no ponto reservado depois de chegar
+func (c *Carro) estacionado() bool {
+	return c.isCarregando || (c.EmFila && c.DestinoPonto == "" && len(c.Rota) == 0)
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Comportamento quando o saldo da carteira não cobre a sessão
+const (
+	politicaBloquear  = "BLOQUEAR"  // Exige carteira com saldo e encerra a sessão quando o saldo acaba
+	politicaNegativo  = "NEGATIVO"  // Permite saldo negativo até o limite configurado
+	politicaPendencia = "PENDENCIA" // Debita o que houver e deixa o restante como pendência
+)
+
+var (
+	politicaCarteira       = lerPoliticaCarteira(os.Getenv("CARTEIRA_POLITICA"))
+	limiteNegativoCarteira = dinheiroDeFloat(lerFloatEnv("CARTEIRA_LIMITE_NEGATIVO", 50), arredondamentoMeioParaCima)
+)
+
+type MovimentoCarteira struct {
+	Tipo              string    `json:"tipo"` // "RECARGA" ou "DEBITO"
+	Valor             Dinheiro  `json:"valor"`
+	Data              time.Time `json:"data"`
+	SessaoID          string    `json:"sessaoID,omitempty"`
+	ChaveIdempotencia string    `json:"chave_idempotencia,omitempty"`
+	TransacaoID       string    `json:"transacaoID,omitempty"`
+}
+
+type Carteira struct {
+	Saldo      Dinheiro            `json:"saldo"`
+	Movimentos []MovimentoCarteira `json:"movimentos"`
+}
+
+func lerPoliticaCarteira(valor string) string {
+	switch strings.ToUpper(valor) {
+	case politicaBloquear:
+		return politicaBloquear
+	case politicaNegativo:
+		return politicaNegativo
+	default:
+		return politicaPendencia
+	}
+}
+
+func lerFloatEnv(nome string, padrao float64) float64 {
+	valor, err := strconv.ParseFloat(os.Getenv(nome), 64)
+	if err != nil {
+		return padrao
+	}
+	return valor
+}
+
+// Quanto a carteira ainda pode pagar, considerando a política. Deve ser chamada com r.mu travado.
+func (r *LivroRazao) disponivelCarteira(carteira *Carteira) Dinheiro {
+	disponivel := carteira.Saldo
+	if politicaCarteira == politicaNegativo {
+		disponivel += limiteNegativoCarteira
+	}
+	if disponivel < 0 {
+		return 0
+	}
+	return disponivel
+}
+
+// Credita uma recarga já cobrada no provedor. Repetições com a mesma chave não somam de novo.
+func (r *LivroRazao) recarregarCarteira(carroID string, valor Dinheiro, chave, transacaoID string) Dinheiro {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	carteira := r.carteira(carroID)
+	for _, m := range carteira.Movimentos {
+		if m.ChaveIdempotencia == chave {
+			return carteira.Saldo
+		}
+	}
+
+	carteira.Saldo += valor
+	carteira.Movimentos = append(carteira.Movimentos, MovimentoCarteira{
+		Tipo:              "RECARGA",
+		Valor:             valor,
+		Data:              time.Now(),
+		ChaveIdempotencia: chave,
+		TransacaoID:       transacaoID,
+	})
+	r.salvar()
+	return carteira.Saldo
+}
+
+// Recarga já creditada com a chave informada, em qualquer carteira. Devolve
+// o carro dono da carteira, o movimento e o saldo atual dela.
+func (r *LivroRazao) recargaPorChave(chave string) (string, MovimentoCarteira, Dinheiro, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for carroID, carteira := range r.Carteiras {
+		for _, m := range carteira.Movimentos {
+			if m.Tipo == "RECARGA" && m.ChaveIdempotencia == chave {
+				return carroID, m, carteira.Saldo, true
+			}
+		}
+	}
+	return "", MovimentoCarteira{}, 0, false
+}
+
+// Cópia da carteira do carro, se ele já tiver uma
+func (r *LivroRazao) consultarCarteira(carroID string) (Carteira, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	carteira, existe := r.Carteiras[carroID]
+	if !existe {
+		return Carteira{}, false
+	}
+	return *carteira, true
+}
+
+// Recusa o início de uma sessão quando a política exige saldo disponível e
+// devolve o custo máximo que a carteira cobre (zero quando não há limite).
+// Em BLOQUEAR o carro precisa ter carteira com saldo acima da taxa da sessão.
+func (r *LivroRazao) verificarCarteiraParaInicio(carroID, pontoID string) (Dinheiro, error) {
+	if politicaCarteira == politicaPendencia {
+		return 0, nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	carteira, existe := r.Carteiras[carroID]
+	if !existe {
+		if politicaCarteira == politicaBloquear {
+			return 0, fmt.Errorf("Carro sem carteira: recarregue a carteira antes de iniciar o carregamento")
+		}
+		return 0, nil
+	}
+
+	disponivel := r.disponivelCarteira(carteira)
+	agora := time.Now()
+	if minimo := tarifaDoPonto(pontoID).calcular(agora, agora, 0, 0).Total; disponivel <= minimo {
+		return 0, fmt.Errorf("Saldo da carteira insuficiente para iniciar o carregamento (saldo %s %s)", carteira.Saldo, moeda)
+	}
+	return disponivel, nil
+}
+
+// Paga a sessão com o saldo disponível da carteira e devolve o valor
+// debitado e o que ficou pendente
+func (r *LivroRazao) debitarCarteira(sessaoID string) (debitado, pendente Dinheiro) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sessao, existe := r.Sessoes[sessaoID]
+	if !existe {
+		return 0, 0
+	}
+	pendente = r.saldoSessao(sessaoID)
+
+	carteira, existe := r.Carteiras[sessao.CarroID]
+	if !existe || pendente <= 0 {
+		return 0, pendente
+	}
+
+	debitado = minDinheiro(pendente, r.disponivelCarteira(carteira))
+	if debitado <= 0 {
+		return 0, pendente
+	}
+
+	carteira.Saldo -= debitado
+	carteira.Movimentos = append(carteira.Movimentos, MovimentoCarteira{
+		Tipo:     "DEBITO",
+		Valor:    debitado,
+		Data:     time.Now(),
+		SessaoID: sessaoID,
+	})
+	r.Lancamentos = append(r.Lancamentos, Lancamento{
+		ID:                r.proximoID("lanc"),
+		SessaoID:          sessaoID,
+		CarroID:           sessao.CarroID,
+		Tipo:              lancamentoCredito,
+		Valor:             debitado,
+		Data:              time.Now(),
+		Descricao:         "Débito automático da carteira",
+		ChaveIdempotencia: "carteira-" + sessaoID,
+	})
+	r.salvar()
+	return debitado, pendente - debitado
+}
+
+// Deve ser chamada com r.mu travado
+func (r *LivroRazao) carteira(carroID string) *Carteira {
+	carteira, existe := r.Carteiras[carroID]
+	if !existe {
+		carteira = &Carteira{}
+		r.Carteiras[carroID] = carteira
+	}
+	return carteira
+}
+
+// Cobra o valor no provedor de pagamento e credita na carteira do carro
+func handleRecarregarCarteira(conn net.Conn, content map[string]interface{}) {
+	carroID, okCarro := content["carroID"].(string)
+	valor, okValor := lerDinheiro(content, "valor")
+	chave, okChave := content["chave_idempotencia"].(string)
+	if !okCarro || !okValor || !okChave || chave == "" {
+		sendErrorResponse(conn, "Dados da recarga incompletos")
+		return
+	}
+	if err := verificarMoeda(content); err != nil {
+		sendErrorResponse(conn, err.Error())
+		return
+	}
+	if valor <= 0 {
+		sendErrorResponse(conn, "Valor da recarga deve ser positivo")
+		return
+	}
+
+	// Repetição de uma recarga já creditada: responde igual, sem cobrar de novo
+	if dono, anterior, saldo, existe := razao.recargaPorChave(chave); existe {
+		if dono != carroID || anterior.Valor != valor {
+			sendErrorResponse(conn, errChaveReutilizada.Error())
+			return
+		}
+		sendResponse(conn, respostaSaldoCarteira("CARTEIRA_RECARREGADA", carroID, saldo))
+		return
+	}
+
+	pedido := PedidoPagamento{ChaveIdempotencia: chave, CarroID: carroID, Valor: valor}
+	cobranca, err := cobrarNoProvedor(pedido)
+	if err != nil {
+		sendErrorResponse(conn, err.Error())
+		return
+	}
+
+	saldo := razao.recarregarCarteira(carroID, valor, chave, cobranca.TransacaoID)
+	fmt.Printf("Carteira do carro %s recarregada com %s (saldo %s)\n", carroID, valor, saldo)
+	sendResponse(conn, respostaSaldoCarteira("CARTEIRA_RECARREGADA", carroID, saldo))
+}
+
+func handleConsultarSaldo(conn net.Conn, content map[string]interface{}) {
+	carroID, ok := content["carroID"].(string)
+	if !ok {
+		sendErrorResponse(conn, "ID do carro inválido")
+		return
+	}
+	carteira, _ := razao.consultarCarteira(carroID)
+	sendResponse(conn, respostaSaldoCarteira("SALDO_CARTEIRA", carroID, carteira.Saldo))
+}
+
+func respostaSaldoCarteira(acao, carroID string, saldo Dinheiro) Message {
+	content := map[string]interface{}{
+		"carroID":  carroID,
+		"saldo":    saldo,
+		"moeda":    moeda,
+		"politica": politicaCarteira,
+	}
+	if politicaCarteira == politicaNegativo {
+		content["limite_negativo"] = limiteNegativoCarteira
+	}
+	return Message{Action: acao, Content: content}
+}
@@ -0,0 +1,518 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Formatos aceitos na importação do catálogo
+const (
+	formatoCSV     = "CSV"
+	formatoGeoJSON = "GEOJSON"
+)
+
+// Situação de um ponto na exportação da rede
+const (
+	statusLivre      = "LIVRE"      // Sem carros na fila
+	statusReservado  = "RESERVADO"  // Com fila, mas sem carregamento em andamento
+	statusCarregando = "CARREGANDO" // Sessão em andamento
+	statusOffline    = "OFFLINE"    // Consta no catálogo, mas não respondeu
+)
+
+// Cadastro de um ponto de recarga importado de planilha (CSV) ou de
+// ferramenta de mapas (GeoJSON). Os dados do catálogo prevalecem sobre os
+// informados pelo próprio ponto.
+type EntradaCatalogo struct {
+	ID         string   `json:"ID"` // Endereço host:porta do ponto
+	Nome       string   `json:"nome,omitempty"`
+	Endereco   string   `json:"endereco,omitempty"`
+	Latitude   float64  `json:"latitude"`
+	Longitude  float64  `json:"longitude"`
+	Conectores []string `json:"conectores,omitempty"`
+	Tarifa     *Tarifa  `json:"tarifa,omitempty"` // nil usa a tarifa do arquivo de tarifas
+}
+
+type Catalogo struct {
+	mu     sync.Mutex
+	pontos map[string]EntradaCatalogo // pontoID -> cadastro
+}
+
+// Estruturas mínimas de GeoJSON (RFC 7946) usadas na importação e exportação
+type ColecaoGeoJSON struct {
+	Type     string           `json:"type"`
+	Features []FeatureGeoJSON `json:"features"`
+}
+
+type FeatureGeoJSON struct {
+	Type       string                 `json:"type"`
+	Geometry   *GeometriaGeoJSON      `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type GeometriaGeoJSON struct {
+	Type        string    `json:"type"`
+	Coordinates []float64 `json:"coordinates"` // [longitude, latitude]
+}
+
+var catalogo = carregarCatalogo(os.Getenv("CATALOGO_ARQUIVO"))
+
+// Único diretório de onde IMPORTAR_CATALOGO lê arquivos; sem ele, só "dados"
+var diretorioCatalogos = os.Getenv("CATALOGO_DIRETORIO")
+
+// Lê o catálogo de pontos informado em CATALOGO_ARQUIVO; sem ele valem
+// apenas os pontos de PONTOS_DE_RECARGA
+func carregarCatalogo(caminho string) *Catalogo {
+	c := &Catalogo{pontos: make(map[string]EntradaCatalogo)}
+	if caminho == "" {
+		return c
+	}
+	dados, err := os.ReadFile(caminho)
+	if err != nil {
+		fmt.Printf("Catálogo de pontos %s não encontrado\n", caminho)
+		return c
+	}
+	entradas, erros := lerCatalogo(dados, formatoDoArquivo(caminho))
+	for _, erro := range erros {
+		fmt.Printf("Catálogo %s: %s\n", caminho, erro)
+	}
+	c.importar(entradas, false)
+	fmt.Printf("Catálogo carregado de %s (%d pontos)\n", caminho, len(entradas))
+	return c
+}
+
+// Formato deduzido da extensão: .csv é planilha, o resto é GeoJSON
+func formatoDoArquivo(caminho string) string {
+	if strings.EqualFold(filepath.Ext(caminho), ".csv") {
+		return formatoCSV
+	}
+	return formatoGeoJSON
+}
+
+// Converte os dados no formato informado, devolvendo as entradas válidas e
+// uma mensagem para cada linha ou feature recusada
+func lerCatalogo(dados []byte, formato string) ([]EntradaCatalogo, []string) {
+	switch strings.ToUpper(formato) {
+	case formatoCSV:
+		return lerCatalogoCSV(dados)
+	case formatoGeoJSON:
+		return lerCatalogoGeoJSON(dados)
+	default:
+		return nil, []string{fmt.Sprintf("formato %q desconhecido, use %s ou %s", formato, formatoCSV, formatoGeoJSON)}
+	}
+}
+
+// CSV com cabeçalho: id, nome, endereco, latitude, longitude, conectores
+// (separados por ";"), tarifa e preco_kwh. Apenas id, latitude e longitude
+// são obrigatórios, e a ordem das colunas é livre.
+func lerCatalogoCSV(dados []byte) ([]EntradaCatalogo, []string) {
+	leitor := csv.NewReader(strings.NewReader(string(dados)))
+	leitor.FieldsPerRecord = -1
+	leitor.TrimLeadingSpace = true
+
+	cabecalho, err := leitor.Read()
+	if err != nil {
+		return nil, []string{fmt.Sprintf("cabeçalho inválido: %v", err)}
+	}
+	colunas := make(map[string]int)
+	for i, nome := range cabecalho {
+		colunas[strings.ToLower(strings.TrimSpace(strings.TrimPrefix(nome, "\ufeff")))] = i
+	}
+	for _, obrigatoria := range []string{"id", "latitude", "longitude"} {
+		if _, existe := colunas[obrigatoria]; !existe {
+			return nil, []string{fmt.Sprintf("coluna %s ausente no cabeçalho", obrigatoria)}
+		}
+	}
+
+	var entradas []EntradaCatalogo
+	var erros []string
+	for linha := 2; ; linha++ {
+		registro, err := leitor.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			erros = append(erros, fmt.Sprintf("linha %d: %v", linha, err))
+			continue
+		}
+		campo := func(nome string) string {
+			if i, existe := colunas[nome]; existe && i < len(registro) {
+				return strings.TrimSpace(registro[i])
+			}
+			return ""
+		}
+		propriedades := map[string]interface{}{
+			"id":         campo("id"),
+			"nome":       campo("nome"),
+			"endereco":   campo("endereco"),
+			"conectores": campo("conectores"),
+			"tarifa":     campo("tarifa"),
+			"preco_kwh":  campo("preco_kwh"),
+		}
+		lat, errLat := strconv.ParseFloat(campo("latitude"), 64)
+		lon, errLon := strconv.ParseFloat(campo("longitude"), 64)
+		if errLat != nil || errLon != nil {
+			erros = append(erros, fmt.Sprintf("linha %d: coordenadas inválidas", linha))
+			continue
+		}
+		entrada, err := novaEntradaCatalogo(propriedades, lat, lon)
+		if err != nil {
+			erros = append(erros, fmt.Sprintf("linha %d: %v", linha, err))
+			continue
+		}
+		entradas = append(entradas, entrada)
+	}
+	return entradas, erros
+}
+
+// FeatureCollection de pontos (geometria Point), com os mesmos campos do CSV
+// nas propriedades; conectores pode ser uma lista ou um texto separado por ";"
+func lerCatalogoGeoJSON(dados []byte) ([]EntradaCatalogo, []string) {
+	var colecao ColecaoGeoJSON
+	if err := json.Unmarshal(dados, &colecao); err != nil {
+		return nil, []string{fmt.Sprintf("GeoJSON inválido: %v", err)}
+	}
+	if colecao.Type != "FeatureCollection" {
+		return nil, []string{"esperada uma FeatureCollection"}
+	}
+
+	var entradas []EntradaCatalogo
+	var erros []string
+	for i, feature := range colecao.Features {
+		if feature.Geometry == nil || feature.Geometry.Type != "Point" || len(feature.Geometry.Coordinates) < 2 {
+			erros = append(erros, fmt.Sprintf("feature %d: geometria deve ser um Point", i+1))
+			continue
+		}
+		propriedades := feature.Properties
+		if propriedades == nil {
+			propriedades = map[string]interface{}{}
+		}
+		if _, existe := propriedades["id"]; !existe {
+			propriedades["id"] = propriedades["ID"]
+		}
+		lon, lat := feature.Geometry.Coordinates[0], feature.Geometry.Coordinates[1]
+		entrada, err := novaEntradaCatalogo(propriedades, lat, lon)
+		if err != nil {
+			erros = append(erros, fmt.Sprintf("feature %d: %v", i+1, err))
+			continue
+		}
+		entradas = append(entradas, entrada)
+	}
+	return entradas, erros
+}
+
+// Valida uma linha ou feature do catálogo e resolve a tarifa pelo nome
+func novaEntradaCatalogo(propriedades map[string]interface{}, lat, lon float64) (EntradaCatalogo, error) {
+	id := strings.TrimSpace(fmt.Sprint(propriedades["id"]))
+	if id == "" || propriedades["id"] == nil {
+		return EntradaCatalogo{}, fmt.Errorf("ID ausente")
+	}
+	// O ID é o endereço que o servidor consulta
+	if host, porta, err := net.SplitHostPort(id); err != nil || host == "" || porta == "" {
+		return EntradaCatalogo{}, fmt.Errorf("ID %s não é um endereço host:porta", id)
+	}
+	if lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+		return EntradaCatalogo{}, fmt.Errorf("coordenadas fora do globo no ponto %s", id)
+	}
+	entrada := EntradaCatalogo{ID: id, Latitude: lat, Longitude: lon}
+	entrada.Nome, _ = propriedades["nome"].(string)
+	entrada.Endereco, _ = propriedades["endereco"].(string)
+
+	switch conectores := propriedades["conectores"].(type) {
+	case string:
+		for _, conector := range strings.Split(conectores, ";") {
+			if conector = strings.TrimSpace(conector); conector != "" {
+				entrada.Conectores = append(entrada.Conectores, conector)
+			}
+		}
+	case []interface{}:
+		entrada.Conectores = convertInterfaceToStringSlice(conectores)
+	}
+
+	nomeTarifa, _ := propriedades["tarifa"].(string)
+	precoKWh, temPreco, err := lerPrecoCatalogo(propriedades["preco_kwh"])
+	if err != nil {
+		return EntradaCatalogo{}, fmt.Errorf("preco_kwh inválido no ponto %s", id)
+	}
+	if strings.TrimSpace(nomeTarifa) != "" || temPreco {
+		tarifa := tarifaConfigurada(id)
+		if strings.TrimSpace(nomeTarifa) != "" {
+			encontrada, existe := tarifaPorNome(nomeTarifa)
+			if !existe {
+				return EntradaCatalogo{}, fmt.Errorf("tarifa %q desconhecida no ponto %s", nomeTarifa, id)
+			}
+			tarifa = encontrada
+		}
+		if temPreco {
+			tarifa.PrecoKWh = precoKWh
+		}
+		entrada.Tarifa = &tarifa
+	}
+	return entrada, nil
+}
+
+// preco_kwh vem como número no GeoJSON e como texto no CSV; vazio não altera a tarifa
+func lerPrecoCatalogo(valor interface{}) (float64, bool, error) {
+	switch v := valor.(type) {
+	case float64:
+		if v < 0 {
+			return 0, false, fmt.Errorf("preço negativo")
+		}
+		return v, true, nil
+	case string:
+		if strings.TrimSpace(v) == "" {
+			return 0, false, nil
+		}
+		preco, err := strconv.ParseFloat(strings.Replace(strings.TrimSpace(v), ",", ".", 1), 64)
+		if err != nil || preco < 0 {
+			return 0, false, fmt.Errorf("preço inválido")
+		}
+		return preco, true, nil
+	case nil:
+		return 0, false, nil
+	default:
+		return 0, false, fmt.Errorf("preço inválido")
+	}
+}
+
+// Tarifa do arquivo de tarifas com o nome informado, sem diferenciar maiúsculas
+func tarifaPorNome(nome string) (Tarifa, bool) {
+	nome = strings.TrimSpace(nome)
+	if strings.EqualFold(tarifas.Padrao.Nome, nome) {
+		return tarifas.Padrao, true
+	}
+	for _, tarifa := range tarifas.Pontos {
+		if strings.EqualFold(tarifa.Nome, nome) {
+			return tarifa, true
+		}
+	}
+	return Tarifa{}, false
+}
+
+// Acrescenta as entradas ao catálogo, substituindo as de mesmo ID. Com
+// substituir, as entradas anteriores são descartadas.
+func (c *Catalogo) importar(entradas []EntradaCatalogo, substituir bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if substituir {
+		c.pontos = make(map[string]EntradaCatalogo)
+	}
+	for _, entrada := range entradas {
+		c.pontos[entrada.ID] = entrada
+	}
+}
+
+func (c *Catalogo) entrada(pontoID string) (EntradaCatalogo, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entrada, existe := c.pontos[pontoID]
+	return entrada, existe
+}
+
+func (c *Catalogo) tarifa(pontoID string) (Tarifa, bool) {
+	entrada, existe := c.entrada(pontoID)
+	if !existe || entrada.Tarifa == nil {
+		return Tarifa{}, false
+	}
+	return *entrada.Tarifa, true
+}
+
+// IDs do catálogo em ordem alfabética
+func (c *Catalogo) ids() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ids := make([]string, 0, len(c.pontos))
+	for id := range c.pontos {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Sobrepõe ao ponto os dados cadastrados no catálogo
+func (c *Catalogo) aplicar(ponto *PontoRecarga) {
+	entrada, existe := c.entrada(ponto.ID)
+	if !existe {
+		return
+	}
+	ponto.Latitude, ponto.Longitude = entrada.Latitude, entrada.Longitude
+	if entrada.Nome != "" {
+		ponto.Nome = entrada.Nome
+	}
+	if entrada.Endereco != "" {
+		ponto.Endereco = entrada.Endereco
+	}
+	if len(entrada.Conectores) > 0 {
+		ponto.Conectores = entrada.Conectores
+	}
+}
+
+// Endereços de todos os pontos gerenciados: os de PONTOS_DE_RECARGA seguidos
+// dos que constam apenas no catálogo
+func enderecosDosPontos() []string {
+	enderecos := append([]string{}, pontosDeRecarga...)
+	conhecidos := make(map[string]bool)
+	for _, endereco := range enderecos {
+		conhecidos[endereco] = true
+	}
+	for _, id := range catalogo.ids() {
+		if !conhecidos[id] {
+			enderecos = append(enderecos, id)
+		}
+	}
+	return enderecos
+}
+
+// Importa um catálogo enviado no pedido ("dados" e "formato") ou lido de um
+// arquivo de CATALOGO_DIRETORIO ("arquivo", só o nome). Restrita ao operador.
+func handleImportarCatalogo(conn net.Conn, content map[string]interface{}) {
+	if !operadorAutorizado(conn, content) {
+		return
+	}
+	formato, _ := content["formato"].(string)
+	var dados []byte
+	if arquivo, _ := content["arquivo"].(string); arquivo != "" {
+		caminho, err := caminhoCatalogo(arquivo)
+		if err != nil {
+			sendErrorResponse(conn, err.Error())
+			return
+		}
+		lidos, err := os.ReadFile(caminho)
+		if err != nil {
+			sendErrorResponse(conn, fmt.Sprintf("Não foi possível ler o catálogo %s", arquivo))
+			return
+		}
+		dados = lidos
+		if formato == "" {
+			formato = formatoDoArquivo(arquivo)
+		}
+	} else if texto, _ := content["dados"].(string); texto != "" {
+		dados = []byte(texto)
+	} else {
+		sendErrorResponse(conn, "Informe o arquivo ou os dados do catálogo")
+		return
+	}
+	if formato == "" {
+		sendErrorResponse(conn, "Informe o formato do catálogo (CSV ou GEOJSON)")
+		return
+	}
+
+	entradas, erros := lerCatalogo(dados, formato)
+	if len(entradas) == 0 {
+		sendResponse(conn, Message{
+			Action: "ERRO",
+			Content: map[string]interface{}{
+				"mensagem": "Nenhum ponto válido no catálogo",
+				"erros":    erros,
+			},
+		})
+		return
+	}
+	substituir, _ := content["substituir"].(bool)
+	catalogo.importar(entradas, substituir)
+	fmt.Printf("Catálogo importado: %d pontos, %d recusados\n", len(entradas), len(erros))
+
+	sendResponse(conn, Message{
+		Action: "CATALOGO_IMPORTADO",
+		Content: map[string]interface{}{
+			"importados": len(entradas),
+			"erros":      erros,
+			"total":      len(catalogo.ids()),
+		},
+	})
+}
+
+// Exporta a rede atual como FeatureCollection GeoJSON, com fila e situação de
+// cada ponto, para visualização em mapas
+func handleExportarRede(conn net.Conn) {
+	sendResponse(conn, Message{
+		Action:  "REDE_GEOJSON",
+		Content: map[string]interface{}{"geojson": exportarRede()},
+	})
+}
+
+// Caminho do arquivo dentro de CATALOGO_DIRETORIO. Recusa caminhos, para
+// que o pedido não leia outros arquivos do servidor.
+func caminhoCatalogo(arquivo string) (string, error) {
+	if diretorioCatalogos == "" {
+		return "", fmt.Errorf("Importação por arquivo desabilitada: defina CATALOGO_DIRETORIO no servidor")
+	}
+	if arquivo != filepath.Base(arquivo) || arquivo == "." || arquivo == ".." || strings.ContainsAny(arquivo, `/\`) {
+		return "", fmt.Errorf("Informe apenas o nome do arquivo em CATALOGO_DIRETORIO")
+	}
+	return filepath.Join(diretorioCatalogos, arquivo), nil
+}
+
+func exportarRede() ColecaoGeoJSON {
+	colecao := ColecaoGeoJSON{Type: "FeatureCollection", Features: []FeatureGeoJSON{}}
+	enderecos := enderecosDosPontos()
+	for i, ponto := range consultarPontos(enderecos) {
+		endereco := enderecos[i]
+		status := statusLivre
+		if ponto.ID == "" {
+			// Sem resposta: só entra no mapa se o catálogo souber onde fica
+			entrada, existe := catalogo.entrada(endereco)
+			if !existe {
+				continue
+			}
+			ponto = PontoRecarga{
+				ID:         entrada.ID,
+				Nome:       entrada.Nome,
+				Endereco:   entrada.Endereco,
+				Conectores: entrada.Conectores,
+				Latitude:   entrada.Latitude,
+				Longitude:  entrada.Longitude,
+				Tarifa:     tarifaDoPonto(entrada.ID),
+			}
+			status = statusOffline
+		} else if emCarregamento(ponto.ID) {
+			status = statusCarregando
+		} else if ponto.TamanhoFila > 0 {
+			status = statusReservado
+		}
+
+		propriedades := map[string]interface{}{
+			"ID":           ponto.ID,
+			"status":       status,
+			"tamanho_fila": ponto.TamanhoFila,
+			"tarifa":       ponto.Tarifa.Nome,
+			"preco_kwh":    ponto.Tarifa.PrecoKWh,
+		}
+		if status != statusOffline {
+			propriedades["potencia_kw"] = ponto.PotenciaKW
+		}
+		if ponto.Nome != "" {
+			propriedades["nome"] = ponto.Nome
+		}
+		if ponto.Endereco != "" {
+			propriedades["endereco"] = ponto.Endereco
+		}
+		if len(ponto.Conectores) > 0 {
+			propriedades["conectores"] = ponto.Conectores
+		}
+		if ponto.Site != "" {
+			propriedades["site"] = ponto.Site
+		}
+		colecao.Features = append(colecao.Features, FeatureGeoJSON{
+			Type:       "Feature",
+			Geometry:   &GeometriaGeoJSON{Type: "Point", Coordinates: []float64{ponto.Longitude, ponto.Latitude}},
+			Properties: propriedades,
+		})
+	}
+	return colecao
+}
+
+func emCarregamento(pontoID string) bool {
+	carregamentoMutex.Lock()
+	defer carregamentoMutex.Unlock()
+	_, existe := carrosEmCarregamento[pontoID]
+	return existe
+}
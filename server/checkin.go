@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// Situação de uma tentativa de check-in
+const (
+	checkInAceito   = "ACEITO"
+	checkInRecusado = "RECUSADO"
+)
+
+const codigoCheckInRecusado = "CHECK_IN_RECUSADO"
+
+var (
+	// Distância máxima (m) entre a posição informada pelo carro e o ponto
+	raioCheckInM = lerFloatEnv("CHECK_IN_RAIO_M", 200)
+	// Prazo para iniciar o carregamento depois do check-in
+	validadeCheckIn = time.Duration(lerFloatEnv("CHECK_IN_VALIDADE_MIN", 30) * float64(time.Minute))
+)
+
+// Tentativa de check-in do carro em um ponto, aceita ou não, guardada no
+// livro-razão para auditoria
+type CheckIn struct {
+	ID             string    `json:"id"`
+	CarroID        string    `json:"carroID"`
+	PontoID        string    `json:"pontoID"`
+	Latitude       float64   `json:"latitude"` // Posição informada pelo carro
+	Longitude      float64   `json:"longitude"`
+	PontoLatitude  float64   `json:"ponto_latitude"`
+	PontoLongitude float64   `json:"ponto_longitude"`
+	DistanciaM     float64   `json:"distancia_m"`
+	RaioM          float64   `json:"raio_m"`
+	Status         string    `json:"status"`
+	Motivo         string    `json:"motivo,omitempty"` // Por que foi recusado
+	Data           time.Time `json:"data"`
+	SessaoID       string    `json:"historicoID,omitempty"` // Sessão iniciada com este check-in
+}
+
+func (r *LivroRazao) registrarCheckIn(checkIn CheckIn) CheckIn {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	checkIn.ID = r.proximoID("checkin")
+	r.CheckIns = append(r.CheckIns, checkIn)
+	r.salvar()
+	return checkIn
+}
+
+// Último check-in aceito do carro no ponto que ainda não foi usado e não
+// expirou. Deve ser chamada com r.mu travado.
+func (r *LivroRazao) checkInValidoTravado(carroID, pontoID string, agora time.Time) *CheckIn {
+	for i := len(r.CheckIns) - 1; i >= 0; i-- {
+		c := &r.CheckIns[i]
+		if c.CarroID != carroID || c.PontoID != pontoID || c.Status != checkInAceito {
+			continue
+		}
+		if c.SessaoID != "" || agora.Sub(c.Data) > validadeCheckIn {
+			return nil
+		}
+		return c
+	}
+	return nil
+}
+
+// Verifica se o carro fez check-in no ponto antes de iniciar o carregamento
+func (r *LivroRazao) verificarCheckIn(carroID, pontoID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.checkInValidoTravado(carroID, pontoID, time.Now()) == nil {
+		return fmt.Errorf("Faça o check-in no ponto %s antes de iniciar o carregamento", pontoID)
+	}
+	return nil
+}
+
+// Lê a posição do carro, confere a reserva e a distância até o ponto e
+// registra o check-in. O carregamento só pode começar após um check-in aceito.
+func handleCheckIn(conn net.Conn, content map[string]interface{}) {
+	carroID, okCarro := content["ID"].(string)
+	pontoID, okPonto := content["pontoID"].(string)
+	latitude, okLat := content["latitude"].(float64)
+	longitude, okLon := content["longitude"].(float64)
+	if !okCarro || !okPonto || !okLat || !okLon {
+		sendErrorResponse(conn, "Dados do check-in incompletos")
+		return
+	}
+
+	enderecoPonto := enderecoDoPonto(pontoID)
+	if enderecoPonto == "" {
+		sendErrorResponse(conn, msgPontoNaoEncontrado)
+		return
+	}
+	ponto := obterInformacoesPonto(enderecoPonto)
+	if ponto.ID == "" {
+		sendErrorResponse(conn, "Ponto de recarga indisponível")
+		return
+	}
+
+	checkIn := CheckIn{
+		CarroID:        carroID,
+		PontoID:        pontoID,
+		Latitude:       latitude,
+		Longitude:      longitude,
+		PontoLatitude:  ponto.Latitude,
+		PontoLongitude: ponto.Longitude,
+		DistanciaM:     calcularDistancia(latitude, longitude, ponto.Latitude, ponto.Longitude) * 1000,
+		RaioM:          raioCheckInM,
+		Status:         checkInAceito,
+		Data:           time.Now(),
+	}
+	switch {
+	case posicaoNaFila(ponto.Fila, carroID) == 0:
+		checkIn.Status, checkIn.Motivo = checkInRecusado, "Carro sem reserva no ponto"
+	case checkIn.DistanciaM > raioCheckInM:
+		checkIn.Status, checkIn.Motivo = checkInRecusado, fmt.Sprintf("Carro a %.0f m do ponto, fora do raio de %.0f m", checkIn.DistanciaM, raioCheckInM)
+	}
+	checkIn = razao.registrarCheckIn(checkIn)
+	fmt.Printf("Check-in %s do carro %s no ponto %s: %s %s\n", checkIn.ID, carroID, pontoID, checkIn.Status, checkIn.Motivo)
+
+	if checkIn.Status != checkInAceito {
+		sendResponse(conn, Message{
+			Action: "ERRO",
+			Content: map[string]interface{}{
+				"codigo":   codigoCheckInRecusado,
+				"mensagem": "Check-in recusado: " + checkIn.Motivo,
+				"check_in": checkIn,
+			},
+		})
+		return
+	}
+	sendResponse(conn, Message{
+		Action: "CHECK_IN_CONFIRMADO",
+		Content: map[string]interface{}{
+			"check_in":        checkIn,
+			"valido_ate":      checkIn.Data.Add(validadeCheckIn),
+			"pontoID":         pontoID,
+			"posicao_na_fila": posicaoNaFila(ponto.Fila, carroID),
+		},
+	})
+}
+
+func posicaoNaFila(fila []string, carroID string) int {
+	for i, id := range fila {
+		if id == carroID {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// Lista os check-ins registrados, filtrando por carro e ponto se informados. Restrita ao operador.
+func handleConsultarCheckIns(conn net.Conn, content map[string]interface{}) {
+	if !operadorAutorizado(conn, content) {
+		return
+	}
+	carroID, _ := content["carroID"].(string)
+	pontoID, _ := content["pontoID"].(string)
+
+	razao.mu.Lock()
+	checkIns := []CheckIn{}
+	for _, c := range razao.CheckIns {
+		if (carroID == "" || c.CarroID == carroID) && (pontoID == "" || c.PontoID == pontoID) {
+			checkIns = append(checkIns, c)
+		}
+	}
+	razao.mu.Unlock()
+
+	sendResponse(conn, Message{
+		Action:  "CHECK_INS",
+		Content: map[string]interface{}{"check_ins": checkIns},
+	})
+}
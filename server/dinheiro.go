@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Valor monetário em unidades mínimas da moeda do servidor (centavos, no
+// caso do real). No protocolo e no livro-razão é escrito como texto decimal
+// ("12.34"); números com casas decimais ainda são aceitos por compatibilidade
+// com clientes e arquivos antigos.
+type Dinheiro int64
+
+// Regras de arredondamento aceitas no campo "arredondamento" das tarifas
+const (
+	arredondamentoMeioParaCima = "MEIO_PARA_CIMA" // 0,005 vira 0,01
+	arredondamentoMeioPar      = "MEIO_PAR"       // Empates vão para o centavo par
+	arredondamentoParaCima     = "PARA_CIMA"
+	arredondamentoParaBaixo    = "PARA_BAIXO"
+)
+
+// Casas decimais das moedas conhecidas; as demais usam duas
+var casasDecimaisMoeda = map[string]int{
+	"BRL": 2,
+	"USD": 2,
+	"EUR": 2,
+	"JPY": 0,
+	"CLP": 0,
+}
+
+// Código ISO 4217 da moeda em que o servidor cobra
+var moeda = strings.ToUpper(lerEnvPadrao("MOEDA", "BRL"))
+
+func casasDecimais() int {
+	if casas, ok := casasDecimaisMoeda[moeda]; ok {
+		return casas
+	}
+	return 2
+}
+
+// Converte um valor em unidades da moeda (ex.: reais) aplicando a regra de arredondamento
+func dinheiroDeFloat(valor float64, regra string) Dinheiro {
+	unidades := valor * math.Pow10(casasDecimais())
+	// Remove o ruído do ponto flutuante (2.675 * 100 = 267.49999...) antes de arredondar
+	unidades = math.Round(unidades*1e6) / 1e6
+
+	switch regra {
+	case arredondamentoMeioPar:
+		return Dinheiro(math.RoundToEven(unidades))
+	case arredondamentoParaCima:
+		return Dinheiro(math.Ceil(unidades))
+	case arredondamentoParaBaixo:
+		return Dinheiro(math.Floor(unidades))
+	default:
+		return Dinheiro(math.Round(unidades))
+	}
+}
+
+// Lê um valor decimal exato, com ponto ou vírgula ("12.34", "12,3", "-5")
+func parseDinheiro(texto string) (Dinheiro, error) {
+	texto = strings.Replace(strings.TrimSpace(texto), ",", ".", 1)
+	negativo := strings.HasPrefix(texto, "-")
+	texto = strings.TrimPrefix(texto, "-")
+
+	inteiro, fracao, _ := strings.Cut(texto, ".")
+	casas := casasDecimais()
+	if inteiro == "" || len(fracao) > casas || strings.ContainsAny(inteiro+fracao, "+-") {
+		return 0, fmt.Errorf("valor %q inválido para a moeda %s", texto, moeda)
+	}
+	fracao += strings.Repeat("0", casas-len(fracao))
+
+	unidades, err := strconv.ParseInt(inteiro+fracao, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("valor %q inválido para a moeda %s", texto, moeda)
+	}
+	if negativo {
+		unidades = -unidades
+	}
+	return Dinheiro(unidades), nil
+}
+
+// Valor monetário de uma mensagem: texto decimal ou, em payloads antigos, número
+func lerDinheiro(content map[string]interface{}, chave string) (Dinheiro, bool) {
+	switch valor := content[chave].(type) {
+	case string:
+		d, err := parseDinheiro(valor)
+		return d, err == nil
+	case float64:
+		return dinheiroDeFloat(valor, arredondamentoMeioParaCima), true
+	default:
+		return 0, false
+	}
+}
+
+// Recusa mensagens que informam uma moeda diferente da do servidor
+func verificarMoeda(content map[string]interface{}) error {
+	if codigo, ok := content["moeda"].(string); ok && strings.ToUpper(codigo) != moeda {
+		return fmt.Errorf("Moeda %s não aceita, o servidor cobra em %s", codigo, moeda)
+	}
+	return nil
+}
+
+func (d Dinheiro) String() string {
+	casas := casasDecimais()
+	unidades := int64(d)
+	sinal := ""
+	if unidades < 0 {
+		sinal = "-"
+		unidades = -unidades
+	}
+	if casas == 0 {
+		return fmt.Sprintf("%s%d", sinal, unidades)
+	}
+	fator := int64(math.Pow10(casas))
+	return fmt.Sprintf("%s%d.%0*d", sinal, unidades/fator, casas, unidades%fator)
+}
+
+func (d Dinheiro) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Dinheiro) UnmarshalJSON(dados []byte) error {
+	var texto string
+	if err := json.Unmarshal(dados, &texto); err == nil {
+		valor, err := parseDinheiro(texto)
+		if err != nil {
+			return err
+		}
+		*d = valor
+		return nil
+	}
+
+	// Livros-razão gravados antes da mudança guardam valores em float
+	var antigo float64
+	if err := json.Unmarshal(dados, &antigo); err != nil {
+		return err
+	}
+	*d = dinheiroDeFloat(antigo, arredondamentoMeioParaCima)
+	return nil
+}
+
+func minDinheiro(a, b Dinheiro) Dinheiro {
+	if a < b {
+		return a
+	}
+	return b
+}
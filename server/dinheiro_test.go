@@ -0,0 +1,73 @@
+package main
+
+import "testing"
+
+func TestParseDinheiro(t *testing.T) {
+	casos := []struct {
+		texto string
+		valor Dinheiro
+		erro  bool
+	}{
+		{texto: "12.34", valor: 1234},
+		{texto: "12,3", valor: 1230},
+		{texto: "12", valor: 1200},
+		{texto: " 0.05 ", valor: 5},
+		{texto: "-5", valor: -500},
+		{texto: "-0.01", valor: -1},
+		// Valores exatos: casas além das da moeda são recusadas, não arredondadas
+		{texto: "2.675", erro: true},
+		{texto: "0.001", erro: true},
+		{texto: "", erro: true},
+		{texto: ".50", erro: true},
+		{texto: "1.2.3", erro: true},
+		{texto: "--1", erro: true},
+		{texto: "1.-5", erro: true},
+		{texto: "abc", erro: true},
+	}
+
+	for _, caso := range casos {
+		t.Run(caso.texto, func(t *testing.T) {
+			valor, err := parseDinheiro(caso.texto)
+			if caso.erro {
+				if err == nil {
+					t.Errorf("esperado erro, obtido %s", valor)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("erro inesperado: %v", err)
+			}
+			if valor != caso.valor {
+				t.Errorf("valor %d, esperado %d", valor, caso.valor)
+			}
+		})
+	}
+}
+
+func TestDinheiroDeFloat(t *testing.T) {
+	casos := []struct {
+		nome  string
+		valor float64
+		regra string
+		total Dinheiro
+	}{
+		// 2.675 * 100 = 267.49999... em ponto flutuante
+		{nome: "meio para cima com ruído", valor: 2.675, regra: arredondamentoMeioParaCima, total: 268},
+		{nome: "meio para cima", valor: 0.125, regra: arredondamentoMeioParaCima, total: 13},
+		{nome: "regra vazia usa meio para cima", valor: 0.125, total: 13},
+		{nome: "meio par arredonda para baixo", valor: 0.125, regra: arredondamentoMeioPar, total: 12},
+		{nome: "meio par arredonda para cima", valor: 0.135, regra: arredondamentoMeioPar, total: 14},
+		{nome: "para cima", valor: 1.001, regra: arredondamentoParaCima, total: 101},
+		{nome: "para cima sem ruído", valor: 1.1, regra: arredondamentoParaCima, total: 110},
+		{nome: "para baixo", valor: 1.009, regra: arredondamentoParaBaixo, total: 100},
+		{nome: "negativo meio para cima", valor: -2.675, regra: arredondamentoMeioParaCima, total: -268},
+	}
+
+	for _, caso := range casos {
+		t.Run(caso.nome, func(t *testing.T) {
+			if total := dinheiroDeFloat(caso.valor, caso.regra); total != caso.total {
+				t.Errorf("%v com %q: %d, esperado %d", caso.valor, caso.regra, total, caso.total)
+			}
+		})
+	}
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Situação de uma disputa de cobrança
+const (
+	disputaAberta   = "ABERTA"
+	disputaAprovada = "APROVADA"
+	disputaNegada   = "NEGADA"
+)
+
+// Token exigido em "token_operador" nas ações do operador. Sem ele, essas
+// ações ficam desabilitadas.
+var tokenOperador = os.Getenv("OPERADOR_TOKEN")
+
+// Evita que dois reembolsos da mesma sessão devolvam o mesmo crédito
+var reembolsoMutex sync.Mutex
+
+// Contestação do valor de uma sessão, aberta pelo carro e resolvida pelo operador
+type Disputa struct {
+	ID            string     `json:"id"`
+	SessaoID      string     `json:"historicoID"`
+	CarroID       string     `json:"carroID"`
+	Motivo        string     `json:"motivo"`
+	Status        string     `json:"status"`
+	ValorOriginal Dinheiro   `json:"valor_original"`
+	ValorAjustado Dinheiro   `json:"valor_ajustado"` // Preenchido na aprovação
+	Observacao    string     `json:"observacao,omitempty"`
+	Abertura      time.Time  `json:"abertura"`
+	Resolucao     *time.Time `json:"resolucao,omitempty"`
+}
+
+// Crédito que ainda pode ser devolvido, e quanto devolver dele
+type parcelaReembolso struct {
+	Credito Lancamento
+	Valor   Dinheiro
+}
+
+// Abre uma disputa para uma sessão finalizada do carro. Só pode haver uma
+// disputa aberta por sessão.
+func (r *LivroRazao) abrirDisputa(carroID, sessaoID, motivo string) (Disputa, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sessao, existe := r.Sessoes[sessaoID]
+	switch {
+	case !existe:
+		return Disputa{}, fmt.Errorf("Sessão %s não encontrada", sessaoID)
+	case sessao.CarroID != carroID:
+		return Disputa{}, fmt.Errorf("Sessão %s pertence a outro carro", sessaoID)
+	case !sessao.Finalizada:
+		return Disputa{}, fmt.Errorf("Sessão %s ainda está em andamento", sessaoID)
+	}
+	for _, d := range r.Disputas {
+		if d.SessaoID == sessaoID && d.Status == disputaAberta {
+			return Disputa{}, fmt.Errorf("Já existe a disputa %s aberta para a sessão %s", d.ID, sessaoID)
+		}
+	}
+
+	disputa := &Disputa{
+		ID:            r.proximoID("disputa"),
+		SessaoID:      sessaoID,
+		CarroID:       carroID,
+		Motivo:        motivo,
+		Status:        disputaAberta,
+		ValorOriginal: sessao.totalDevido(),
+		Abertura:      time.Now(),
+	}
+	r.Disputas[disputa.ID] = disputa
+	r.salvar()
+	return *disputa, nil
+}
+
+// Registra a decisão do operador. Na aprovação, a diferença para o valor
+// ajustado é lançada como ajuste e abatida da dívida da sessão. A diferença
+// parte do total atual da sessão, e não do valor da abertura, porque
+// descontos e ajustes podem ter sido lançados enquanto a disputa estava aberta.
+func (r *LivroRazao) resolverDisputa(disputaID string, aprovar bool, ajustado Dinheiro, observacao string) (Disputa, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	disputa, existe := r.Disputas[disputaID]
+	if !existe {
+		return Disputa{}, fmt.Errorf("Disputa %s não encontrada", disputaID)
+	}
+	if disputa.Status != disputaAberta {
+		return Disputa{}, fmt.Errorf("Disputa %s já foi resolvida (%s)", disputaID, disputa.Status)
+	}
+
+	sessao := r.Sessoes[disputa.SessaoID]
+	atual := sessao.totalDevido()
+	if aprovar {
+		if ajustado < 0 || ajustado > atual {
+			return Disputa{}, fmt.Errorf("Valor ajustado deve estar entre 0 e %s", atual)
+		}
+		if abatimento := atual - ajustado; abatimento > 0 {
+			sessao.Ajuste += abatimento
+			r.Lancamentos = append(r.Lancamentos, Lancamento{
+				ID:        r.proximoID("lanc"),
+				SessaoID:  sessao.ID,
+				CarroID:   sessao.CarroID,
+				Tipo:      lancamentoAjuste,
+				Valor:     abatimento,
+				Data:      time.Now(),
+				Descricao: fmt.Sprintf("Ajuste da disputa %s", disputaID),
+			})
+		}
+		disputa.Status = disputaAprovada
+		disputa.ValorAjustado = ajustado
+	} else {
+		disputa.Status = disputaNegada
+		disputa.ValorAjustado = atual
+	}
+
+	disputa.Observacao = observacao
+	agora := time.Now()
+	disputa.Resolucao = &agora
+	r.salvar()
+	return *disputa, nil
+}
+
+// Disputa mais recente da sessão do carro
+func (r *LivroRazao) disputaDaSessao(carroID, sessaoID string) (Disputa, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var encontrada *Disputa
+	for _, d := range r.Disputas {
+		if d.CarroID == carroID && d.SessaoID == sessaoID && (encontrada == nil || d.Abertura.After(encontrada.Abertura)) {
+			encontrada = d
+		}
+	}
+	if encontrada == nil {
+		return Disputa{}, false
+	}
+	return *encontrada, true
+}
+
+// Créditos a devolver para zerar o excedente da sessão, do mais recente
+// para o mais antigo
+func (r *LivroRazao) planoReembolso(sessaoID string) ([]parcelaReembolso, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, existe := r.Sessoes[sessaoID]; !existe {
+		return nil, fmt.Errorf("Sessão %s não encontrada", sessaoID)
+	}
+	excedente := -r.saldoSessao(sessaoID)
+	if excedente <= 0 {
+		return nil, fmt.Errorf("Sessão %s não tem valor a reembolsar", sessaoID)
+	}
+
+	devolvido := make(map[string]Dinheiro)
+	for _, l := range r.Lancamentos {
+		if l.Tipo == lancamentoReembolso {
+			devolvido[l.Referencia] += l.Valor
+		}
+	}
+
+	var plano []parcelaReembolso
+	for i := len(r.Lancamentos) - 1; i >= 0 && excedente > 0; i-- {
+		l := r.Lancamentos[i]
+		if l.SessaoID != sessaoID || l.Tipo != lancamentoCredito {
+			continue
+		}
+		disponivel := l.Valor - devolvido[l.ID]
+		if disponivel <= 0 {
+			continue
+		}
+		parte := minDinheiro(disponivel, excedente)
+		plano = append(plano, parcelaReembolso{Credito: l, Valor: parte})
+		excedente -= parte
+	}
+	return plano, nil
+}
+
+// Lança a devolução de uma parcela. Pagamentos feitos pela carteira ou por
+// PIX voltam como saldo na carteira do carro.
+func (r *LivroRazao) registrarReembolso(parcela parcelaReembolso, naCarteira bool, transacaoID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	descricao := "Reembolso no meio de pagamento"
+	if naCarteira {
+		descricao = "Reembolso na carteira"
+		carteira := r.carteira(parcela.Credito.CarroID)
+		carteira.Saldo += parcela.Valor
+		carteira.Movimentos = append(carteira.Movimentos, MovimentoCarteira{
+			Tipo:     "REEMBOLSO",
+			Valor:    parcela.Valor,
+			Data:     time.Now(),
+			SessaoID: parcela.Credito.SessaoID,
+		})
+	}
+
+	r.Lancamentos = append(r.Lancamentos, Lancamento{
+		ID:          r.proximoID("lanc"),
+		SessaoID:    parcela.Credito.SessaoID,
+		CarroID:     parcela.Credito.CarroID,
+		Tipo:        lancamentoReembolso,
+		Valor:       parcela.Valor,
+		Data:        time.Now(),
+		Descricao:   descricao,
+		TransacaoID: transacaoID,
+		Referencia:  parcela.Credito.ID,
+	})
+	r.salvar()
+}
+
+// Devolve o que a sessão recebeu além do devido. Em caso de falha no
+// provedor, o que já foi devolvido fica lançado e o restante pode ser
+// tentado de novo com REEMBOLSO.
+func reembolsarSessao(sessaoID string) (Dinheiro, error) {
+	reembolsoMutex.Lock()
+	defer reembolsoMutex.Unlock()
+
+	plano, err := razao.planoReembolso(sessaoID)
+	if err != nil {
+		return 0, err
+	}
+
+	var total Dinheiro
+	for _, parcela := range plano {
+		credito := parcela.Credito
+		naCarteira := credito.TransacaoID == "" ||
+			strings.HasPrefix(credito.ChaveIdempotencia, "carteira-") ||
+			strings.HasPrefix(credito.ChaveIdempotencia, "pix-")
+
+		transacaoID := ""
+		if !naCarteira {
+			if _, err := provedorPagamento.Refund(credito.TransacaoID, parcela.Valor); err != nil {
+				return total, fmt.Errorf("Falha ao estornar %s da transação %s: %v", parcela.Valor, credito.TransacaoID, err)
+			}
+			transacaoID = credito.TransacaoID
+		}
+		razao.registrarReembolso(parcela, naCarteira, transacaoID)
+		total += parcela.Valor
+	}
+	fmt.Printf("Reembolso de %s realizado para a sessão %s\n", total, sessaoID)
+	return total, nil
+}
+
+func handleAbrirDisputa(conn net.Conn, content map[string]interface{}) {
+	carroID, okCarro := content["carroID"].(string)
+	historicoID, okHistorico := content["historicoID"].(string)
+	motivo, _ := content["motivo"].(string)
+	if !okCarro || !okHistorico || strings.TrimSpace(motivo) == "" {
+		sendErrorResponse(conn, "Dados da disputa incompletos")
+		return
+	}
+
+	disputa, err := razao.abrirDisputa(carroID, historicoID, motivo)
+	if err != nil {
+		sendErrorResponse(conn, err.Error())
+		return
+	}
+	fmt.Printf("Disputa %s aberta pelo carro %s para a sessão %s: %s\n", disputa.ID, carroID, historicoID, motivo)
+	sendResponse(conn, respostaDisputa("DISPUTA_ABERTA", disputa, 0))
+}
+
+func handleConsultarDisputa(conn net.Conn, content map[string]interface{}) {
+	carroID, okCarro := content["carroID"].(string)
+	historicoID, okHistorico := content["historicoID"].(string)
+	if !okCarro || !okHistorico {
+		sendErrorResponse(conn, "Dados da disputa incompletos")
+		return
+	}
+
+	disputa, existe := razao.disputaDaSessao(carroID, historicoID)
+	if !existe {
+		sendErrorResponse(conn, fmt.Sprintf("Nenhuma disputa para a sessão %s", historicoID))
+		return
+	}
+	sendResponse(conn, respostaDisputa("DISPUTA", disputa, 0))
+}
+
+// Ação do operador: aprova (com o valor ajustado) ou nega a disputa. Se a
+// sessão ficar paga a mais, o excedente é reembolsado em seguida.
+func handleResolverDisputa(conn net.Conn, content map[string]interface{}) {
+	if !operadorAutorizado(conn, content) {
+		return
+	}
+	disputaID, okDisputa := content["disputaID"].(string)
+	decisao, _ := content["decisao"].(string)
+	observacao, _ := content["observacao"].(string)
+	if !okDisputa || (decisao != "APROVAR" && decisao != "NEGAR") {
+		sendErrorResponse(conn, "Informe disputaID e decisao (APROVAR ou NEGAR)")
+		return
+	}
+
+	aprovar := decisao == "APROVAR"
+	ajustado, okAjustado := lerDinheiro(content, "valor_ajustado")
+	if aprovar && !okAjustado {
+		sendErrorResponse(conn, "Valor ajustado inválido")
+		return
+	}
+	if err := verificarMoeda(content); err != nil {
+		sendErrorResponse(conn, err.Error())
+		return
+	}
+
+	disputa, err := razao.resolverDisputa(disputaID, aprovar, ajustado, observacao)
+	if err != nil {
+		sendErrorResponse(conn, err.Error())
+		return
+	}
+	fmt.Printf("Disputa %s resolvida: %s (valor %s)\n", disputa.ID, disputa.Status, disputa.ValorAjustado)
+
+	var reembolsado Dinheiro
+	if aprovar {
+		reembolsado, err = reembolsarSessao(disputa.SessaoID)
+		if err != nil && reembolsado == 0 {
+			fmt.Println("Reembolso não realizado:", err)
+		}
+	}
+	sendResponse(conn, respostaDisputa("DISPUTA_RESOLVIDA", disputa, reembolsado))
+}
+
+// Ação do operador: devolve o excedente pago em uma sessão
+func handleReembolso(conn net.Conn, content map[string]interface{}) {
+	if !operadorAutorizado(conn, content) {
+		return
+	}
+	historicoID, ok := content["historicoID"].(string)
+	if !ok {
+		sendErrorResponse(conn, "ID da sessão inválido")
+		return
+	}
+
+	reembolsado, err := reembolsarSessao(historicoID)
+	if err != nil && reembolsado == 0 {
+		sendErrorResponse(conn, err.Error())
+		return
+	}
+
+	resposta := map[string]interface{}{
+		"historicoID": historicoID,
+		"reembolsado": reembolsado,
+		"moeda":       moeda,
+	}
+	if err != nil {
+		resposta["mensagem"] = err.Error()
+	}
+	sendResponse(conn, Message{Action: "REEMBOLSO_REALIZADO", Content: resposta})
+}
+
+func operadorAutorizado(conn net.Conn, content map[string]interface{}) bool {
+	if tokenOperador == "" {
+		sendErrorResponse(conn, "Ações do operador desabilitadas: defina OPERADOR_TOKEN no servidor")
+		return false
+	}
+	token, _ := content["token_operador"].(string)
+	if subtle.ConstantTimeCompare([]byte(token), []byte(tokenOperador)) != 1 {
+		sendErrorResponse(conn, "Ação restrita ao operador")
+		return false
+	}
+	return true
+}
+
+// Disputa com a situação atual da sessão, para que o carro ajuste seu histórico
+func respostaDisputa(acao string, disputa Disputa, reembolsado Dinheiro) Message {
+	recibo, _ := razao.recibo(disputa.CarroID, disputa.SessaoID)
+	content := map[string]interface{}{
+		"disputa":           disputa,
+		"historicoID":       disputa.SessaoID,
+		"ajuste":            recibo.Ajuste,
+		"total_reembolsado": recibo.Reembolsado,
+		"saldo":             recibo.Saldo,
+		"moeda":             moeda,
+	}
+	if reembolsado > 0 {
+		content["reembolsado"] = reembolsado
+	}
+	return Message{Action: acao, Content: content}
+}
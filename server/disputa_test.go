@@ -0,0 +1,55 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// O abatimento da disputa parte do total da sessão na resolução, que pode
+// ter mudado desde a abertura por descontos lançados nesse meio-tempo
+func TestResolverDisputaUsaTotalAtual(t *testing.T) {
+	casos := []struct {
+		nome     string
+		desconto Dinheiro // Lançado depois da abertura
+		aprovar  bool
+		ajustado Dinheiro
+		erro     bool
+		ajuste   Dinheiro
+		devido   Dinheiro
+	}{
+		{nome: "sem desconto", aprovar: true, ajustado: 600, ajuste: 400, devido: 600},
+		{nome: "desconto depois da abertura", desconto: 300, aprovar: true, ajustado: 600, ajuste: 100, devido: 600},
+		{nome: "ajustado acima do total atual", desconto: 300, aprovar: true, ajustado: 800, erro: true, devido: 700},
+		{nome: "negada", desconto: 300, devido: 700},
+	}
+
+	for _, caso := range casos {
+		t.Run(caso.nome, func(t *testing.T) {
+			r := novoRazao(filepath.Join(t.TempDir(), "razao.json"))
+			sessao := &SessaoRazao{ID: "sessao-1", CarroID: "A", Cobranca: DetalheCobranca{Total: 1000}, Finalizada: true}
+			r.Sessoes[sessao.ID] = sessao
+
+			disputa, err := r.abrirDisputa("A", sessao.ID, "cobrança indevida")
+			if err != nil {
+				t.Fatalf("erro ao abrir disputa: %v", err)
+			}
+			if caso.desconto > 0 {
+				sessao.Descontos = append(sessao.Descontos, Desconto{Valor: caso.desconto})
+			}
+
+			resolvida, err := r.resolverDisputa(disputa.ID, caso.aprovar, caso.ajustado, "")
+			if caso.erro != (err != nil) {
+				t.Fatalf("erro %v, esperado erro: %v", err, caso.erro)
+			}
+			if sessao.Ajuste != caso.ajuste {
+				t.Errorf("ajuste %s, esperado %s", sessao.Ajuste, caso.ajuste)
+			}
+			if devido := sessao.totalDevido(); devido != caso.devido {
+				t.Errorf("total devido %s, esperado %s", devido, caso.devido)
+			}
+			if err == nil && resolvida.ValorAjustado != caso.devido {
+				t.Errorf("valor ajustado %s, esperado %s", resolvida.ValorAjustado, caso.devido)
+			}
+		})
+	}
+}
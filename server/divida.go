@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+const codigoDebitoPendente = "DEBITO_PENDENTE"
+
+// Máximos de dívida tolerados: novas reservas são recusadas quando o carro
+// passa de um deles. Só contam sessões vencidas, isto é, finalizadas há mais
+// que a carência. Máximos menores ou iguais a zero ficam desativados.
+type PoliticaDivida struct {
+	MaxSessoes int
+	MaxValor   Dinheiro
+	Carencia   time.Duration
+}
+
+var politicaDivida = PoliticaDivida{
+	MaxSessoes: int(lerFloatEnv("DIVIDA_MAX_SESSOES", 3)),
+	MaxValor:   dinheiroDeFloat(lerFloatEnv("DIVIDA_MAX_VALOR", 100), arredondamentoMeioParaCima),
+	Carencia:   time.Duration(lerFloatEnv("DIVIDA_CARENCIA_MINUTOS", 60) * float64(time.Minute)),
+}
+
+type SituacaoDivida struct {
+	SessoesEmAberto int      `json:"sessoes_em_aberto"`
+	TotalEmAberto   Dinheiro `json:"total_em_aberto"`
+	SessoesVencidas int      `json:"sessoes_vencidas"`
+	TotalVencido    Dinheiro `json:"total_vencido"`
+}
+
+// Soma as sessões do carro que ainda têm saldo a pagar
+func (r *LivroRazao) situacaoDivida(carroID string, agora time.Time, carencia time.Duration) SituacaoDivida {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var situacao SituacaoDivida
+	for _, sessao := range r.Sessoes {
+		if sessao.CarroID != carroID || !sessao.Finalizada {
+			continue
+		}
+		saldo := r.saldoSessao(sessao.ID)
+		if saldo <= 0 {
+			continue
+		}
+		situacao.SessoesEmAberto++
+		situacao.TotalEmAberto += saldo
+		if agora.Sub(sessao.Fim) > carencia {
+			situacao.SessoesVencidas++
+			situacao.TotalVencido += saldo
+		}
+	}
+	return situacao
+}
+
+// Retorna a situação do carro e, se ela passar de algum máximo da política,
+// o motivo da recusa; vazio se o carro pode reservar
+func (p PoliticaDivida) verificar(carroID string) (SituacaoDivida, string) {
+	situacao := razao.situacaoDivida(carroID, time.Now(), p.Carencia)
+	switch {
+	case p.MaxSessoes > 0 && situacao.SessoesVencidas > p.MaxSessoes:
+		return situacao, fmt.Sprintf("existem %d sessões vencidas sem pagamento, acima do máximo de %d", situacao.SessoesVencidas, p.MaxSessoes)
+	case p.MaxValor > 0 && situacao.TotalVencido > p.MaxValor:
+		return situacao, fmt.Sprintf("%s %s vencidos sem pagamento, acima do máximo de %s %s", situacao.TotalVencido, moeda, p.MaxValor, moeda)
+	}
+	return situacao, ""
+}
+
+// Recusa a reserva com o código DEBITO_PENDENTE quando o carro excede a política
+func bloqueadoPorDivida(conn net.Conn, carroID string) bool {
+	situacao, motivo := politicaDivida.verificar(carroID)
+	if motivo == "" {
+		return false
+	}
+
+	fmt.Printf("Reserva do carro %s recusada por dívida: %+v\n", carroID, situacao)
+	sendResponse(conn, Message{
+		Action: "ERRO",
+		Content: map[string]interface{}{
+			"codigo":            codigoDebitoPendente,
+			"mensagem":          "Reserva recusada: " + motivo,
+			"sessoes_em_aberto": situacao.SessoesEmAberto,
+			"total_em_aberto":   situacao.TotalEmAberto,
+			"sessoes_vencidas":  situacao.SessoesVencidas,
+			"total_vencido":     situacao.TotalVencido,
+			"moeda":             moeda,
+		},
+	})
+	return true
+}
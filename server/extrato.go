@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// Lista as sessões em aberto do carro, da mais antiga para a mais recente
+func handleExtrato(conn net.Conn, content map[string]interface{}) {
+	carroID, ok := content["carroID"].(string)
+	if !ok {
+		sendErrorResponse(conn, "ID do carro inválido")
+		return
+	}
+	sendResponse(conn, respostaExtrato("EXTRATO", carroID, nil))
+}
+
+// Paga várias sessões com uma única cobrança. Sem "historicoIDs", considera
+// todas as sessões em aberto. O valor pode ser menor que o total, e é
+// distribuído quitando primeiro as sessões mais antigas.
+func handlePagarTodas(conn net.Conn, content map[string]interface{}) {
+	carroID, okCarro := content["carroID"].(string)
+	valor, okValor := lerDinheiro(content, "valor")
+	chave, okChave := content["chave_idempotencia"].(string)
+	if !okCarro || !okValor || !okChave || chave == "" {
+		sendErrorResponse(conn, "Dados do pagamento incompletos")
+		return
+	}
+	if err := verificarMoeda(content); err != nil {
+		sendErrorResponse(conn, err.Error())
+		return
+	}
+	sessoes := convertInterfaceToStringSlice(content["historicoIDs"])
+
+	// Repetição de um pagamento já concluído: responde igual, sem cobrar de novo
+	if anteriores := razao.pagamentosPorChave(chave); len(anteriores) > 0 {
+		if anteriores[0].CarroID != carroID {
+			sendErrorResponse(conn, "Chave de idempotência já usada em outro pagamento")
+			return
+		}
+		var alocacoes []Alocacao
+		for _, l := range anteriores {
+			alocacoes = append(alocacoes, Alocacao{SessaoID: l.SessaoID, Valor: l.Valor})
+		}
+		sendResponse(conn, respostaPagamentoDistribuido(carroID, anteriores[0].TransacaoID, alocacoes))
+		return
+	}
+
+	if _, err := razao.alocarPagamento(carroID, sessoes, valor); err != nil {
+		sendErrorResponse(conn, err.Error())
+		return
+	}
+
+	pedido := PedidoPagamento{ChaveIdempotencia: chave, CarroID: carroID, Valor: valor}
+	cobranca, err := cobrarNoProvedor(pedido)
+	if err != nil {
+		fmt.Println("Falha no provedor de pagamento:", err)
+		sendErrorResponse(conn, err.Error())
+		return
+	}
+
+	alocacoes, err := razao.registrarPagamentoDistribuido(carroID, sessoes, valor, chave, cobranca.TransacaoID)
+	if err != nil {
+		// As pendências mudaram enquanto cobrávamos: devolve o valor
+		if _, errEstorno := provedorPagamento.Refund(cobranca.TransacaoID, valor); errEstorno != nil {
+			fmt.Println("Erro ao estornar pagamento:", errEstorno)
+		}
+		sendErrorResponse(conn, err.Error())
+		return
+	}
+
+	fmt.Printf("Pagamento de %s do carro %s distribuído em %d sessões\n", valor, carroID, len(alocacoes))
+	sendResponse(conn, respostaPagamentoDistribuido(carroID, cobranca.TransacaoID, alocacoes))
+}
+
+func respostaPagamentoDistribuido(carroID, transacaoID string, alocacoes []Alocacao) Message {
+	resposta := respostaExtrato("PAGAMENTOS_CONFIRMADOS", carroID, alocacoes)
+	resposta.Content["transacaoID"] = transacaoID
+	return resposta
+}
+
+func respostaExtrato(acao, carroID string, alocacoes []Alocacao) Message {
+	itens := razao.extrato(carroID)
+	var total Dinheiro
+	for _, item := range itens {
+		total += item.Saldo
+	}
+
+	content := map[string]interface{}{
+		"carroID":         carroID,
+		"sessoes":         itens,
+		"total_em_aberto": total,
+		"moeda":           moeda,
+	}
+	if alocacoes != nil {
+		content["alocacoes"] = alocacoes
+	}
+	return Message{Action: acao, Content: content}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+)
+
+// Como a distância até o ponto foi calculada
+const (
+	trajetoViario    = "VIARIO"     // Menor caminho pelo grafo de ruas
+	trajetoLinhaReta = "LINHA_RETA" // Haversine, sem grafo ou fora dele
+)
+
+const (
+	velocidadeViaPadraoKmH = 50.0 // Arestas sem velocidade informada
+	velocidadeAcessoKmH    = 30.0 // Trecho entre a posição e o nó mais próximo
+)
+
+var (
+	// Posições mais distantes que isso do nó mais próximo ficam fora do grafo
+	distanciaMaxAcessoKm = lerFloatEnv("GRAFO_ACESSO_MAX_KM", 2)
+	grafoViario          = carregarGrafo(os.Getenv("GRAFO_ARQUIVO"))
+)
+
+// Grafo viário simplificado, por exemplo extraído do OpenStreetMap: nós com
+// coordenadas e arestas com distância e velocidade
+type ArquivoGrafo struct {
+	Nos     []NoViario     `json:"nos"`
+	Arestas []ArestaViaria `json:"arestas"`
+}
+
+type NoViario struct {
+	ID        string  `json:"id"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// Sem distancia_km, vale a distância em linha reta entre os nós. Arestas são
+// de mão dupla, a menos que mao_unica seja informado.
+type ArestaViaria struct {
+	De            string  `json:"de"`
+	Para          string  `json:"para"`
+	DistanciaKm   float64 `json:"distancia_km,omitempty"`
+	VelocidadeKmH float64 `json:"velocidade_kmh,omitempty"`
+	MaoUnica      bool    `json:"mao_unica,omitempty"`
+}
+
+type GrafoViario struct {
+	nos       []NoViario
+	adjacente [][]ligacao // índice do nó -> arestas que saem dele
+}
+
+type ligacao struct {
+	destino     int
+	distanciaKm float64
+	tempoH      float64
+}
+
+// Distância e tempo de direção da origem até um ponto
+type Trajeto struct {
+	DistanciaKm float64
+	TempoMin    float64
+}
+
+// Lê o grafo viário de GRAFO_ARQUIVO; sem ele as distâncias são em linha reta
+func carregarGrafo(caminho string) *GrafoViario {
+	if caminho == "" {
+		return nil
+	}
+	dados, err := os.ReadFile(caminho)
+	if err != nil {
+		fmt.Printf("Grafo viário %s não encontrado, usando distâncias em linha reta\n", caminho)
+		return nil
+	}
+	var arquivo ArquivoGrafo
+	if err := json.Unmarshal(dados, &arquivo); err != nil {
+		fmt.Printf("Erro ao ler o grafo viário de %s: %v. Usando distâncias em linha reta\n", caminho, err)
+		return nil
+	}
+	grafo, err := montarGrafo(arquivo)
+	if err != nil {
+		fmt.Printf("Grafo viário %s inválido: %v. Usando distâncias em linha reta\n", caminho, err)
+		return nil
+	}
+	fmt.Printf("Grafo viário carregado de %s (%d nós, %d arestas)\n", caminho, len(arquivo.Nos), len(arquivo.Arestas))
+	return grafo
+}
+
+func montarGrafo(arquivo ArquivoGrafo) (*GrafoViario, error) {
+	if len(arquivo.Nos) == 0 {
+		return nil, fmt.Errorf("nenhum nó")
+	}
+	grafo := &GrafoViario{nos: arquivo.Nos, adjacente: make([][]ligacao, len(arquivo.Nos))}
+	indice := make(map[string]int, len(arquivo.Nos))
+	for i, no := range arquivo.Nos {
+		if _, repetido := indice[no.ID]; repetido {
+			return nil, fmt.Errorf("nó %s repetido", no.ID)
+		}
+		indice[no.ID] = i
+	}
+
+	for _, aresta := range arquivo.Arestas {
+		de, okDe := indice[aresta.De]
+		para, okPara := indice[aresta.Para]
+		if !okDe || !okPara {
+			return nil, fmt.Errorf("aresta %s-%s liga nó inexistente", aresta.De, aresta.Para)
+		}
+		distancia := aresta.DistanciaKm
+		if distancia <= 0 {
+			distancia = calcularDistancia(grafo.nos[de].Latitude, grafo.nos[de].Longitude, grafo.nos[para].Latitude, grafo.nos[para].Longitude)
+		}
+		velocidade := aresta.VelocidadeKmH
+		if velocidade <= 0 {
+			velocidade = velocidadeViaPadraoKmH
+		}
+		grafo.adjacente[de] = append(grafo.adjacente[de], ligacao{destino: para, distanciaKm: distancia, tempoH: distancia / velocidade})
+		if !aresta.MaoUnica {
+			grafo.adjacente[para] = append(grafo.adjacente[para], ligacao{destino: de, distanciaKm: distancia, tempoH: distancia / velocidade})
+		}
+	}
+	return grafo, nil
+}
+
+// Nó mais próximo da posição e a distância em linha reta até ele; -1 se
+// nenhum estiver a até distanciaMaxAcessoKm
+func (g *GrafoViario) noMaisProximo(lat, lon float64) (int, float64) {
+	melhor, menor := -1, math.Inf(1)
+	for i, no := range g.nos {
+		if d := calcularDistancia(lat, lon, no.Latitude, no.Longitude); d < menor {
+			melhor, menor = i, d
+		}
+	}
+	if menor > distanciaMaxAcessoKm {
+		return -1, 0
+	}
+	return melhor, menor
+}
+
+// Menores caminhos de uma origem a todos os nós do grafo, calculados uma vez
+// por consulta e usados para todos os pontos
+type CaminhosViarios struct {
+	grafo     *GrafoViario
+	acessoKm  float64   // Da origem até o nó de partida
+	distancia []float64 // Menor distância até cada nó
+	tempoH    []float64 // Tempo de direção pelo caminho de menor distância
+}
+
+// Calcula os caminhos pela menor distância (Dijkstra) a partir da posição.
+// Devolve nil sem grafo ou se a origem estiver fora dele.
+func (g *GrafoViario) caminhosDe(lat, lon float64) *CaminhosViarios {
+	if g == nil {
+		return nil
+	}
+	origem, acesso := g.noMaisProximo(lat, lon)
+	if origem < 0 {
+		return nil
+	}
+	c := &CaminhosViarios{
+		grafo:     g,
+		acessoKm:  acesso,
+		distancia: make([]float64, len(g.nos)),
+		tempoH:    make([]float64, len(g.nos)),
+	}
+	for i := range c.distancia {
+		c.distancia[i] = math.Inf(1)
+	}
+	c.distancia[origem] = 0
+
+	fila := &filaNos{{no: origem}}
+	for fila.Len() > 0 {
+		atual := heap.Pop(fila).(itemFila)
+		if atual.distancia > c.distancia[atual.no] {
+			continue // Entrada antiga, o nó já foi alcançado por caminho menor
+		}
+		for _, l := range g.adjacente[atual.no] {
+			if d := atual.distancia + l.distanciaKm; d < c.distancia[l.destino] {
+				c.distancia[l.destino] = d
+				c.tempoH[l.destino] = c.tempoH[atual.no] + l.tempoH
+				heap.Push(fila, itemFila{no: l.destino, distancia: d})
+			}
+		}
+	}
+	return c
+}
+
+// Trajeto até a posição pelo grafo, incluindo os trechos de acesso na origem
+// e no destino. Falso se o destino estiver fora do grafo ou sem caminho.
+func (c *CaminhosViarios) ate(lat, lon float64) (Trajeto, bool) {
+	if c == nil {
+		return Trajeto{}, false
+	}
+	destino, acesso := c.grafo.noMaisProximo(lat, lon)
+	if destino < 0 || math.IsInf(c.distancia[destino], 1) {
+		return Trajeto{}, false
+	}
+	acessos := c.acessoKm + acesso
+	return Trajeto{
+		DistanciaKm: c.distancia[destino] + acessos,
+		TempoMin:    (c.tempoH[destino] + acessos/velocidadeAcessoKmH) * 60,
+	}, true
+}
+
+// Fila de prioridade de nós pela distância acumulada
+type itemFila struct {
+	no        int
+	distancia float64
+}
+
+type filaNos []itemFila
+
+func (f filaNos) Len() int            { return len(f) }
+func (f filaNos) Less(i, j int) bool  { return f[i].distancia < f[j].distancia }
+func (f filaNos) Swap(i, j int)       { f[i], f[j] = f[j], f[i] }
+func (f *filaNos) Push(x interface{}) { *f = append(*f, x.(itemFila)) }
+func (f *filaNos) Pop() interface{} {
+	antiga := *f
+	item := antiga[len(antiga)-1]
+	*f = antiga[:len(antiga)-1]
+	return item
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// Malha pequena com coordenadas nos próprios nós, para que os trechos de
+// acesso sejam nulos. O caminho A-B-C é mais curto que a aresta direta A-C,
+// e D só é alcançado pela mão única C->D.
+func grafoDeTeste(t *testing.T) *GrafoViario {
+	t.Helper()
+	grafo, err := montarGrafo(ArquivoGrafo{
+		Nos: []NoViario{
+			{ID: "A", Latitude: -23.50, Longitude: -46.60},
+			{ID: "B", Latitude: -23.50, Longitude: -46.59},
+			{ID: "C", Latitude: -23.50, Longitude: -46.58},
+			{ID: "D", Latitude: -23.49, Longitude: -46.58},
+			{ID: "E", Latitude: -23.48, Longitude: -46.60},
+		},
+		Arestas: []ArestaViaria{
+			{De: "A", Para: "B", DistanciaKm: 1, VelocidadeKmH: 60},
+			{De: "B", Para: "C", DistanciaKm: 1, VelocidadeKmH: 30},
+			{De: "A", Para: "C", DistanciaKm: 5, VelocidadeKmH: 120},
+			{De: "C", Para: "D", DistanciaKm: 1, VelocidadeKmH: 60, MaoUnica: true},
+		},
+	})
+	if err != nil {
+		t.Fatalf("erro ao montar grafo: %v", err)
+	}
+	return grafo
+}
+
+func TestCaminhosViarios(t *testing.T) {
+	grafo := grafoDeTeste(t)
+	posicao := map[string][2]float64{}
+	for _, no := range grafo.nos {
+		posicao[no.ID] = [2]float64{no.Latitude, no.Longitude}
+	}
+	posicao["fora"] = [2]float64{-22.90, -43.17}
+
+	casos := []struct {
+		nome       string
+		origem     string
+		destino    string
+		alcancavel bool
+		distancia  float64
+		tempoMin   float64
+	}{
+		{nome: "mesmo nó", origem: "A", destino: "A", alcancavel: true},
+		{nome: "vizinho", origem: "A", destino: "B", alcancavel: true, distancia: 1, tempoMin: 1},
+		{nome: "dois trechos mais curtos que a aresta direta", origem: "A", destino: "C", alcancavel: true, distancia: 2, tempoMin: 3},
+		{nome: "mão dupla no sentido inverso", origem: "C", destino: "A", alcancavel: true, distancia: 2, tempoMin: 3},
+		{nome: "mão única no sentido permitido", origem: "A", destino: "D", alcancavel: true, distancia: 3, tempoMin: 4},
+		{nome: "mão única no sentido proibido", origem: "D", destino: "A"},
+		{nome: "nó sem arestas", origem: "A", destino: "E"},
+		{nome: "destino fora do grafo", origem: "A", destino: "fora"},
+		{nome: "origem fora do grafo", origem: "fora", destino: "A"},
+	}
+
+	for _, caso := range casos {
+		t.Run(caso.nome, func(t *testing.T) {
+			origem, destino := posicao[caso.origem], posicao[caso.destino]
+			trajeto, ok := grafo.caminhosDe(origem[0], origem[1]).ate(destino[0], destino[1])
+			if ok != caso.alcancavel {
+				t.Fatalf("alcançável %v, esperado %v", ok, caso.alcancavel)
+			}
+			if math.Abs(trajeto.DistanciaKm-caso.distancia) > 1e-9 {
+				t.Errorf("distância %.3f km, esperada %.3f km", trajeto.DistanciaKm, caso.distancia)
+			}
+			if math.Abs(trajeto.TempoMin-caso.tempoMin) > 1e-9 {
+				t.Errorf("tempo %.3f min, esperado %.3f min", trajeto.TempoMin, caso.tempoMin)
+			}
+		})
+	}
+}
+
+func TestMontarGrafoInvalido(t *testing.T) {
+	casos := []struct {
+		nome    string
+		arquivo ArquivoGrafo
+	}{
+		{nome: "sem nós", arquivo: ArquivoGrafo{}},
+		{nome: "nó repetido", arquivo: ArquivoGrafo{Nos: []NoViario{{ID: "A"}, {ID: "A"}}}},
+		{nome: "aresta com nó inexistente", arquivo: ArquivoGrafo{
+			Nos:     []NoViario{{ID: "A"}},
+			Arestas: []ArestaViaria{{De: "A", Para: "B"}},
+		}},
+	}
+
+	for _, caso := range casos {
+		t.Run(caso.nome, func(t *testing.T) {
+			if _, err := montarGrafo(caso.arquivo); err == nil {
+				t.Error("esperado erro")
+			}
+		})
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	statusAutorizado = "AUTORIZADO"
+	statusCapturado  = "CAPTURADO"
+	statusRecusado   = "RECUSADO"
+	statusEstornado  = "ESTORNADO"
+
+	modoMockAprovar = "APROVAR"
+	modoMockRecusar = "RECUSAR"
+	modoMockTimeout = "TIMEOUT"
+
+	timeoutProvedor = 3 * time.Second
+)
+
+var (
+	errTimeoutProvedor  = errors.New("tempo esgotado ao contatar o provedor de pagamento")
+	errChaveReutilizada = errors.New("Chave de idempotência já usada em outro pagamento")
+)
+
+// Pedido enviado ao provedor. Pedidos com a mesma chave de idempotência
+// representam a mesma tentativa e nunca geram duas cobranças.
+type PedidoPagamento struct {
+	ChaveIdempotencia string
+	CarroID           string
+	SessaoID          string
+	Valor             Dinheiro
+}
+
+type ResultadoPagamento struct {
+	TransacaoID string   `json:"transacaoID"`
+	Status      string   `json:"status"`
+	Valor       Dinheiro `json:"valor"`
+	Mensagem    string   `json:"mensagem"`
+}
+
+// Meio de pagamento usado por PAGAR_PENDENCIA
+type PaymentProvider interface {
+	Authorize(pedido PedidoPagamento) (ResultadoPagamento, error)
+	Capture(transacaoID string) (ResultadoPagamento, error)
+	Refund(transacaoID string, valor Dinheiro) (ResultadoPagamento, error)
+	Status(transacaoID string) (ResultadoPagamento, error)
+}
+
+var provedorPagamento PaymentProvider = novoProvedorMock(os.Getenv("PAGAMENTO_MOCK_MODO"))
+
+// Provedor local para testes, que aprova, recusa ou simula timeout conforme o modo
+type provedorMock struct {
+	mu         sync.Mutex
+	modo       string
+	sequencia  int
+	transacoes map[string]*ResultadoPagamento
+	porChave   map[string]string          // chave de idempotência -> transacaoID
+	pedidos    map[string]PedidoPagamento // chave de idempotência -> pedido original
+}
+
+func novoProvedorMock(modo string) *provedorMock {
+	p := &provedorMock{
+		transacoes: make(map[string]*ResultadoPagamento),
+		porChave:   make(map[string]string),
+		pedidos:    make(map[string]PedidoPagamento),
+	}
+	p.configurar(modo)
+	return p
+}
+
+func (p *provedorMock) configurar(modo string) {
+	modo = strings.ToUpper(modo)
+	if modo != modoMockRecusar && modo != modoMockTimeout {
+		modo = modoMockAprovar
+	}
+	p.mu.Lock()
+	p.modo = modo
+	p.mu.Unlock()
+	fmt.Println("Provedor de pagamento simulado em modo", modo)
+}
+
+// No modo TIMEOUT a autorização é registrada mas a resposta "se perde",
+// como aconteceria em uma falha de rede. Recusas não ficam presas à chave,
+// para que o carro possa tentar de novo. Uma chave só devolve a transação
+// anterior se o pedido for o mesmo (carro, sessão e valor).
+func (p *provedorMock) Authorize(pedido PedidoPagamento) (ResultadoPagamento, error) {
+	p.mu.Lock()
+	if id, existe := p.porChave[pedido.ChaveIdempotencia]; existe {
+		if p.pedidos[pedido.ChaveIdempotencia] != pedido {
+			p.mu.Unlock()
+			return ResultadoPagamento{}, errChaveReutilizada
+		}
+		resultado := *p.transacoes[id]
+		p.mu.Unlock()
+		return resultado, nil
+	}
+
+	if p.modo == modoMockRecusar {
+		p.mu.Unlock()
+		return ResultadoPagamento{Status: statusRecusado, Valor: pedido.Valor, Mensagem: "saldo insuficiente no emissor"}, nil
+	}
+
+	p.sequencia++
+	resultado := &ResultadoPagamento{
+		TransacaoID: fmt.Sprintf("mock-%06d", p.sequencia),
+		Status:      statusAutorizado,
+		Valor:       pedido.Valor,
+		Mensagem:    "Pagamento autorizado",
+	}
+	p.transacoes[resultado.TransacaoID] = resultado
+	p.porChave[pedido.ChaveIdempotencia] = resultado.TransacaoID
+	p.pedidos[pedido.ChaveIdempotencia] = pedido
+	modo := p.modo
+	p.mu.Unlock()
+
+	if modo == modoMockTimeout {
+		time.Sleep(timeoutProvedor)
+		return ResultadoPagamento{}, errTimeoutProvedor
+	}
+	return *resultado, nil
+}
+
+func (p *provedorMock) Capture(transacaoID string) (ResultadoPagamento, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	transacao, existe := p.transacoes[transacaoID]
+	if !existe {
+		return ResultadoPagamento{}, fmt.Errorf("transação %s não encontrada", transacaoID)
+	}
+	if transacao.Status == statusAutorizado {
+		transacao.Status = statusCapturado
+		transacao.Mensagem = "Pagamento capturado"
+	}
+	if transacao.Status != statusCapturado {
+		return *transacao, fmt.Errorf("transação %s não pode ser capturada (%s)", transacaoID, transacao.Status)
+	}
+	return *transacao, nil
+}
+
+func (p *provedorMock) Refund(transacaoID string, valor Dinheiro) (ResultadoPagamento, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	transacao, existe := p.transacoes[transacaoID]
+	if !existe {
+		return ResultadoPagamento{}, fmt.Errorf("transação %s não encontrada", transacaoID)
+	}
+	if transacao.Status != statusCapturado && transacao.Status != statusAutorizado {
+		return *transacao, fmt.Errorf("transação %s não pode ser estornada (%s)", transacaoID, transacao.Status)
+	}
+	if valor > transacao.Valor {
+		return *transacao, fmt.Errorf("estorno de %s maior que o valor da transação %s", valor, transacaoID)
+	}
+	transacao.Valor -= valor
+	if transacao.Valor <= 0 {
+		transacao.Status = statusEstornado
+	}
+	transacao.Mensagem = fmt.Sprintf("Estorno de %s realizado", valor)
+	return *transacao, nil
+}
+
+func (p *provedorMock) Status(transacaoID string) (ResultadoPagamento, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	transacao, existe := p.transacoes[transacaoID]
+	if !existe {
+		return ResultadoPagamento{}, fmt.Errorf("transação %s não encontrada", transacaoID)
+	}
+	return *transacao, nil
+}
+
+// Cobra o pedido no provedor: autoriza e captura. Retorna o resultado capturado.
+func cobrarNoProvedor(pedido PedidoPagamento) (ResultadoPagamento, error) {
+	autorizacao, err := provedorPagamento.Authorize(pedido)
+	if err != nil {
+		return ResultadoPagamento{}, err
+	}
+	if autorizacao.Status == statusRecusado {
+		return autorizacao, fmt.Errorf("Pagamento recusado: %s", autorizacao.Mensagem)
+	}
+	return provedorPagamento.Capture(autorizacao.TransacaoID)
+}
+
+// Permite trocar o comportamento do provedor simulado sem reiniciar o
+// servidor. Restrita ao operador.
+func handleConfigurarPagamentoMock(conn net.Conn, content map[string]interface{}) {
+	if !operadorAutorizado(conn, content) {
+		return
+	}
+	mock, ok := provedorPagamento.(*provedorMock)
+	if !ok {
+		sendErrorResponse(conn, "Provedor de pagamento atual não é simulado")
+		return
+	}
+	modo, _ := content["modo"].(string)
+	mock.configurar(modo)
+
+	mock.mu.Lock()
+	modoAtual := mock.modo
+	mock.mu.Unlock()
+
+	sendResponse(conn, Message{
+		Action:  "PAGAMENTO_MOCK_CONFIGURADO",
+		Content: map[string]interface{}{"modo": modoAtual},
+	})
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// Duas autorizações seguidas no provedor simulado: a mesma chave com o mesmo
+// pedido devolve a transação original, e com outro pedido é recusada
+func TestProvedorMockIdempotencia(t *testing.T) {
+	pedido := PedidoPagamento{ChaveIdempotencia: "chave-1", CarroID: "A", SessaoID: "sessao-1", Valor: 1000}
+	com := func(alterar func(p *PedidoPagamento)) PedidoPagamento {
+		p := pedido
+		alterar(&p)
+		return p
+	}
+
+	casos := []struct {
+		nome           string
+		modoPrimeiro   string
+		segundo        PedidoPagamento
+		erro           error
+		mesmaTransacao bool
+	}{
+		{nome: "repetição do mesmo pedido", segundo: pedido, mesmaTransacao: true},
+		{nome: "chave reutilizada com outro valor", segundo: com(func(p *PedidoPagamento) { p.Valor = 2000 }), erro: errChaveReutilizada},
+		{nome: "chave reutilizada em outra sessão", segundo: com(func(p *PedidoPagamento) { p.SessaoID = "sessao-2" }), erro: errChaveReutilizada},
+		{nome: "chave reutilizada por outro carro", segundo: com(func(p *PedidoPagamento) { p.CarroID = "B" }), erro: errChaveReutilizada},
+		{nome: "outra chave gera outra transação", segundo: com(func(p *PedidoPagamento) { p.ChaveIdempotencia = "chave-2" })},
+		{nome: "recusa não prende a chave", modoPrimeiro: modoMockRecusar, segundo: pedido},
+	}
+
+	for _, caso := range casos {
+		t.Run(caso.nome, func(t *testing.T) {
+			provedor := novoProvedorMock(caso.modoPrimeiro)
+			primeiro, err := provedor.Authorize(pedido)
+			if err != nil {
+				t.Fatalf("erro na primeira autorização: %v", err)
+			}
+
+			provedor.configurar(modoMockAprovar)
+			segundo, err := provedor.Authorize(caso.segundo)
+			if !errors.Is(err, caso.erro) {
+				t.Fatalf("erro %v, esperado %v", err, caso.erro)
+			}
+			if err != nil {
+				return
+			}
+			if segundo.Status != statusAutorizado {
+				t.Errorf("status %s, esperado %s", segundo.Status, statusAutorizado)
+			}
+			if mesma := segundo.TransacaoID == primeiro.TransacaoID; mesma != caso.mesmaTransacao {
+				t.Errorf("transações %q e %q, esperado mesma transação: %v", primeiro.TransacaoID, segundo.TransacaoID, caso.mesmaTransacao)
+			}
+		})
+	}
+}
+
+// A repetição depois da captura devolve a transação já capturada, sem cobrar de novo
+func TestProvedorMockRepeticaoAposCaptura(t *testing.T) {
+	provedor := novoProvedorMock(modoMockAprovar)
+	pedido := PedidoPagamento{ChaveIdempotencia: "chave-1", CarroID: "A", SessaoID: "sessao-1", Valor: 1000}
+
+	autorizado, err := provedor.Authorize(pedido)
+	if err != nil {
+		t.Fatalf("erro na autorização: %v", err)
+	}
+	if _, err := provedor.Capture(autorizado.TransacaoID); err != nil {
+		t.Fatalf("erro na captura: %v", err)
+	}
+
+	repetido, err := provedor.Authorize(pedido)
+	if err != nil {
+		t.Fatalf("erro na repetição: %v", err)
+	}
+	if repetido.TransacaoID != autorizado.TransacaoID || repetido.Status != statusCapturado {
+		t.Errorf("repetição devolveu %+v, esperada a transação %s capturada", repetido, autorizado.TransacaoID)
+	}
+	if provedor.sequencia != 1 {
+		t.Errorf("%d transações criadas, esperada 1", provedor.sequencia)
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Dados do recebedor usados no BR Code
+var (
+	pixChave  = lerEnvPadrao("PIX_CHAVE", "pagamentos@recarga.com.br")
+	pixNome   = lerEnvPadrao("PIX_NOME", "REDE DE RECARGA")
+	pixCidade = lerEnvPadrao("PIX_CIDADE", "SALVADOR")
+
+	// Endereço do webhook em que o banco simulado confirma os pagamentos
+	pixWebhookEndereco = lerEnvPadrao("PIX_WEBHOOK_ENDERECO", "127.0.0.1:8081")
+)
+
+// Cobrança PIX gerada para uma sessão, guardada no livro-razão para que um
+// código pago depois de reiniciar o servidor ainda seja reconhecido
+type CobrancaPix struct {
+	TxID       string   `json:"txid"`
+	CarroID    string   `json:"carroID"`
+	SessaoID   string   `json:"historicoID"`
+	Valor      Dinheiro `json:"valor"`
+	CopiaECola string   `json:"copia_e_cola"`
+}
+
+// Gera (ou reapresenta) o PIX copia e cola da sessão. Se a sessão já foi
+// paga pelo banco, responde com a confirmação do pagamento.
+func handleGerarPix(conn net.Conn, content map[string]interface{}) {
+	carroID, okCarro := content["carroID"].(string)
+	historicoID, okHistorico := content["historicoID"].(string)
+	if !okCarro || !okHistorico {
+		sendErrorResponse(conn, "Dados do pagamento incompletos")
+		return
+	}
+	if moeda != "BRL" {
+		sendErrorResponse(conn, "PIX disponível apenas para cobranças em BRL")
+		return
+	}
+
+	pagamentos := razao.pagamentosPix(carroID, historicoID)
+	saldo, err := razao.saldoEmAberto(carroID, historicoID)
+	if err != nil {
+		// Sessão quitada com PIX: confirma o último pagamento
+		if len(pagamentos) > 0 {
+			sendResponse(conn, confirmacaoPagamento(historicoID, pagamentos[len(pagamentos)-1].TransacaoID))
+			return
+		}
+		sendErrorResponse(conn, err.Error())
+		return
+	}
+
+	// Cada PIX da sessão tem o seu txid, e o próximo cobra só o que falta
+	txid := txidDaSessao(historicoID, len(pagamentos)+1)
+
+	cobranca := razao.cobrancaPix(txid, carroID, historicoID, saldo)
+
+	sendResponse(conn, Message{
+		Action: "PIX_GERADO",
+		Content: map[string]interface{}{
+			"historicoID":  historicoID,
+			"txid":         cobranca.TxID,
+			"valor":        cobranca.Valor,
+			"moeda":        moeda,
+			"copia_e_cola": cobranca.CopiaECola,
+		},
+	})
+}
+
+// Monta o payload EMV do PIX estático com valor, no formato do Manual do BR Code
+func gerarBRCode(chave, nome, cidade, txid string, valor Dinheiro) string {
+	contaRecebedor := campoEMV("00", "br.gov.bcb.pix") + campoEMV("01", chave)
+	dadosAdicionais := campoEMV("05", txid)
+
+	payload := campoEMV("00", "01") +
+		campoEMV("26", contaRecebedor) +
+		campoEMV("52", "0000") +
+		campoEMV("53", "986") + // Real brasileiro
+		campoEMV("54", valor.String()) +
+		campoEMV("58", "BR") +
+		campoEMV("59", limitarASCII(nome, 25)) +
+		campoEMV("60", limitarASCII(cidade, 15)) +
+		campoEMV("62", dadosAdicionais) +
+		"6304"
+
+	return payload + fmt.Sprintf("%04X", crc16CCITT(payload))
+}
+
+// Campo EMV: ID de dois dígitos, tamanho de dois dígitos e valor
+func campoEMV(id, valor string) string {
+	return fmt.Sprintf("%s%02d%s", id, len(valor), valor)
+}
+
+// CRC16-CCITT (polinômio 0x1021, valor inicial 0xFFFF), exigido no campo 63
+func crc16CCITT(dados string) uint16 {
+	crc := uint16(0xFFFF)
+	for i := 0; i < len(dados); i++ {
+		crc ^= uint16(dados[i]) << 8
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// O txid aceita apenas letras e números, com até 25 caracteres. O sufixo
+// numera os PIX da mesma sessão.
+func txidDaSessao(sessaoID string, sequencia int) string {
+	var txid strings.Builder
+	for _, c := range sessaoID {
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') {
+			txid.WriteRune(c)
+		}
+	}
+	sufixo := fmt.Sprintf("P%d", sequencia)
+	return limitarASCII(txid.String(), 25-len(sufixo)) + sufixo
+}
+
+// Créditos de PIX já lançados na sessão, na ordem em que foram recebidos
+func (r *LivroRazao) pagamentosPix(carroID, sessaoID string) []Lancamento {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var pagamentos []Lancamento
+	for _, l := range r.Lancamentos {
+		if l.Tipo == lancamentoCredito && l.CarroID == carroID && l.SessaoID == sessaoID && strings.HasPrefix(l.ChaveIdempotencia, chavePix("")) {
+			pagamentos = append(pagamentos, l)
+		}
+	}
+	return pagamentos
+}
+
+func limitarASCII(texto string, tamanho int) string {
+	var resultado strings.Builder
+	for _, c := range texto {
+		if c >= 0x20 && c < 0x7F && resultado.Len() < tamanho {
+			resultado.WriteRune(c)
+		}
+	}
+	return resultado.String()
+}
+
+func chavePix(txid string) string {
+	return "pix-" + txid
+}
+
+// Notificação enviada pelo banco, no formato do webhook do PIX
+type notificacaoPix struct {
+	Pix []struct {
+		EndToEndID string `json:"endToEndId"`
+		TxID       string `json:"txid"`
+		Valor      string `json:"valor"`
+	} `json:"pix"`
+}
+
+// Webhook local em que o banco simulado confirma os PIX recebidos
+func iniciarWebhookPix() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/pix", handleWebhookPix)
+
+	fmt.Printf("Webhook PIX ouvindo em %s...\n", pixWebhookEndereco)
+	if err := http.ListenAndServe(pixWebhookEndereco, mux); err != nil {
+		fmt.Println("Erro ao iniciar o webhook PIX:", err)
+	}
+}
+
+func handleWebhookPix(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Método não permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var notificacao notificacaoPix
+	if err := json.NewDecoder(r.Body).Decode(&notificacao); err != nil {
+		http.Error(w, "JSON inválido", http.StatusBadRequest)
+		return
+	}
+
+	for _, pix := range notificacao.Pix {
+		if err := confirmarPix(pix.TxID, pix.EndToEndID, pix.Valor); err != nil {
+			fmt.Println("PIX não confirmado:", err)
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Lança o crédito da cobrança no livro-razão. O dinheiro já saiu da conta do
+// cliente, então o PIX é sempre creditado, mesmo que o saldo da sessão tenha
+// mudado desde a geração do código; o que passar do devido volta para a
+// carteira. Notificações repetidas são ignoradas.
+func confirmarPix(txid, endToEndID, valorTexto string) error {
+	cobranca, existe := razao.buscarCobrancaPix(txid)
+	if !existe {
+		return fmt.Errorf("cobrança PIX %s não encontrada", txid)
+	}
+	valor, err := parseDinheiro(valorTexto)
+	if err != nil {
+		return err
+	}
+	if valor <= 0 {
+		return fmt.Errorf("valor %s inválido", valor)
+	}
+
+	novo, saldo, err := razao.registrarPix(cobranca, valor, endToEndID)
+	if err != nil || !novo {
+		return err
+	}
+	if valor != cobranca.Valor {
+		fmt.Printf("PIX %s pago com %s, cobrança era de %s\n", txid, valor, cobranca.Valor)
+	}
+	fmt.Printf("PIX %s confirmado para a sessão %s\n", txid, cobranca.SessaoID)
+
+	if saldo < 0 {
+		// O reembolso pode ser repetido com REEMBOLSO se falhar aqui
+		if _, err := reembolsarSessao(cobranca.SessaoID); err != nil {
+			fmt.Printf("Excedente do PIX %s não devolvido: %v\n", txid, err)
+		}
+	}
+	return nil
+}
+
+// Cobrança do txid com o valor informado, criada ou atualizada se o saldo
+// mudou desde a última geração
+func (r *LivroRazao) cobrancaPix(txid, carroID, sessaoID string, valor Dinheiro) CobrancaPix {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cobranca, existe := r.CobrancasPix[txid]
+	if !existe || cobranca.Valor != valor {
+		cobranca = &CobrancaPix{
+			TxID:       txid,
+			CarroID:    carroID,
+			SessaoID:   sessaoID,
+			Valor:      valor,
+			CopiaECola: gerarBRCode(pixChave, pixNome, pixCidade, txid, valor),
+		}
+		r.CobrancasPix[txid] = cobranca
+		r.salvar()
+	}
+	return *cobranca
+}
+
+func (r *LivroRazao) buscarCobrancaPix(txid string) (CobrancaPix, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cobranca, existe := r.CobrancasPix[txid]
+	if !existe {
+		return CobrancaPix{}, false
+	}
+	return *cobranca, true
+}
+
+// Lança o PIX como crédito da sessão, sem limitar ao saldo. A chave inclui o
+// endToEndId, que identifica cada transferência: a mesma notificação não é
+// lançada duas vezes, mas um segundo pagamento do mesmo código é. Devolve se
+// o crédito é novo e o saldo da sessão depois dele.
+func (r *LivroRazao) registrarPix(cobranca CobrancaPix, valor Dinheiro, endToEndID string) (bool, Dinheiro, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sessao, existe := r.Sessoes[cobranca.SessaoID]
+	if !existe || sessao.CarroID != cobranca.CarroID {
+		return false, 0, fmt.Errorf("sessão %s da cobrança %s não encontrada", cobranca.SessaoID, cobranca.TxID)
+	}
+	chave := chavePix(cobranca.TxID + "-" + endToEndID)
+	for _, l := range r.Lancamentos {
+		if l.Tipo == lancamentoCredito && l.ChaveIdempotencia == chave {
+			return false, r.saldoSessao(sessao.ID), nil
+		}
+	}
+
+	r.Lancamentos = append(r.Lancamentos, Lancamento{
+		ID:                r.proximoID("lanc"),
+		SessaoID:          sessao.ID,
+		CarroID:           sessao.CarroID,
+		Tipo:              lancamentoCredito,
+		Valor:             valor,
+		Data:              time.Now(),
+		Descricao:         "Pagamento por PIX",
+		ChaveIdempotencia: chave,
+		TransacaoID:       endToEndID,
+	})
+	r.salvar()
+	return true, r.saldoSessao(sessao.ID), nil
+}
+
+func lerEnvPadrao(nome, padrao string) string {
+	if valor := os.Getenv(nome); valor != "" {
+		return valor
+	}
+	return padrao
+}
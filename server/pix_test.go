@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestCRC16CCITT(t *testing.T) {
+	casos := []struct {
+		nome  string
+		dados string
+		crc   uint16
+	}{
+		{nome: "valor de verificação do CRC-16/CCITT-FALSE", dados: "123456789", crc: 0x29B1},
+		{nome: "vazio", dados: "", crc: 0xFFFF},
+		// Exemplo de BR Code estático do manual do PIX do Banco Central
+		{
+			nome:  "BR Code do manual do PIX",
+			dados: "00020126580014br.gov.bcb.pix0136123e4567-e12b-12d1-a456-4266554400005204000053039865802BR5913Fulano de Tal6008BRASILIA62070503***6304",
+			crc:   0x1D3D,
+		},
+	}
+
+	for _, caso := range casos {
+		t.Run(caso.nome, func(t *testing.T) {
+			if crc := crc16CCITT(caso.dados); crc != caso.crc {
+				t.Errorf("CRC %04X, esperado %04X", crc, caso.crc)
+			}
+		})
+	}
+}
+
+func TestGerarBRCode(t *testing.T) {
+	casos := []struct {
+		nome      string
+		chave     string
+		recebedor string
+		cidade    string
+		txid      string
+		valor     Dinheiro
+		payload   string // Sem o CRC
+	}{
+		{
+			nome:      "campos do manual do PIX com valor",
+			chave:     "123e4567-e12b-12d1-a456-426655440000",
+			recebedor: "Fulano de Tal",
+			cidade:    "BRASILIA",
+			txid:      "***",
+			valor:     1000,
+			payload:   "00020126580014br.gov.bcb.pix0136123e4567-e12b-12d1-a456-426655440000520400005303986540510.005802BR5913Fulano de Tal6008BRASILIA62070503***6304",
+		},
+		{
+			nome:      "nome e cidade sem acentos e limitados",
+			chave:     "pix@recarga.com.br",
+			recebedor: "Rede de Recarga Elétrica do Brasil",
+			cidade:    "São José dos Campos",
+			txid:      "sessao000001P1",
+			valor:     12345,
+			payload:   "00020126400014br.gov.bcb.pix0118pix@recarga.com.br5204000053039865406123.455802BR5925Rede de Recarga Eltrica d6015So Jos dos Camp62180514sessao000001P16304",
+		},
+	}
+
+	for _, caso := range casos {
+		t.Run(caso.nome, func(t *testing.T) {
+			codigo := gerarBRCode(caso.chave, caso.recebedor, caso.cidade, caso.txid, caso.valor)
+			if !strings.HasPrefix(codigo, caso.payload) {
+				t.Fatalf("BR Code %s\nesperado começar com %s", codigo, caso.payload)
+			}
+			if crc := codigo[len(caso.payload):]; crc != fmt.Sprintf("%04X", crc16CCITT(caso.payload)) {
+				t.Errorf("CRC %s não confere com o payload", crc)
+			}
+		})
+	}
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Tipos de cupom
+const (
+	cupomPercentual = "PERCENTUAL"
+	cupomFixo       = "FIXO"
+)
+
+// Cupom de desconto, aplicado na reserva (vale para a próxima sessão) ou no pagamento
+type Cupom struct {
+	Tipo        string   `json:"tipo"`
+	Percentual  float64  `json:"percentual,omitempty"`
+	Valor       Dinheiro `json:"valor,omitempty"`
+	Validade    string   `json:"validade,omitempty"`     // "AAAA-MM-DD", inclusive
+	UsosMaximos int      `json:"usos_maximos,omitempty"` // Zero para ilimitado
+	UmPorCarro  bool     `json:"um_por_carro,omitempty"`
+}
+
+// Plano de assinatura com minutos e kWh inclusos por período de cobrança (mês)
+type Plano struct {
+	Nome            string  `json:"nome"`
+	MinutosInclusos float64 `json:"minutos_inclusos"`
+	KWhInclusos     float64 `json:"kwh_inclusos"`
+	// Peso do carro na divisão da potência de sites com estratégia PRIORIDADE (padrão 1)
+	Prioridade float64 `json:"prioridade,omitempty"`
+}
+
+type ConfiguracaoPromocoes struct {
+	Cupons map[string]Cupom `json:"cupons"` // código -> cupom
+	Planos map[string]Plano `json:"planos"` // ID -> plano
+}
+
+// Franquia do plano já consumida por um carro em um período
+type UsoFranquia struct {
+	Plano   string  `json:"plano"`
+	Minutos float64 `json:"minutos"`
+	KWh     float64 `json:"kwh"`
+}
+
+// Situação da franquia mostrada ao carro e nos recibos
+type SituacaoFranquia struct {
+	Plano            string  `json:"plano"`
+	Periodo          string  `json:"periodo"`
+	MinutosUsados    float64 `json:"minutos_usados"`
+	MinutosRestantes float64 `json:"minutos_restantes"`
+	KWhUsados        float64 `json:"kwh_usados"`
+	KWhRestantes     float64 `json:"kwh_restantes"`
+}
+
+// Desconto concedido a uma sessão. Origem é "CUPOM:<código>" ou "PLANO:<ID>".
+type Desconto struct {
+	Origem    string   `json:"origem"`
+	Descricao string   `json:"descricao"`
+	Valor     Dinheiro `json:"valor"`
+	Minutos   float64  `json:"minutos,omitempty"` // Franquia consumida
+	KWh       float64  `json:"kwh,omitempty"`
+}
+
+var promocoes = carregarPromocoes(os.Getenv("PROMOCOES_ARQUIVO"))
+
+func carregarPromocoes(caminho string) ConfiguracaoPromocoes {
+	if caminho == "" {
+		caminho = "promocoes.json"
+	}
+	config := ConfiguracaoPromocoes{}
+
+	dados, err := os.ReadFile(caminho)
+	if err != nil {
+		fmt.Printf("Arquivo de promoções %s não encontrado, sem cupons nem planos\n", caminho)
+		return config
+	}
+	if err := json.Unmarshal(dados, &config); err != nil {
+		fmt.Printf("Erro ao ler promoções de %s: %v\n", caminho, err)
+		return ConfiguracaoPromocoes{}
+	}
+	fmt.Printf("Promoções carregadas de %s (%d cupons, %d planos)\n", caminho, len(config.Cupons), len(config.Planos))
+	return config
+}
+
+func somaDescontos(descontos []Desconto) Dinheiro {
+	var total Dinheiro
+	for _, d := range descontos {
+		total += d.Valor
+	}
+	return total
+}
+
+func periodoCobranca(instante time.Time) string {
+	return instante.Format("2006-01")
+}
+
+// Valor que o carro deve pela sessão depois de ajustes e descontos
+func (s *SessaoRazao) totalDevido() Dinheiro {
+	total := s.Cobranca.Total - s.Ajuste
+	for _, d := range s.Descontos {
+		total -= d.Valor
+	}
+	return total
+}
+
+// Verifica se o cupom pode ser usado pelo carro. Deve ser chamada com r.mu travado.
+func (r *LivroRazao) validarCupomTravado(carroID, codigo string, agora time.Time) (Cupom, error) {
+	cupom, existe := promocoes.Cupons[codigo]
+	if !existe {
+		return Cupom{}, fmt.Errorf("Cupom %s inválido", codigo)
+	}
+	if cupom.Validade != "" {
+		validade, err := time.ParseInLocation("2006-01-02", cupom.Validade, agora.Location())
+		if err == nil && agora.After(validade.AddDate(0, 0, 1)) {
+			return Cupom{}, fmt.Errorf("Cupom %s expirado", codigo)
+		}
+	}
+
+	usos, usosDoCarro := 0, 0
+	for _, sessao := range r.Sessoes {
+		for _, d := range sessao.Descontos {
+			if d.Origem == "CUPOM:"+codigo {
+				usos++
+				if sessao.CarroID == carroID {
+					usosDoCarro++
+				}
+			}
+		}
+	}
+	if cupom.UsosMaximos > 0 && usos >= cupom.UsosMaximos {
+		return Cupom{}, fmt.Errorf("Cupom %s esgotado", codigo)
+	}
+	if cupom.UmPorCarro && usosDoCarro > 0 {
+		return Cupom{}, fmt.Errorf("Cupom %s já utilizado por este carro", codigo)
+	}
+	return cupom, nil
+}
+
+// Guarda o cupom informado na reserva para a próxima sessão do carro
+func (r *LivroRazao) reservarCupom(carroID, codigo string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, err := r.validarCupomTravado(carroID, codigo, time.Now()); err != nil {
+		return err
+	}
+	r.CuponsReservados[carroID] = codigo
+	r.salvar()
+	return nil
+}
+
+// Lança um desconto na sessão, limitado ao que ainda está em aberto. Um
+// desconto que não abate nada não é registrado, para não gastar um uso do
+// cupom. Deve ser chamada com r.mu travado.
+func (r *LivroRazao) lancarDesconto(sessao *SessaoRazao, desconto Desconto) Desconto {
+	desconto.Valor = minDinheiro(desconto.Valor, r.saldoSessao(sessao.ID))
+	if desconto.Valor <= 0 {
+		desconto.Valor = 0
+		return desconto
+	}
+	sessao.Descontos = append(sessao.Descontos, desconto)
+	r.Lancamentos = append(r.Lancamentos, Lancamento{
+		ID:        r.proximoID("lanc"),
+		SessaoID:  sessao.ID,
+		CarroID:   sessao.CarroID,
+		Tipo:      lancamentoDesconto,
+		Valor:     desconto.Valor,
+		Data:      time.Now(),
+		Descricao: desconto.Descricao,
+	})
+	return desconto
+}
+
+// Calcula o desconto do cupom sobre o que a sessão ainda deve. Deve ser chamada com r.mu travado.
+func (r *LivroRazao) descontoCupomTravado(sessao *SessaoRazao, codigo string) (Desconto, error) {
+	for _, d := range sessao.Descontos {
+		if d.Origem == "CUPOM:"+codigo {
+			return d, nil // Cupom já aplicado nesta sessão
+		}
+	}
+	cupom, err := r.validarCupomTravado(sessao.CarroID, codigo, time.Now())
+	if err != nil {
+		return Desconto{}, err
+	}
+
+	desconto := Desconto{Origem: "CUPOM:" + codigo}
+	switch cupom.Tipo {
+	case cupomPercentual:
+		regra := tarifaDoPonto(sessao.PontoID).Arredondamento
+		desconto.Valor = dinheiroDeFloat(float64(sessao.totalDevido())*cupom.Percentual/100/math.Pow10(casasDecimais()), regra)
+		desconto.Descricao = fmt.Sprintf("Cupom %s (%.0f%%)", codigo, cupom.Percentual)
+	case cupomFixo:
+		desconto.Valor = cupom.Valor
+		desconto.Descricao = fmt.Sprintf("Cupom %s (%s %s)", codigo, moeda, cupom.Valor)
+	default:
+		return Desconto{}, fmt.Errorf("Cupom %s com tipo desconhecido", codigo)
+	}
+	return r.lancarDesconto(sessao, desconto), nil
+}
+
+// Aplica um cupom informado no pagamento a uma sessão em aberto do carro
+func (r *LivroRazao) aplicarCupom(carroID, sessaoID, codigo string) (Desconto, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, err := r.saldoEmAbertoTravado(carroID, sessaoID); err != nil {
+		return Desconto{}, err
+	}
+	desconto, err := r.descontoCupomTravado(r.Sessoes[sessaoID], codigo)
+	if err != nil {
+		return Desconto{}, err
+	}
+	r.salvar()
+	return desconto, nil
+}
+
+// Aplica à sessão recém-finalizada a franquia do plano do carro e o cupom
+// guardado na reserva, nessa ordem
+func (r *LivroRazao) aplicarBeneficios(sessaoID string) []Desconto {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sessao, existe := r.Sessoes[sessaoID]
+	if !existe {
+		return nil
+	}
+
+	if desconto, ok := r.descontoFranquiaTravado(sessao); ok {
+		r.lancarDesconto(sessao, desconto)
+	}
+	if codigo, ok := r.CuponsReservados[sessao.CarroID]; ok {
+		delete(r.CuponsReservados, sessao.CarroID)
+		if _, err := r.descontoCupomTravado(sessao, codigo); err != nil {
+			fmt.Printf("Cupom %s da reserva não aplicado à sessão %s: %v\n", codigo, sessaoID, err)
+		}
+	}
+	r.salvar()
+	return sessao.Descontos
+}
+
+// Consome a franquia do período com os minutos e kWh da sessão. Só é
+// consumido o que a tarifa cobra: minutos em tarifas sem preço por minuto
+// continuam disponíveis. Deve ser chamada com r.mu travado.
+func (r *LivroRazao) descontoFranquiaTravado(sessao *SessaoRazao) (Desconto, bool) {
+	planoID, assinante := r.Assinaturas[sessao.CarroID]
+	plano, existe := promocoes.Planos[planoID]
+	if !assinante || !existe {
+		return Desconto{}, false
+	}
+
+	uso := r.usoFranquia(sessao.CarroID, periodoCobranca(sessao.Fim), planoID)
+	minutos := sessao.Fim.Sub(sessao.Inicio).Minutes()
+	desconto := Desconto{Origem: "PLANO:" + planoID}
+
+	var valor float64
+	if minutos > 0 && sessao.Cobranca.Tempo > 0 {
+		desconto.Minutos = math.Max(0, math.Min(minutos, plano.MinutosInclusos-uso.Minutos))
+		valor += float64(sessao.Cobranca.Tempo) * desconto.Minutos / minutos
+	}
+	if sessao.EnergiaKWh > 0 && sessao.Cobranca.Energia > 0 {
+		desconto.KWh = math.Max(0, math.Min(sessao.EnergiaKWh, plano.KWhInclusos-uso.KWh))
+		valor += float64(sessao.Cobranca.Energia) * desconto.KWh / sessao.EnergiaKWh
+	}
+	if desconto.Minutos == 0 && desconto.KWh == 0 {
+		return Desconto{}, false
+	}
+
+	uso.Minutos += desconto.Minutos
+	uso.KWh += desconto.KWh
+	regra := tarifaDoPonto(sessao.PontoID).Arredondamento
+	desconto.Valor = dinheiroDeFloat(valor/math.Pow10(casasDecimais()), regra)
+	desconto.Descricao = fmt.Sprintf("Plano %s: %.1f min e %.3f kWh inclusos", plano.Nome, desconto.Minutos, desconto.KWh)
+	return desconto, true
+}
+
+// Deve ser chamada com r.mu travado
+func (r *LivroRazao) usoFranquia(carroID, periodo, planoID string) *UsoFranquia {
+	usos, existe := r.Franquias[carroID]
+	if !existe {
+		usos = make(map[string]*UsoFranquia)
+		r.Franquias[carroID] = usos
+	}
+	uso, existe := usos[periodo]
+	if !existe {
+		uso = &UsoFranquia{Plano: planoID}
+		usos[periodo] = uso
+	}
+	return uso
+}
+
+// Franquia do carro no período, se ele tiver um plano. Deve ser chamada com r.mu travado.
+func (r *LivroRazao) situacaoFranquiaTravado(carroID, periodo string) (SituacaoFranquia, bool) {
+	planoID := r.Assinaturas[carroID]
+	var uso UsoFranquia
+	if registrado, ok := r.Franquias[carroID][periodo]; ok {
+		uso = *registrado
+		planoID = registrado.Plano
+	}
+	plano, existe := promocoes.Planos[planoID]
+	if !existe {
+		return SituacaoFranquia{}, false
+	}
+	return SituacaoFranquia{
+		Plano:            plano.Nome,
+		Periodo:          periodo,
+		MinutosUsados:    uso.Minutos,
+		MinutosRestantes: math.Max(0, plano.MinutosInclusos-uso.Minutos),
+		KWhUsados:        uso.KWh,
+		KWhRestantes:     math.Max(0, plano.KWhInclusos-uso.KWh),
+	}, true
+}
+
+// Peso do carro na divisão da potência de um site, conforme o plano assinado
+func (r *LivroRazao) prioridadeDoCarro(carroID string) float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if plano, existe := promocoes.Planos[r.Assinaturas[carroID]]; existe && plano.Prioridade > 0 {
+		return plano.Prioridade
+	}
+	return 1
+}
+
+// Assina (ou, com plano vazio, cancela) o plano do carro a partir do período atual
+func (r *LivroRazao) assinarPlano(carroID, planoID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if planoID == "" {
+		delete(r.Assinaturas, carroID)
+		r.salvar()
+		return nil
+	}
+	if _, existe := promocoes.Planos[planoID]; !existe {
+		return fmt.Errorf("Plano %s não encontrado", planoID)
+	}
+	r.Assinaturas[carroID] = planoID
+	if uso, ok := r.Franquias[carroID][periodoCobranca(time.Now())]; ok {
+		uso.Plano = planoID
+	}
+	r.salvar()
+	return nil
+}
+
+// Ação do operador: define o plano de assinatura de um carro
+func handleAssinarPlano(conn net.Conn, content map[string]interface{}) {
+	if !operadorAutorizado(conn, content) {
+		return
+	}
+	carroID, ok := content["carroID"].(string)
+	if !ok {
+		sendErrorResponse(conn, "ID do carro inválido")
+		return
+	}
+	planoID, _ := content["plano"].(string)
+	if err := razao.assinarPlano(carroID, strings.ToUpper(planoID)); err != nil {
+		sendErrorResponse(conn, err.Error())
+		return
+	}
+	fmt.Printf("Carro %s agora no plano %q\n", carroID, planoID)
+	handleConsultarPlano(conn, content)
+}
+
+// Mostra o plano do carro e a franquia do período atual
+func handleConsultarPlano(conn net.Conn, content map[string]interface{}) {
+	carroID, ok := content["carroID"].(string)
+	if !ok {
+		sendErrorResponse(conn, "ID do carro inválido")
+		return
+	}
+
+	razao.mu.Lock()
+	planoID := razao.Assinaturas[carroID]
+	franquia, temFranquia := razao.situacaoFranquiaTravado(carroID, periodoCobranca(time.Now()))
+	razao.mu.Unlock()
+
+	resposta := map[string]interface{}{"carroID": carroID, "plano": planoID}
+	if temFranquia {
+		resposta["franquia"] = franquia
+	}
+	sendResponse(conn, Message{Action: "PLANO", Content: resposta})
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	lancamentoDebito    = "DEBITO"
+	lancamentoCredito   = "CREDITO"
+	lancamentoAjuste    = "AJUSTE"    // Redução da cobrança aprovada em disputa
+	lancamentoReembolso = "REEMBOLSO" // Devolução de um crédito pago a mais
+	lancamentoDesconto  = "DESCONTO"  // Cupom ou franquia de plano
+)
+
+// Sessão de carregamento registrada pelo servidor
+type SessaoRazao struct {
+	ID         string          `json:"id"`
+	CarroID    string          `json:"carroID"`
+	PontoID    string          `json:"pontoID"`
+	Inicio     time.Time       `json:"inicio"`
+	Fim        time.Time       `json:"fim"`
+	EnergiaKWh float64         `json:"energia_kwh"`
+	Cobranca   DetalheCobranca `json:"cobranca"`
+	Finalizada bool            `json:"finalizada"`
+	Recibo     string          `json:"recibo,omitempty"` // Número do recibo, emitido ao finalizar
+	Ajuste     Dinheiro        `json:"ajuste,omitempty"` // Valor abatido da cobrança por disputa
+	Descontos  []Desconto      `json:"descontos,omitempty"`
+}
+
+// Débitos vêm do fim de uma sessão e créditos dos pagamentos. Ajustes
+// abatem a dívida e reembolsos devolvem o que foi pago a mais.
+type Lancamento struct {
+	ID        string    `json:"id"`
+	SessaoID  string    `json:"sessaoID"`
+	CarroID   string    `json:"carroID"`
+	Tipo      string    `json:"tipo"`
+	Valor     Dinheiro  `json:"valor"`
+	Data      time.Time `json:"data"`
+	Descricao string    `json:"descricao"`
+
+	// Preenchidos apenas em créditos de pagamento
+	ChaveIdempotencia string `json:"chave_idempotencia,omitempty"`
+	TransacaoID       string `json:"transacaoID,omitempty"`
+
+	// Em reembolsos, o ID do crédito devolvido
+	Referencia string `json:"referencia,omitempty"`
+}
+
+// Livro-razão do servidor, gravado em disco a cada alteração
+type LivroRazao struct {
+	mu          sync.Mutex
+	caminho     string
+	Sessoes     map[string]*SessaoRazao `json:"sessoes"`
+	Lancamentos []Lancamento            `json:"lancamentos"`
+	Carteiras   map[string]*Carteira    `json:"carteiras"`
+	Disputas    map[string]*Disputa     `json:"disputas"`
+
+	Assinaturas      map[string]string                  `json:"assinaturas"`       // carroID -> plano
+	Franquias        map[string]map[string]*UsoFranquia `json:"franquias"`         // carroID -> período -> uso
+	CuponsReservados map[string]string                  `json:"cupons_reservados"` // carroID -> cupom da próxima sessão
+	Sequencia        int                                `json:"sequencia"`
+	SeqRecibos       int                                `json:"sequencia_recibos"` // Numeração própria, sem lacunas
+	CheckIns         []CheckIn                          `json:"check_ins"`
+	CobrancasPix     map[string]*CobrancaPix            `json:"cobrancas_pix"` // txid -> cobrança
+}
+
+var razao = carregarRazao(os.Getenv("RAZAO_ARQUIVO"))
+
+func novoRazao(caminho string) *LivroRazao {
+	return &LivroRazao{
+		caminho:   caminho,
+		Sessoes:   make(map[string]*SessaoRazao),
+		Carteiras: make(map[string]*Carteira),
+		Disputas:  make(map[string]*Disputa),
+
+		Assinaturas:      make(map[string]string),
+		Franquias:        make(map[string]map[string]*UsoFranquia),
+		CuponsReservados: make(map[string]string),
+		CobrancasPix:     make(map[string]*CobrancaPix),
+	}
+}
+
+func carregarRazao(caminho string) *LivroRazao {
+	if caminho == "" {
+		caminho = "razao.json"
+	}
+	r := novoRazao(caminho)
+
+	dados, err := os.ReadFile(caminho)
+	if err != nil {
+		fmt.Printf("Livro-razão %s não encontrado, iniciando vazio\n", caminho)
+		return r
+	}
+	if err := json.Unmarshal(dados, r); err != nil {
+		fmt.Printf("Erro ao ler livro-razão %s: %v\n", caminho, err)
+		return novoRazao(caminho)
+	}
+	if r.Sessoes == nil {
+		r.Sessoes = make(map[string]*SessaoRazao)
+	}
+	if r.Carteiras == nil {
+		r.Carteiras = make(map[string]*Carteira)
+	}
+	if r.Disputas == nil {
+		r.Disputas = make(map[string]*Disputa)
+	}
+	if r.Assinaturas == nil {
+		r.Assinaturas = make(map[string]string)
+	}
+	if r.Franquias == nil {
+		r.Franquias = make(map[string]map[string]*UsoFranquia)
+	}
+	if r.CuponsReservados == nil {
+		r.CuponsReservados = make(map[string]string)
+	}
+	if r.CobrancasPix == nil {
+		r.CobrancasPix = make(map[string]*CobrancaPix)
+	}
+	fmt.Printf("Livro-razão carregado de %s (%d sessões)\n", caminho, len(r.Sessoes))
+	return r
+}
+
+// Grava em um arquivo temporário e renomeia, para não deixar o razão pela metade.
+// Deve ser chamada com r.mu travado.
+func (r *LivroRazao) salvar() {
+	dados, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		fmt.Println("Erro ao codificar livro-razão:", err)
+		return
+	}
+	temporario := r.caminho + ".tmp"
+	if err := os.WriteFile(temporario, dados, 0644); err != nil {
+		fmt.Println("Erro ao gravar livro-razão:", err)
+		return
+	}
+	if err := os.Rename(temporario, r.caminho); err != nil {
+		fmt.Println("Erro ao gravar livro-razão:", err)
+	}
+}
+
+func (r *LivroRazao) proximoID(prefixo string) string {
+	r.Sequencia++
+	return fmt.Sprintf("%s-%06d", prefixo, r.Sequencia)
+}
+
+// Registra o início de uma sessão e devolve o ID que identifica sua cobrança
+func (r *LivroRazao) abrirSessao(carroID, pontoID string, inicio time.Time) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sessao := &SessaoRazao{
+		ID:      r.proximoID("sessao"),
+		CarroID: carroID,
+		PontoID: pontoID,
+		Inicio:  inicio,
+	}
+	r.Sessoes[sessao.ID] = sessao
+	if checkIn := r.checkInValidoTravado(carroID, pontoID, time.Now()); checkIn != nil {
+		checkIn.SessaoID = sessao.ID // Cada check-in vale para uma única sessão
+	}
+	r.salvar()
+	return sessao.ID
+}
+
+// Fecha a sessão em andamento do carro no ponto e lança o débito correspondente
+func (r *LivroRazao) finalizarSessao(carroID, pontoID string, medicao MedicaoSessao, cobranca DetalheCobranca) (*SessaoRazao, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sessao := r.sessaoEmAndamentoTravado(carroID, pontoID)
+	if sessao == nil {
+		return nil, fmt.Errorf("Sessão em andamento não encontrada")
+	}
+
+	sessao.Inicio = medicao.Inicio
+	sessao.Fim = medicao.Fim
+	sessao.EnergiaKWh = medicao.EnergiaKWh
+	sessao.Cobranca = cobranca
+	sessao.Finalizada = true
+	r.emitirRecibo(sessao)
+
+	r.Lancamentos = append(r.Lancamentos, Lancamento{
+		ID:        r.proximoID("lanc"),
+		SessaoID:  sessao.ID,
+		CarroID:   carroID,
+		Tipo:      lancamentoDebito,
+		Valor:     cobranca.Total,
+		Data:      medicao.Fim,
+		Descricao: fmt.Sprintf("Carregamento no ponto %s", pontoID),
+	})
+	r.salvar()
+	return sessao, nil
+}
+
+// Sessão ainda não finalizada do carro no ponto. Deve ser chamada com r.mu travado.
+func (r *LivroRazao) sessaoEmAndamentoTravado(carroID, pontoID string) *SessaoRazao {
+	for _, s := range r.Sessoes {
+		if s.CarroID == carroID && s.PontoID == pontoID && !s.Finalizada {
+			return s
+		}
+	}
+	return nil
+}
+
+// ID da sessão em andamento do carro no ponto, ou vazio
+func (r *LivroRazao) sessaoEmAndamento(carroID, pontoID string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if sessao := r.sessaoEmAndamentoTravado(carroID, pontoID); sessao != nil {
+		return sessao.ID
+	}
+	return ""
+}
+
+// Valor ainda devido em uma sessão; negativo quando há valor a reembolsar.
+// Deve ser chamada com r.mu travado.
+func (r *LivroRazao) saldoSessao(sessaoID string) Dinheiro {
+	var saldo Dinheiro
+	for _, l := range r.Lancamentos {
+		if l.SessaoID != sessaoID {
+			continue
+		}
+		switch l.Tipo {
+		case lancamentoDebito, lancamentoReembolso:
+			saldo += l.Valor
+		case lancamentoCredito, lancamentoAjuste, lancamentoDesconto:
+			saldo -= l.Valor
+		}
+	}
+	return saldo
+}
+
+// Verifica se um pagamento seria aceito, sem lançá-lo
+func (r *LivroRazao) validarPagamento(carroID, sessaoID string, valor Dinheiro) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.validarPagamentoTravado(carroID, sessaoID, valor)
+}
+
+// Pagamento já lançado com a chave de idempotência informada, se houver
+func (r *LivroRazao) pagamentoPorChave(chave string) (Lancamento, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, l := range r.Lancamentos {
+		if l.Tipo == lancamentoCredito && l.ChaveIdempotencia == chave {
+			return l, true
+		}
+	}
+	return Lancamento{}, false
+}
+
+// Saldo devido de uma sessão finalizada do carro, com erro se não houver o que pagar
+func (r *LivroRazao) saldoEmAberto(carroID, sessaoID string) (Dinheiro, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.saldoEmAbertoTravado(carroID, sessaoID)
+}
+
+// Deve ser chamada com r.mu travado
+func (r *LivroRazao) saldoEmAbertoTravado(carroID, sessaoID string) (Dinheiro, error) {
+	sessao, existe := r.Sessoes[sessaoID]
+	switch {
+	case !existe:
+		return 0, fmt.Errorf("Sessão %s não encontrada", sessaoID)
+	case sessao.CarroID != carroID:
+		return 0, fmt.Errorf("Sessão %s pertence a outro carro", sessaoID)
+	case !sessao.Finalizada:
+		return 0, fmt.Errorf("Sessão %s ainda está em andamento", sessaoID)
+	}
+
+	saldo := r.saldoSessao(sessaoID)
+	if saldo <= 0 {
+		return 0, fmt.Errorf("Sessão %s já está paga", sessaoID)
+	}
+	return saldo, nil
+}
+
+// Deve ser chamada com r.mu travado
+func (r *LivroRazao) validarPagamentoTravado(carroID, sessaoID string, valor Dinheiro) error {
+	saldo, err := r.saldoEmAbertoTravado(carroID, sessaoID)
+	if err != nil {
+		return err
+	}
+	// Pagamentos parciais são aceitos; apenas pagar mais que o devido é recusado
+	if valor <= 0 || valor > saldo {
+		return fmt.Errorf("Valor %s não corresponde ao saldo da sessão %s (%s)", valor, sessaoID, saldo)
+	}
+	return nil
+}
+
+// Pagamentos lançados com a chave informada; um PAGAR_TODAS gera um por sessão
+func (r *LivroRazao) pagamentosPorChave(chave string) []Lancamento {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var pagamentos []Lancamento
+	for _, l := range r.Lancamentos {
+		if l.Tipo == lancamentoCredito && l.ChaveIdempotencia == chave {
+			pagamentos = append(pagamentos, l)
+		}
+	}
+	return pagamentos
+}
+
+// Sessão em aberto de um carro, como aparece no extrato
+type ItemExtrato struct {
+	SessaoID string    `json:"historicoID"`
+	PontoID  string    `json:"pontoID"`
+	Fim      time.Time `json:"fim"`
+	Total    Dinheiro  `json:"valor_total"`
+	Pago     Dinheiro  `json:"valor_pago"`
+	Saldo    Dinheiro  `json:"saldo"`
+}
+
+// Parte de um pagamento destinada a uma sessão
+type Alocacao struct {
+	SessaoID string   `json:"historicoID"`
+	Valor    Dinheiro `json:"valor"`
+}
+
+// Sessões do carro com saldo a pagar, da mais antiga para a mais recente
+func (r *LivroRazao) extrato(carroID string) []ItemExtrato {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.extratoTravado(carroID)
+}
+
+// Deve ser chamada com r.mu travado
+func (r *LivroRazao) extratoTravado(carroID string) []ItemExtrato {
+	itens := []ItemExtrato{}
+	for _, sessao := range r.Sessoes {
+		if sessao.CarroID != carroID || !sessao.Finalizada {
+			continue
+		}
+		saldo := r.saldoSessao(sessao.ID)
+		if saldo <= 0 {
+			continue
+		}
+		itens = append(itens, ItemExtrato{
+			SessaoID: sessao.ID,
+			PontoID:  sessao.PontoID,
+			Fim:      sessao.Fim,
+			Total:    sessao.totalDevido(),
+			Pago:     sessao.totalDevido() - saldo,
+			Saldo:    saldo,
+		})
+	}
+	sort.Slice(itens, func(i, j int) bool { return itens[i].Fim.Before(itens[j].Fim) })
+	return itens
+}
+
+// Distribui o valor entre as sessões escolhidas (ou todas, se nenhuma for
+// indicada), quitando primeiro as mais antigas. Deve ser chamada com r.mu travado.
+func (r *LivroRazao) alocarPagamentoTravado(carroID string, sessoes []string, valor Dinheiro) ([]Alocacao, error) {
+	escolhidas := make(map[string]bool)
+	for _, id := range sessoes {
+		if _, err := r.saldoEmAbertoTravado(carroID, id); err != nil {
+			return nil, err
+		}
+		escolhidas[id] = true
+	}
+
+	var alocacoes []Alocacao
+	restante := valor
+	for _, item := range r.extratoTravado(carroID) {
+		if len(escolhidas) > 0 && !escolhidas[item.SessaoID] {
+			continue
+		}
+		if restante <= 0 {
+			break
+		}
+		parte := minDinheiro(restante, item.Saldo)
+		alocacoes = append(alocacoes, Alocacao{SessaoID: item.SessaoID, Valor: parte})
+		restante -= parte
+	}
+
+	if len(alocacoes) == 0 {
+		return nil, fmt.Errorf("Nenhuma pendência em aberto para pagamento")
+	}
+	if restante > 0 {
+		return nil, fmt.Errorf("Valor %s excede o total em aberto das sessões escolhidas", valor)
+	}
+	return alocacoes, nil
+}
+
+// Calcula a distribuição de um pagamento sem lançá-lo
+func (r *LivroRazao) alocarPagamento(carroID string, sessoes []string, valor Dinheiro) ([]Alocacao, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.alocarPagamentoTravado(carroID, sessoes, valor)
+}
+
+// Lança um pagamento já cobrado no provedor, distribuído entre as sessões
+func (r *LivroRazao) registrarPagamentoDistribuido(carroID string, sessoes []string, valor Dinheiro, chave, transacaoID string) ([]Alocacao, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	alocacoes, err := r.alocarPagamentoTravado(carroID, sessoes, valor)
+	if err != nil {
+		return nil, err
+	}
+	for _, alocacao := range alocacoes {
+		r.Lancamentos = append(r.Lancamentos, Lancamento{
+			ID:                r.proximoID("lanc"),
+			SessaoID:          alocacao.SessaoID,
+			CarroID:           carroID,
+			Tipo:              lancamentoCredito,
+			Valor:             alocacao.Valor,
+			Data:              time.Now(),
+			Descricao:         "Pagamento de pendências",
+			ChaveIdempotencia: chave,
+			TransacaoID:       transacaoID,
+		})
+	}
+	r.salvar()
+	return alocacoes, nil
+}
+
+// Valida e lança o crédito do pagamento de uma sessão, já cobrado no provedor
+func (r *LivroRazao) registrarPagamento(carroID, sessaoID string, valor Dinheiro, chave, transacaoID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.validarPagamentoTravado(carroID, sessaoID, valor); err != nil {
+		return err
+	}
+
+	r.Lancamentos = append(r.Lancamentos, Lancamento{
+		ID:                r.proximoID("lanc"),
+		SessaoID:          sessaoID,
+		CarroID:           carroID,
+		Tipo:              lancamentoCredito,
+		Valor:             valor,
+		Data:              time.Now(),
+		Descricao:         "Pagamento de pendência",
+		ChaveIdempotencia: chave,
+		TransacaoID:       transacaoID,
+	})
+	r.salvar()
+	return nil
+}
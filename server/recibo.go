@@ -0,0 +1,289 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Situação de pagamento mostrada no recibo
+const (
+	reciboPago      = "PAGO"
+	reciboParcial   = "PARCIAL"
+	reciboPendente  = "PENDENTE"
+	reciboReembolso = "REEMBOLSO_PENDENTE" // Pago a mais após ajuste, aguardando devolução
+)
+
+const formatoTexto = "TEXTO"
+
+// Recibo de uma sessão finalizada, com a cobrança e os pagamentos recebidos
+type Recibo struct {
+	Numero          string            `json:"numero"`
+	SessaoID        string            `json:"historicoID"`
+	CarroID         string            `json:"carroID"`
+	PontoID         string            `json:"pontoID"`
+	Inicio          time.Time         `json:"inicio"`
+	Fim             time.Time         `json:"fim"`
+	DuracaoSegundos float64           `json:"duracao_segundos"`
+	EnergiaKWh      float64           `json:"energia_kwh"`
+	Cobranca        DetalheCobranca   `json:"cobranca"`
+	Descontos       []Desconto        `json:"descontos"`
+	Franquia        *SituacaoFranquia `json:"franquia,omitempty"` // Franquia do plano no período da sessão
+	Ajuste          Dinheiro          `json:"ajuste"`
+	TotalDevido     Dinheiro          `json:"total_devido"` // Total após descontos e ajustes
+	Pagamentos      []PagamentoRecibo `json:"pagamentos"`
+	Reembolsado     Dinheiro          `json:"reembolsado"`
+	ValorPago       Dinheiro          `json:"valor_pago"` // Pagamentos menos reembolsos
+	Saldo           Dinheiro          `json:"saldo"`
+	Moeda           string            `json:"moeda"`
+	Status          string            `json:"status"`
+}
+
+type PagamentoRecibo struct {
+	Data        time.Time `json:"data"`
+	Valor       Dinheiro  `json:"valor"`
+	Descricao   string    `json:"descricao"`
+	TransacaoID string    `json:"transacaoID,omitempty"`
+}
+
+// Recibos de um carro no mês, com os totais do período
+type ExtratoMensal struct {
+	CarroID       string   `json:"carroID"`
+	Mes           string   `json:"mes"` // "AAAA-MM"
+	Recibos       []Recibo `json:"recibos"`
+	EnergiaKWh    float64  `json:"energia_kwh"`
+	Total         Dinheiro `json:"total"`
+	Impostos      Dinheiro `json:"impostos"`
+	TotalPago     Dinheiro `json:"total_pago"`
+	TotalEmAberto Dinheiro `json:"total_em_aberto"`
+	Moeda         string   `json:"moeda"`
+}
+
+// Numera o recibo da sessão. Deve ser chamada com r.mu travado.
+func (r *LivroRazao) emitirRecibo(sessao *SessaoRazao) {
+	if sessao.Recibo != "" {
+		return
+	}
+	r.SeqRecibos++
+	sessao.Recibo = fmt.Sprintf("REC-%06d", r.SeqRecibos)
+}
+
+// Recibo de uma sessão finalizada do carro
+func (r *LivroRazao) recibo(carroID, sessaoID string) (Recibo, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sessao, existe := r.Sessoes[sessaoID]
+	switch {
+	case !existe:
+		return Recibo{}, fmt.Errorf("Sessão %s não encontrada", sessaoID)
+	case sessao.CarroID != carroID:
+		return Recibo{}, fmt.Errorf("Sessão %s pertence a outro carro", sessaoID)
+	case !sessao.Finalizada:
+		return Recibo{}, fmt.Errorf("Sessão %s ainda está em andamento", sessaoID)
+	}
+	return r.reciboTravado(sessao), nil
+}
+
+// Recibos das sessões do carro finalizadas no mês ("AAAA-MM"), em ordem de emissão
+func (r *LivroRazao) extratoMensal(carroID, mes string) ExtratoMensal {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	extrato := ExtratoMensal{CarroID: carroID, Mes: mes, Recibos: []Recibo{}, Moeda: moeda}
+	for _, sessao := range r.Sessoes {
+		if sessao.CarroID != carroID || !sessao.Finalizada || sessao.Fim.Format("2006-01") != mes {
+			continue
+		}
+		recibo := r.reciboTravado(sessao)
+		extrato.Recibos = append(extrato.Recibos, recibo)
+		extrato.EnergiaKWh += recibo.EnergiaKWh
+		extrato.Total += recibo.TotalDevido
+		extrato.Impostos += recibo.Cobranca.Impostos
+		extrato.TotalPago += recibo.ValorPago
+		extrato.TotalEmAberto += recibo.Saldo
+	}
+	sort.Slice(extrato.Recibos, func(i, j int) bool {
+		return extrato.Recibos[i].Fim.Before(extrato.Recibos[j].Fim)
+	})
+	return extrato
+}
+
+// Deve ser chamada com r.mu travado
+func (r *LivroRazao) reciboTravado(sessao *SessaoRazao) Recibo {
+	// Sessões gravadas antes da numeração recebem o número na primeira consulta
+	if sessao.Recibo == "" {
+		r.emitirRecibo(sessao)
+		r.salvar()
+	}
+
+	recibo := Recibo{
+		Numero:          sessao.Recibo,
+		SessaoID:        sessao.ID,
+		CarroID:         sessao.CarroID,
+		PontoID:         sessao.PontoID,
+		Inicio:          sessao.Inicio,
+		Fim:             sessao.Fim,
+		DuracaoSegundos: sessao.Fim.Sub(sessao.Inicio).Seconds(),
+		EnergiaKWh:      sessao.EnergiaKWh,
+		Cobranca:        sessao.Cobranca,
+		Descontos:       append([]Desconto{}, sessao.Descontos...),
+		Ajuste:          sessao.Ajuste,
+		TotalDevido:     sessao.totalDevido(),
+		Pagamentos:      []PagamentoRecibo{},
+		Saldo:           r.saldoSessao(sessao.ID),
+		Moeda:           moeda,
+	}
+	if franquia, ok := r.situacaoFranquiaTravado(sessao.CarroID, periodoCobranca(sessao.Fim)); ok {
+		recibo.Franquia = &franquia
+	}
+	for _, l := range r.Lancamentos {
+		if l.SessaoID != sessao.ID {
+			continue
+		}
+		switch l.Tipo {
+		case lancamentoCredito:
+			recibo.Pagamentos = append(recibo.Pagamentos, PagamentoRecibo{
+				Data:        l.Data,
+				Valor:       l.Valor,
+				Descricao:   l.Descricao,
+				TransacaoID: l.TransacaoID,
+			})
+			recibo.ValorPago += l.Valor
+		case lancamentoReembolso:
+			recibo.Reembolsado += l.Valor
+			recibo.ValorPago -= l.Valor
+		}
+	}
+
+	switch {
+	case recibo.Saldo < 0:
+		recibo.Status = reciboReembolso
+	case recibo.Saldo == 0:
+		recibo.Status = reciboPago
+	case recibo.ValorPago > 0:
+		recibo.Status = reciboParcial
+	default:
+		recibo.Status = reciboPendente
+	}
+	return recibo
+}
+
+func (rec Recibo) texto() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "RECIBO %s\n", rec.Numero)
+	fmt.Fprintf(&b, "Sessão: %s\n", rec.SessaoID)
+	fmt.Fprintf(&b, "Carro: %s\n", rec.CarroID)
+	fmt.Fprintf(&b, "Ponto de recarga: %s\n", rec.PontoID)
+	fmt.Fprintf(&b, "Início: %s\n", rec.Inicio.Format("02/01/2006 15:04:05"))
+	fmt.Fprintf(&b, "Fim: %s\n", rec.Fim.Format("02/01/2006 15:04:05"))
+	fmt.Fprintf(&b, "Duração: %s\n", time.Duration(rec.DuracaoSegundos*float64(time.Second)).Round(time.Second))
+	fmt.Fprintf(&b, "Energia: %.3f kWh\n", rec.EnergiaKWh)
+	fmt.Fprintf(&b, "Tarifa: %s\n", rec.Cobranca.Tarifa)
+	type linha struct {
+		nome  string
+		valor Dinheiro
+	}
+	linhas := []linha{
+		{"Taxa de sessão", rec.Cobranca.TaxaSessao},
+		{"Energia", rec.Cobranca.Energia},
+		{"Tempo", rec.Cobranca.Tempo},
+		{"Ociosidade", rec.Cobranca.Ociosidade},
+		{"Total", rec.Cobranca.Total},
+		{"Tributos inclusos", rec.Cobranca.Impostos},
+	}
+	for _, d := range rec.Descontos {
+		// A descrição completa é longa demais para a coluna; a origem identifica o desconto
+		linhas = append(linhas, linha{strings.Replace(d.Origem, ":", " ", 1), -d.Valor})
+	}
+	if rec.Ajuste > 0 {
+		linhas = append(linhas, linha{"Ajuste (disputa)", -rec.Ajuste})
+	}
+	if rec.TotalDevido != rec.Cobranca.Total {
+		linhas = append(linhas, linha{"Total a pagar", rec.TotalDevido})
+	}
+	for _, l := range linhas {
+		fmt.Fprintf(&b, "  %-18s %s %8s\n", l.nome, rec.Moeda, l.valor)
+	}
+	if f := rec.Franquia; f != nil {
+		fmt.Fprintf(&b, "Plano %s em %s: restam %.1f min e %.3f kWh (usados %.1f min e %.3f kWh)\n",
+			f.Plano, f.Periodo, f.MinutosRestantes, f.KWhRestantes, f.MinutosUsados, f.KWhUsados)
+	}
+	for _, p := range rec.Pagamentos {
+		fmt.Fprintf(&b, "Pagamento em %s: %s %s (%s)\n", p.Data.Format("02/01/2006 15:04"), rec.Moeda, p.Valor, p.Descricao)
+	}
+	if rec.Reembolsado > 0 {
+		fmt.Fprintf(&b, "Reembolsado: %s %s\n", rec.Moeda, rec.Reembolsado)
+	}
+	fmt.Fprintf(&b, "Situação: %s (pago %s %s, em aberto %s %s)\n", rec.Status, rec.Moeda, rec.ValorPago, rec.Moeda, rec.Saldo)
+	return b.String()
+}
+
+func (e ExtratoMensal) texto() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "EXTRATO MENSAL %s - carro %s\n", e.Mes, e.CarroID)
+	if len(e.Recibos) == 0 {
+		b.WriteString("Nenhuma sessão no período.\n")
+		return b.String()
+	}
+	for _, rec := range e.Recibos {
+		fmt.Fprintf(&b, "%s  %s  %-20s %8.3f kWh  %s %8s  %s\n",
+			rec.Numero, rec.Fim.Format("02/01 15:04"), rec.PontoID, rec.EnergiaKWh, e.Moeda, rec.TotalDevido, rec.Status)
+	}
+	fmt.Fprintf(&b, "Energia total: %.3f kWh\n", e.EnergiaKWh)
+	fmt.Fprintf(&b, "Total: %s %s (tributos inclusos %s %s)\n", e.Moeda, e.Total, e.Moeda, e.Impostos)
+	fmt.Fprintf(&b, "Pago: %s %s, em aberto: %s %s\n", e.Moeda, e.TotalPago, e.Moeda, e.TotalEmAberto)
+	return b.String()
+}
+
+// Devolve o recibo de uma sessão em JSON ou, com "formato" TEXTO, em texto simples
+func handleRecibo(conn net.Conn, content map[string]interface{}) {
+	carroID, okCarro := content["carroID"].(string)
+	historicoID, okHistorico := content["historicoID"].(string)
+	if !okCarro || !okHistorico {
+		sendErrorResponse(conn, "Dados do recibo incompletos")
+		return
+	}
+
+	recibo, err := razao.recibo(carroID, historicoID)
+	if err != nil {
+		sendErrorResponse(conn, err.Error())
+		return
+	}
+
+	resposta := map[string]interface{}{"historicoID": historicoID, "numero": recibo.Numero}
+	if formato, _ := content["formato"].(string); strings.ToUpper(formato) == formatoTexto {
+		resposta["texto"] = recibo.texto()
+	} else {
+		resposta["recibo"] = recibo
+	}
+	sendResponse(conn, Message{Action: "RECIBO", Content: resposta})
+}
+
+// Devolve os recibos do carro no mês informado ("AAAA-MM", padrão: mês atual)
+func handleExtratoMensal(conn net.Conn, content map[string]interface{}) {
+	carroID, ok := content["carroID"].(string)
+	if !ok {
+		sendErrorResponse(conn, "ID do carro inválido")
+		return
+	}
+	mes, _ := content["mes"].(string)
+	if mes == "" {
+		mes = time.Now().Format("2006-01")
+	}
+	if _, err := time.Parse("2006-01", mes); err != nil {
+		sendErrorResponse(conn, "Mês inválido, use o formato AAAA-MM")
+		return
+	}
+
+	extrato := razao.extratoMensal(carroID, mes)
+	resposta := map[string]interface{}{"carroID": carroID, "mes": mes}
+	if formato, _ := content["formato"].(string); strings.ToUpper(formato) == formatoTexto {
+		resposta["texto"] = extrato.texto()
+	} else {
+		resposta["extrato"] = extrato
+	}
+	sendResponse(conn, Message{Action: "EXTRATO_MENSAL", Content: resposta})
+}
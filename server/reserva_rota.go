@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	timeoutTransacao = 5 * time.Second
+	// Tempo que os pontos retêm a vaga preparada. Cobre a fase 1, em que um
+	// ponto pode ser procurado em cada servidor parceiro, e as novas
+	// tentativas de confirmação da fase 2.
+	validadeReservaRota = 2 * time.Minute
+	// Espera entre tentativas de confirmação
+	intervaloConfirmacao = time.Second
+)
+
+// Ponto que aceitou a preparação e o nó que responde por ele
+// (o próprio ponto de recarga ou um servidor parceiro)
+type participanteReserva struct {
+	pontoID  string
+	endereco string
+}
+
+// Reserva todos os pontos de uma rota ou nenhum, usando duas fases:
+// PREPARAR_RESERVA em todos os pontos e, só então, CONFIRMAR_RESERVA.
+// Qualquer recusa ou timeout na primeira fase cancela as preparações feitas.
+// Na segunda, cada ponto é confirmado até responder; se algum não puder mais
+// confirmar, as reservas já confirmadas são desfeitas.
+func handleReservarRota(conn net.Conn, request Message) {
+	fmt.Println("Cliente solicitou reserva de rota.")
+
+	carroID, ok := request.Content["ID"].(string)
+	pontosIDs := convertInterfaceToStringSlice(request.Content["pontos"])
+	if !ok || len(pontosIDs) == 0 {
+		sendErrorResponse(conn, "Dados da reserva de rota incompletos")
+		return
+	}
+	if bloqueadoPorDivida(conn, carroID) {
+		return
+	}
+
+	transacaoID := fmt.Sprintf("tx-%s-%d", carroID, time.Now().UnixNano())
+	fmt.Printf("Iniciando transação %s para os pontos %v\n", transacaoID, pontosIDs)
+
+	// Fase 1: preparar todos os pontos ao mesmo tempo, para que rotas longas
+	// não esgotem a validade das primeiras preparações
+	prazo := time.Now().Add(validadeReservaRota)
+	participantes := make([]participanteReserva, len(pontosIDs))
+	falhas := make([]string, len(pontosIDs))
+	var wg sync.WaitGroup
+	for i, pontoID := range pontosIDs {
+		wg.Add(1)
+		go func(i int, pontoID string) {
+			defer wg.Done()
+			participante, resposta, err := prepararReserva(transacaoID, carroID, pontoID)
+			participantes[i] = participante
+			if err != nil {
+				falhas[i] = err.Error()
+			} else if resposta.Action != "RESERVA_PREPARADA" {
+				falhas[i] = fmt.Sprint(resposta.Content["mensagem"])
+			}
+		}(i, pontoID)
+	}
+	wg.Wait()
+
+	// Em caso de timeout o ponto pode ter preparado sem conseguirmos saber,
+	// então o cancelamento vai a todos os que foram contatados
+	var preparados []participanteReserva
+	for _, participante := range participantes {
+		if participante.endereco != "" {
+			preparados = append(preparados, participante)
+		}
+	}
+	for i, motivo := range falhas {
+		if motivo != "" {
+			abortarReservaRota(transacaoID, preparados)
+			sendErrorResponse(conn, fmt.Sprintf("Reserva da rota cancelada: ponto %s indisponível (%s)", pontosIDs[i], motivo))
+			return
+		}
+	}
+
+	// Fase 2: confirmar em todos os pontos
+	respostas := make([]Message, len(preparados))
+	errosConfirmacao := make([]error, len(preparados))
+	for i, participante := range preparados {
+		wg.Add(1)
+		go func(i int, participante participanteReserva) {
+			defer wg.Done()
+			respostas[i], errosConfirmacao[i] = confirmarReserva(transacaoID, participante, prazo)
+		}(i, participante)
+	}
+	wg.Wait()
+
+	for i, err := range errosConfirmacao {
+		if err != nil {
+			fmt.Printf("Falha ao confirmar transação %s no ponto %s: %v\n", transacaoID, preparados[i].pontoID, err)
+			abortarReservaRota(transacaoID, preparados)
+			sendErrorResponse(conn, fmt.Sprintf("Reserva da rota cancelada: ponto %s não confirmou (%v)", preparados[i].pontoID, err))
+			return
+		}
+	}
+	var reservas []map[string]interface{}
+	for i, participante := range preparados {
+		reservas = append(reservas, map[string]interface{}{
+			"pontoID":      participante.pontoID,
+			"posicao_fila": respostas[i].Content["posicao_fila"],
+		})
+	}
+
+	response := Message{
+		Action: "RESERVA_ROTA_CONFIRMADA",
+		Content: map[string]interface{}{
+			"transacaoID": transacaoID,
+			"carroID":     carroID,
+			"reservas":    reservas,
+		},
+	}
+	sendResponse(conn, response)
+}
+
+// Envia PREPARAR_RESERVA ao ponto local ou, se não for gerenciado aqui,
+// ao primeiro servidor parceiro que o reconhecer
+func prepararReserva(transacaoID, carroID, pontoID string) (participanteReserva, Message, error) {
+	msg := Message{
+		Action: "PREPARAR_RESERVA",
+		Content: map[string]interface{}{
+			"transacaoID": transacaoID,
+			"carroID":     carroID,
+			"pontoID":     pontoID,
+			"validade_s":  validadeReservaRota.Seconds(),
+		},
+	}
+
+	if endereco := enderecoDoPonto(pontoID); endereco != "" {
+		participante := participanteReserva{pontoID: pontoID, endereco: endereco}
+		resposta, err := trocarMensagem(endereco, msg, timeoutTransacao)
+		return participante, resposta, err
+	}
+
+	for _, servidor := range servidoresParceiros {
+		resposta, err := trocarMensagem(servidor, msg, timeoutTransacao)
+		if err == nil && resposta.Action == "ERRO" && resposta.Content["mensagem"] == msgPontoNaoEncontrado {
+			continue
+		}
+		participante := participanteReserva{pontoID: pontoID, endereco: servidor}
+		return participante, resposta, err
+	}
+
+	return participanteReserva{}, Message{}, fmt.Errorf(msgPontoNaoEncontrado)
+}
+
+// A decisão de confirmar já foi tomada, então insiste até o ponto responder.
+// A confirmação é idempotente no ponto, e só uma recusa (a preparação
+// expirou ou foi perdida) ou o fim do prazo fazem desistir.
+func confirmarReserva(transacaoID string, participante participanteReserva, prazo time.Time) (Message, error) {
+	msg := Message{
+		Action: "CONFIRMAR_RESERVA",
+		Content: map[string]interface{}{
+			"transacaoID": transacaoID,
+			"pontoID":     participante.pontoID,
+		},
+	}
+
+	for {
+		resposta, err := trocarMensagem(participante.endereco, msg, timeoutTransacao)
+		if err == nil {
+			if resposta.Action != "RESERVA_CONFIRMADA" {
+				return resposta, fmt.Errorf("%v", resposta.Content["mensagem"])
+			}
+			return resposta, nil
+		}
+		if time.Now().Add(intervaloConfirmacao).After(prazo) {
+			return Message{}, fmt.Errorf("prazo esgotado: %v", err)
+		}
+		fmt.Printf("Nova tentativa de confirmar a transação %s no ponto %s: %v\n", transacaoID, participante.pontoID, err)
+		time.Sleep(intervaloConfirmacao)
+	}
+}
+
+// Cancela a transação em todos os pontos: libera as vagas preparadas e
+// retira o carro da fila onde a reserva já tinha sido confirmada
+func abortarReservaRota(transacaoID string, participantes []participanteReserva) {
+	var wg sync.WaitGroup
+	for _, participante := range participantes {
+		wg.Add(1)
+		go func(participante participanteReserva) {
+			defer wg.Done()
+			msg := Message{
+				Action: "CANCELAR_RESERVA",
+				Content: map[string]interface{}{
+					"transacaoID": transacaoID,
+					"pontoID":     participante.pontoID,
+				},
+			}
+			// Se o cancelamento se perder, a preparação expira sozinha no ponto
+			if _, err := trocarMensagem(participante.endereco, msg, timeoutTransacao); err != nil {
+				fmt.Printf("Falha ao cancelar transação %s no ponto %s: %v\n", transacaoID, participante.pontoID, err)
+			}
+		}(participante)
+	}
+	wg.Wait()
+}
+
+// Repassa mensagens do protocolo de reserva vindas de servidores parceiros
+// ao ponto de recarga gerenciado por este servidor
+func handleParticipanteReserva(conn net.Conn, request Message) {
+	pontoID, _ := request.Content["pontoID"].(string)
+	endereco := enderecoDoPonto(pontoID)
+	if endereco == "" {
+		sendErrorResponse(conn, msgPontoNaoEncontrado)
+		return
+	}
+
+	resposta, err := trocarMensagem(endereco, request, timeoutTransacao)
+	if err != nil {
+		sendErrorResponse(conn, fmt.Sprintf("Erro ao comunicar com o ponto: %v", err))
+		return
+	}
+	sendResponse(conn, resposta)
+}
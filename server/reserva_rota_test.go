@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Comportamento de um ponto de recarga falso usado nos testes
+const (
+	pontoAceita          = "ACEITA"           // Prepara, confirma e cancela
+	pontoRecusa          = "RECUSA"           // Recusa a preparação
+	pontoRecusaConfirmar = "RECUSA_CONFIRMAR" // Prepara, mas a preparação expira antes da confirmação
+	pontoMudo            = "MUDO"             // Lê as mensagens e nunca responde
+)
+
+// Ponto de recarga falso escutando em localhost, que registra as ações recebidas
+type pontoFalso struct {
+	listener      net.Listener
+	comportamento string
+
+	mu      sync.Mutex
+	acoes   []string
+	abertas []net.Conn
+}
+
+func novoPontoFalso(t *testing.T, comportamento string) *pontoFalso {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("erro ao abrir ponto falso: %v", err)
+	}
+	p := &pontoFalso{listener: listener, comportamento: comportamento}
+	go p.atender()
+	return p
+}
+
+func (p *pontoFalso) endereco() string {
+	return p.listener.Addr().String()
+}
+
+func (p *pontoFalso) atender() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		go p.responder(conn)
+	}
+}
+
+func (p *pontoFalso) responder(conn net.Conn) {
+	linha, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return
+	}
+	var msg Message
+	json.Unmarshal([]byte(linha), &msg)
+
+	p.mu.Lock()
+	p.acoes = append(p.acoes, msg.Action)
+	if p.comportamento == pontoMudo {
+		// A conexão fica aberta até o fim do teste, como um ponto travado
+		p.abertas = append(p.abertas, conn)
+		p.mu.Unlock()
+		return
+	}
+	p.mu.Unlock()
+	defer conn.Close()
+
+	resposta := Message{Content: map[string]interface{}{"transacaoID": msg.Content["transacaoID"]}}
+	switch {
+	case msg.Action == "PREPARAR_RESERVA" && p.comportamento == pontoRecusa:
+		resposta.Action = "RESERVA_RECUSADA"
+		resposta.Content["mensagem"] = "Fila do ponto está cheia"
+	case msg.Action == "PREPARAR_RESERVA":
+		resposta.Action = "RESERVA_PREPARADA"
+	case msg.Action == "CONFIRMAR_RESERVA" && p.comportamento == pontoRecusaConfirmar:
+		resposta.Action = "RESERVA_RECUSADA"
+		resposta.Content["mensagem"] = "Preparação não encontrada ou expirada"
+	case msg.Action == "CONFIRMAR_RESERVA":
+		resposta.Action = "RESERVA_CONFIRMADA"
+		resposta.Content["posicao_fila"] = 1
+	case msg.Action == "CANCELAR_RESERVA":
+		resposta.Action = "RESERVA_CANCELADA"
+	}
+	sendResponse(conn, resposta)
+}
+
+func (p *pontoFalso) acoesRecebidas() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string{}, p.acoes...)
+}
+
+func (p *pontoFalso) fechar() {
+	p.listener.Close()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, conn := range p.abertas {
+		conn.Close()
+	}
+}
+
+// Reserva de rota com pontos falsos em localhost: as duas fases, o
+// cancelamento após recusa e o cancelamento após timeout de um ponto travado
+func TestReservarRota(t *testing.T) {
+	casos := []struct {
+		nome     string
+		pontos   []string
+		resposta string
+		acoes    [][]string // Ações recebidas por cada ponto, na ordem
+		duracao  time.Duration
+	}{
+		{
+			nome:     "todos aceitam",
+			pontos:   []string{pontoAceita, pontoAceita},
+			resposta: "RESERVA_ROTA_CONFIRMADA",
+			acoes: [][]string{
+				{"PREPARAR_RESERVA", "CONFIRMAR_RESERVA"},
+				{"PREPARAR_RESERVA", "CONFIRMAR_RESERVA"},
+			},
+		},
+		{
+			nome:     "recusa na preparação cancela os demais",
+			pontos:   []string{pontoAceita, pontoRecusa},
+			resposta: "ERRO",
+			acoes: [][]string{
+				{"PREPARAR_RESERVA", "CANCELAR_RESERVA"},
+				{"PREPARAR_RESERVA", "CANCELAR_RESERVA"},
+			},
+		},
+		{
+			nome:     "recusa na confirmação desfaz as confirmadas",
+			pontos:   []string{pontoAceita, pontoRecusaConfirmar},
+			resposta: "ERRO",
+			acoes: [][]string{
+				{"PREPARAR_RESERVA", "CONFIRMAR_RESERVA", "CANCELAR_RESERVA"},
+				{"PREPARAR_RESERVA", "CONFIRMAR_RESERVA", "CANCELAR_RESERVA"},
+			},
+		},
+		{
+			nome:     "ponto travado esgota o timeout e a transação é abortada",
+			pontos:   []string{pontoAceita, pontoMudo},
+			resposta: "ERRO",
+			acoes: [][]string{
+				{"PREPARAR_RESERVA", "CANCELAR_RESERVA"},
+				{"PREPARAR_RESERVA", "CANCELAR_RESERVA"},
+			},
+			duracao: timeoutTransacao,
+		},
+	}
+
+	pontosOriginais := pontosDeRecarga
+	defer func() { pontosDeRecarga = pontosOriginais }()
+
+	for _, caso := range casos {
+		t.Run(caso.nome, func(t *testing.T) {
+			var falsos []*pontoFalso
+			var ids []interface{}
+			pontosDeRecarga = nil
+			for _, comportamento := range caso.pontos {
+				p := novoPontoFalso(t, comportamento)
+				defer p.fechar()
+				falsos = append(falsos, p)
+				ids = append(ids, p.endereco())
+				pontosDeRecarga = append(pontosDeRecarga, p.endereco())
+			}
+
+			cliente, servidor := net.Pipe()
+			defer cliente.Close()
+			inicio := time.Now()
+			go func() {
+				defer servidor.Close()
+				handleReservarRota(servidor, Message{
+					Action:  "RESERVAR_ROTA",
+					Content: map[string]interface{}{"ID": "carro-teste-rota", "pontos": ids},
+				})
+			}()
+
+			cliente.SetDeadline(time.Now().Add(3 * timeoutTransacao))
+			linha, err := bufio.NewReader(cliente).ReadString('\n')
+			if err != nil {
+				t.Fatalf("erro ao ler resposta: %v", err)
+			}
+			var resposta Message
+			if err := json.Unmarshal([]byte(linha), &resposta); err != nil {
+				t.Fatalf("resposta inválida: %v", err)
+			}
+			if resposta.Action != caso.resposta {
+				t.Fatalf("resposta %s, esperada %s (%v)", resposta.Action, caso.resposta, resposta.Content)
+			}
+			if decorrido := time.Since(inicio); decorrido < caso.duracao {
+				t.Errorf("resposta em %s, antes do timeout de %s", decorrido, caso.duracao)
+			}
+
+			for i, p := range falsos {
+				if acoes := p.acoesRecebidas(); !reflect.DeepEqual(acoes, caso.acoes[i]) {
+					t.Errorf("ponto %d (%s) recebeu %v, esperado %v", i, p.comportamento, acoes, caso.acoes[i])
+				}
+			}
+		})
+	}
+}
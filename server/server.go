@@ -6,8 +6,10 @@ import (
 	"fmt"
 	"math"
 	"net"
+	"os"
 	"strings"
 	"sync"
+	"time"
 )
 
 type Message struct {
@@ -16,30 +18,57 @@ type Message struct {
 }
 
 // Lista de Pontos de Recarga e suas portas
-var pontosDeRecarga = []string{"charger:6001", "charger2:6002"}
+var pontosDeRecarga = lerListaEnv("PONTOS_DE_RECARGA", []string{"charger:6001", "charger2:6002"})
+
+// Outros servidores consultados quando um ponto não é gerenciado localmente
+var servidoresParceiros = lerListaEnv("SERVIDORES_PARCEIROS", nil)
+
+const msgPontoNaoEncontrado = "Ponto de recarga não encontrado"
+
+const (
+	// Tempo máximo de espera pela resposta de um ponto ao listar a rede
+	timeoutConsultaPonto = 2 * time.Second
+	// Pontos consultados ao mesmo tempo ao listar a rede
+	consultasSimultaneas = 32
+)
 
 type PontoRecarga struct {
 	ID          string   `json:"ID"`
+	Nome        string   `json:"nome,omitempty"`
+	Endereco    string   `json:"endereco,omitempty"`
+	Conectores  []string `json:"conectores,omitempty"`
 	Latitude    float64  `json:"latitude"`
 	Longitude   float64  `json:"longitude"`
 	Fila        []string `json:"fila"`
 	TamanhoFila int      `json:"TamanhoFila"`
 	Distancia   float64  `json:"Distancia"`
+	TempoMin    float64  `json:"tempo_min,omitempty"` // Tempo de direção, só com o grafo viário
+	Trajeto     string   `json:"trajeto,omitempty"`   // VIARIO ou LINHA_RETA
+	PotenciaKW  float64  `json:"potencia_kw"`         // Já limitada pela parte do site que um novo carro receberia
+	Site        string   `json:"site,omitempty"`
+	Tarifa      Tarifa   `json:"tarifa"`
+	// Preenchido quando o carro informa a energia restante e o consumo
+	Alcance   *AlcancePonto          `json:"alcance,omitempty"`
+	Metadados map[string]interface{} `json:"metadados,omitempty"`
 }
 
 var (
 	carrosEmCarregamento = make(map[string]string) // Mapa carroID -> pontoID
+	pontosIniciando      = make(map[string]bool)   // Pontos com sessão começando
 	carregamentoMutex    sync.Mutex
 )
 
 func main() {
-	listener, err := net.Listen("tcp", ":5000")
+	porta := lerEnvPadrao("PORTA", "5000")
+	go iniciarWebhookPix()
+
+	listener, err := net.Listen("tcp", ":"+porta)
 	if err != nil {
 		fmt.Println("Erro ao iniciar o servidor:", err)
 		return
 	}
 	defer listener.Close()
-	fmt.Println("Servidor ouvindo na porta 5000...")
+	fmt.Printf("Servidor ouvindo na porta %s...\n", porta)
 
 	for {
 		conn, err := listener.Accept()
@@ -71,14 +100,60 @@ func handleClient(conn net.Conn) {
 	switch request.Action {
 	case "LISTAR_PONTOS":
 		handleListarPontos(conn, request)
+	case "IMPORTAR_CATALOGO":
+		handleImportarCatalogo(conn, request.Content)
+	case "EXPORTAR_REDE":
+		handleExportarRede(conn)
 	case "RESERVAR_PONTO":
 		handleReservarPonto(conn, request)
+	case "DESISTIR_RESERVA":
+		handleDesistirReserva(conn, request.Content)
 	case "INICIO_CARREGAMENTO":
 		handleInicioCarregamento(conn, request)
 	case "FIM_CARREGAMENTO":
 		handleFimCarregamento(conn, request)
+	case "CHECK_IN":
+		handleCheckIn(conn, request.Content)
+	case "CONSULTAR_CHECK_INS":
+		handleConsultarCheckIns(conn, request.Content)
+	case "ACOMPANHAR_CARREGAMENTO":
+		handleAcompanharCarregamento(conn, request.Content)
 	case "PAGAR_PENDENCIA":
 		handlePagarPendencia(conn, request.Content)
+	case "PAGAR_TODAS":
+		handlePagarTodas(conn, request.Content)
+	case "EXTRATO":
+		handleExtrato(conn, request.Content)
+	case "RECIBO":
+		handleRecibo(conn, request.Content)
+	case "EXTRATO_MENSAL":
+		handleExtratoMensal(conn, request.Content)
+	case "ABRIR_DISPUTA":
+		handleAbrirDisputa(conn, request.Content)
+	case "CONSULTAR_DISPUTA":
+		handleConsultarDisputa(conn, request.Content)
+	case "RESOLVER_DISPUTA":
+		handleResolverDisputa(conn, request.Content)
+	case "REEMBOLSO":
+		handleReembolso(conn, request.Content)
+	case "ASSINAR_PLANO":
+		handleAssinarPlano(conn, request.Content)
+	case "CONSULTAR_PLANO":
+		handleConsultarPlano(conn, request.Content)
+	case "GERAR_PIX":
+		handleGerarPix(conn, request.Content)
+	case "RECARREGAR_CARTEIRA":
+		handleRecarregarCarteira(conn, request.Content)
+	case "CONSULTAR_SALDO":
+		handleConsultarSaldo(conn, request.Content)
+	case "CONFIGURAR_PAGAMENTO_MOCK":
+		handleConfigurarPagamentoMock(conn, request.Content)
+	case "PLANEJAR_VIAGEM":
+		handlePlanejarViagem(conn, request)
+	case "RESERVAR_ROTA":
+		handleReservarRota(conn, request)
+	case "PREPARAR_RESERVA", "CONFIRMAR_RESERVA", "CANCELAR_RESERVA":
+		handleParticipanteReserva(conn, request)
 	default:
 		fmt.Println("Ação desconhecida:", request.Action)
 		sendErrorResponse(conn, "Ação desconhecida")
@@ -88,40 +163,159 @@ func handleClient(conn net.Conn) {
 func handlePagarPendencia(conn net.Conn, content map[string]interface{}) {
 	fmt.Println("Recebido pedido de pagamento do carro:", content["carroID"])
 
+	carroID, okCarro := content["carroID"].(string)
 	historicoID, ok := content["historicoID"].(string)
 	if !ok {
 		sendErrorResponse(conn, "ID da sessão inválido")
 		return
 	}
+	valor, okValor := lerDinheiro(content, "valor")
+	chave, okChave := content["chave_idempotencia"].(string)
+	if !okCarro || !okValor || !okChave || chave == "" {
+		sendErrorResponse(conn, "Dados do pagamento incompletos")
+		return
+	}
+	if err := verificarMoeda(content); err != nil {
+		sendErrorResponse(conn, err.Error())
+		return
+	}
+
+	// Repetição de um pagamento já concluído: responde igual, sem cobrar de novo
+	if anterior, existe := razao.pagamentoPorChave(chave); existe {
+		if anterior.CarroID != carroID || anterior.SessaoID != historicoID {
+			sendErrorResponse(conn, "Chave de idempotência já usada em outro pagamento")
+			return
+		}
+		sendResponse(conn, confirmacaoPagamento(historicoID, anterior.TransacaoID))
+		return
+	}
+
+	// Cupom informado no pagamento: o desconto é lançado antes e o valor
+	// cobrado é limitado ao que restar em aberto
+	var desconto *Desconto
+	if cupom, _ := content["cupom"].(string); strings.TrimSpace(cupom) != "" {
+		aplicado, err := razao.aplicarCupom(carroID, historicoID, strings.ToUpper(strings.TrimSpace(cupom)))
+		if err != nil {
+			sendErrorResponse(conn, err.Error())
+			return
+		}
+		desconto = &aplicado
+		fmt.Printf("Cupom %s aplicado à sessão %s: %s\n", cupom, historicoID, aplicado.Valor)
+
+		saldo, err := razao.saldoEmAberto(carroID, historicoID)
+		if err != nil {
+			// O desconto cobriu todo o saldo: nada a cobrar
+			sendResponse(conn, confirmacaoComDesconto(historicoID, "", 0, desconto))
+			return
+		}
+		valor = minDinheiro(valor, saldo)
+	}
+
+	if err := razao.validarPagamento(carroID, historicoID, valor); err != nil {
+		fmt.Println("Pagamento recusado:", err)
+		sendErrorResponse(conn, err.Error())
+		return
+	}
+
+	pedido := PedidoPagamento{ChaveIdempotencia: chave, CarroID: carroID, SessaoID: historicoID, Valor: valor}
+	cobranca, err := cobrarNoProvedor(pedido)
+	if err != nil {
+		fmt.Println("Falha no provedor de pagamento:", err)
+		sendErrorResponse(conn, err.Error())
+		return
+	}
+
+	if err := razao.registrarPagamento(carroID, historicoID, valor, chave, cobranca.TransacaoID); err != nil {
+		// Uma repetição simultânea com a mesma chave já lançou esta mesma transação
+		if anterior, existe := razao.pagamentoPorChave(chave); existe && anterior.TransacaoID == cobranca.TransacaoID {
+			sendResponse(conn, confirmacaoPagamento(historicoID, cobranca.TransacaoID))
+			return
+		}
+		// A sessão foi paga por outra requisição enquanto cobrávamos: devolve o valor
+		if _, errEstorno := provedorPagamento.Refund(cobranca.TransacaoID, valor); errEstorno != nil {
+			fmt.Println("Erro ao estornar pagamento duplicado:", errEstorno)
+		}
+		sendErrorResponse(conn, err.Error())
+		return
+	}
+
+	sendResponse(conn, confirmacaoComDesconto(historicoID, cobranca.TransacaoID, valor, desconto))
+}
+
+// Confirmação de um pagamento em que foi usado um cupom
+func confirmacaoComDesconto(historicoID, transacaoID string, cobrado Dinheiro, desconto *Desconto) Message {
+	resposta := confirmacaoPagamento(historicoID, transacaoID)
+	if desconto != nil {
+		resposta.Content["desconto"] = desconto
+		resposta.Content["valor_cobrado"] = cobrado
+		resposta.Content["moeda"] = moeda
+	}
+	if transacaoID == "" {
+		resposta.Content["status"] = "SEM_COBRANCA"
+	}
+	return resposta
+}
+
+func confirmacaoPagamento(historicoID, transacaoID string) Message {
+	status, err := provedorPagamento.Status(transacaoID)
+	if err != nil {
+		status.Status = statusCapturado
+	}
 
 	response := Message{
 		Action: "PAGAMENTO_CONFIRMADO",
 		Content: map[string]interface{}{
 			"historicoID": historicoID,
+			"transacaoID": transacaoID,
+			"status":      status.Status,
 			"mensagem":    fmt.Sprintf("Pagamento da sessão %v recebido com sucesso.", historicoID),
 		},
 	}
-
-	sendResponse(conn, response)
+	return response
 }
 
 func handleListarPontos(conn net.Conn, request Message) {
 	fmt.Println("Cliente solicitou a lista de pontos de recarga.")
 	carro := request.Content
 
+	autonomia, informada, err := lerAutonomia(carro)
+	if err != nil {
+		sendErrorResponse(conn, err.Error())
+		return
+	}
+	somenteAlcancaveis, _ := carro["somente_alcancaveis"].(bool)
+	if somenteAlcancaveis && !informada {
+		sendErrorResponse(conn, "Informe a energia restante e o consumo para filtrar os pontos alcançáveis")
+		return
+	}
+
+	// Menores caminhos pelo grafo viário a partir do carro; nil sem grafo
+	caminhos := grafoViario.caminhosDe(carro["latitude"].(float64), carro["longitude"].(float64))
+
 	// Obter informações de todos os pontos de recarga
-	var pontos []PontoRecarga
-	for _, endereco := range pontosDeRecarga {
-		ponto := obterInformacoesPonto(endereco)
-		if ponto.ID != "" { // Verifica se obteve resposta válida
+	pontos := []PontoRecarga{} // Lista vazia, e não nula, se todos forem ocultados
+	ocultos := 0
+	for _, ponto := range obterTodosOsPontos() {
+		if trajeto, ok := caminhos.ate(ponto.Latitude, ponto.Longitude); ok {
+			ponto.Distancia, ponto.TempoMin, ponto.Trajeto = trajeto.DistanciaKm, trajeto.TempoMin, trajetoViario
+		} else {
 			ponto.Distancia = calcularDistancia(
 				carro["latitude"].(float64),
 				carro["longitude"].(float64),
 				ponto.Latitude,
 				ponto.Longitude,
 			)
-			pontos = append(pontos, ponto)
+			ponto.Trajeto = trajetoLinhaReta
+		}
+		if informada {
+			alcance := autonomia.chegada(ponto.Distancia)
+			ponto.Alcance = &alcance
+			if somenteAlcancaveis && !alcance.Alcancavel {
+				ocultos++
+				continue
+			}
 		}
+		pontos = append(pontos, ponto)
 	}
 
 	// Ordenar pontos por distância (mais próximo primeiro)
@@ -140,6 +334,10 @@ func handleListarPontos(conn net.Conn, request Message) {
 			"pontos": pontos,
 		},
 	}
+	if informada {
+		response.Content["alcance_km"] = autonomia.alcance()
+		response.Content["ocultos"] = ocultos
+	}
 
 	sendResponse(conn, response)
 }
@@ -157,17 +355,25 @@ func handleReservarPonto(conn net.Conn, request Message) {
 		sendErrorResponse(conn, "Carro já está na fila")
 		return
 	}
-	// Encontrar o endereço do ponto desejado
-	var enderecoPonto string
-	for _, endereco := range pontosDeRecarga {
-		if strings.Contains(endereco, pontoID) {
-			enderecoPonto = endereco
-			break
+	if bloqueadoPorDivida(conn, carroID) {
+		return
+	}
+	// Cupom opcional, que vale para a próxima sessão do carro
+	cupom, _ := request.Content["cupom"].(string)
+	cupom = strings.ToUpper(strings.TrimSpace(cupom))
+	if cupom != "" {
+		razao.mu.Lock()
+		_, err := razao.validarCupomTravado(carroID, cupom, time.Now())
+		razao.mu.Unlock()
+		if err != nil {
+			sendErrorResponse(conn, err.Error())
+			return
 		}
 	}
-
+	// Encontrar o endereço do ponto desejado
+	enderecoPonto := enderecoDoPonto(pontoID)
 	if enderecoPonto == "" {
-		sendErrorResponse(conn, "Ponto de recarga não encontrado")
+		sendErrorResponse(conn, msgPontoNaoEncontrado)
 		return
 	}
 
@@ -202,10 +408,42 @@ func handleReservarPonto(conn net.Conn, request Message) {
 		return
 	}
 
+	if cupom != "" && respostaPonto.Action == "RESERVA_CONFIRMADA" {
+		if err := razao.reservarCupom(carroID, cupom); err == nil {
+			respostaPonto.Content["cupom"] = cupom
+		}
+	}
+
 	// Encaminhar resposta ao cliente
 	sendResponse(conn, respostaPonto)
 }
 
+// Desfaz a reserva de um carro que não vai mais ao ponto. O ponto não retira
+// da fila um carro que já está carregando.
+func handleDesistirReserva(conn net.Conn, content map[string]interface{}) {
+	carroID, _ := content["ID"].(string)
+	pontoID, _ := content["pontoID"].(string)
+	if carroID == "" {
+		sendErrorResponse(conn, "ID do carro não informado")
+		return
+	}
+	enderecoPonto := enderecoDoPonto(pontoID)
+	if enderecoPonto == "" {
+		sendErrorResponse(conn, msgPontoNaoEncontrado)
+		return
+	}
+
+	resposta, err := trocarMensagem(enderecoPonto, Message{
+		Action:  "DESISTIR_RESERVA",
+		Content: map[string]interface{}{"carroID": carroID},
+	}, timeoutTransacao)
+	if err != nil {
+		sendErrorResponse(conn, fmt.Sprintf("Erro ao comunicar com o ponto: %v", err))
+		return
+	}
+	sendResponse(conn, resposta)
+}
+
 func handleInicioCarregamento(conn net.Conn, request Message) {
 	fmt.Println("Cliente solicitou início de carregamento.")
 	carro := request.Content
@@ -213,15 +451,15 @@ func handleInicioCarregamento(conn net.Conn, request Message) {
 	pontoID := carro["pontoID"].(string)
 
 	// Buscar o endereço do ponto de recarga
-	var enderecoPonto string
-	for _, endereco := range pontosDeRecarga {
-		if strings.Contains(endereco, pontoID) {
-			enderecoPonto = endereco
-			break
-		}
-	}
+	enderecoPonto := enderecoDoPonto(pontoID)
 	if enderecoPonto == "" {
-		sendErrorResponse(conn, "Ponto de recarga não encontrado")
+		sendErrorResponse(conn, msgPontoNaoEncontrado)
+		return
+	}
+
+	limites, err := lerLimitesCarregamento(carro, pontoID)
+	if err != nil {
+		sendErrorResponse(conn, err.Error())
 		return
 	}
 
@@ -259,24 +497,107 @@ func handleInicioCarregamento(conn net.Conn, request Message) {
 		return
 	}
 
-	// Se for o primeiro, inicia o carregamento
-	carregamentoMutex.Lock()
-	defer carregamentoMutex.Unlock()
+	if err := razao.verificarCheckIn(carroID, pontoID); err != nil {
+		sendErrorResponse(conn, err.Error())
+		return
+	}
+
+	// A sessão é encerrada por custo máximo quando chega ao saldo da carteira
+	saldoMaximo, err := razao.verificarCarteiraParaInicio(carroID, pontoID)
+	if err != nil {
+		sendErrorResponse(conn, err.Error())
+		return
+	}
+	if saldoMaximo > 0 && (limites.CustoMaximo == 0 || saldoMaximo < limites.CustoMaximo) {
+		limites.CustoMaximo = saldoMaximo
+	}
 
-	if _, exists := carrosEmCarregamento[pontoID]; exists {
+	// Se for o primeiro, inicia o carregamento. O ponto fica marcado enquanto
+	// a sessão começa, para que as trocas de mensagens com os pontos não
+	// aconteçam com carregamentoMutex travado.
+	carregamentoMutex.Lock()
+	_, emUso := carrosEmCarregamento[pontoID]
+	if emUso || pontosIniciando[pontoID] {
+		carregamentoMutex.Unlock()
 		sendErrorResponse(conn, "Ponto já está em uso")
 		return
 	}
+	pontosIniciando[pontoID] = true
+	carregamentoMutex.Unlock()
+	defer func() {
+		carregamentoMutex.Lock()
+		delete(pontosIniciando, pontoID)
+		carregamentoMutex.Unlock()
+	}()
+
+	// O ponto passa a medir a sessão; o horário de início é o dele. A bateria
+	// informada pelo carro define a curva de carga usada na medição, e o ponto
+	// encerra a medição sozinho ao atingir o SOC alvo ou a energia máxima.
+	msgSessao := Message{
+		Action: "INICIAR_SESSAO",
+		Content: map[string]interface{}{
+			"carroID":         carroID,
+			"soc_alvo":        limites.SocAlvo,
+			"energia_max_kwh": limites.EnergiaMaxKWh,
+		},
+	}
+	for _, campo := range []string{"capacidade_kwh", "potencia_max_kw", "soc"} {
+		if valor, ok := carro[campo].(float64); ok {
+			msgSessao.Content[campo] = valor
+		}
+	}
+
+	// Em um site, a potência das outras sessões é reduzida antes de o ponto
+	// começar a entregar, e ele já começa na parte que coube ao carro
+	siteID, site := siteDoPonto(pontoID)
+	if site != nil {
+		demanda := lerFloat(carro, "potencia_max_kw", math.Inf(1))
+		msgSessao.Content["potencia_alocada_kw"] = site.reservarSessao(pontoID, carroID, demanda, razao.prioridadeDoCarro(carroID))
+	}
+
+	respostaSessao, err := trocarMensagem(enderecoPonto, msgSessao, timeoutTransacao)
+	if err == nil && respostaSessao.Action != "SESSAO_INICIADA" {
+		err = fmt.Errorf("%v", respostaSessao.Content["mensagem"])
+	}
+	if err != nil {
+		if site != nil {
+			site.encerrarSessao(pontoID, carroID)
+		}
+		sendErrorResponse(conn, fmt.Sprintf("Erro ao iniciar sessão no ponto: %v", err))
+		return
+	}
 
+	inicio, err := lerHorario(respostaSessao.Content, "inicio")
+	if err != nil {
+		inicio = time.Now()
+	}
+	potenciaAlocada := 0.0
+	if site != nil {
+		potenciaAlocada = site.confirmarSessao(pontoID, inicio, lerFloat(respostaSessao.Content, "potencia_max_kw", 0))
+	}
+	historicoID := razao.abrirSessao(carroID, pontoID, inicio)
+	carregamentoMutex.Lock()
 	carrosEmCarregamento[pontoID] = carroID
+	carregamentoMutex.Unlock()
+	iniciarMonitor(carroID, pontoID, historicoID, siteID, enderecoPonto, inicio, limites)
 
 	response := Message{
 		Action: "CARREGAMENTO_INICIADO",
 		Content: map[string]interface{}{
-			"pontoID": pontoID,
-			"carroID": carroID,
+			"pontoID":     pontoID,
+			"carroID":     carroID,
+			"historicoID": historicoID,
+			"inicio":      inicio,
+			"potencia_kw": respostaSessao.Content["potencia_kw"],
 		},
 	}
+	if site != nil {
+		response.Content["site"] = siteID
+		response.Content["potencia_alocada_kw"] = potenciaAlocada
+	}
+	if limites != (LimitesCarregamento{}) {
+		response.Content["limites"] = limites
+	}
 
 	fmt.Println("Carregamento iniciado:", pontoID, carroID)
 	sendResponse(conn, response)
@@ -287,122 +608,222 @@ func handleFimCarregamento(conn net.Conn, request Message) {
 	carro := request.Content
 	carroID := carro["ID"].(string)
 	pontoID := carro["pontoID"].(string)
-	tempo := carro["tempo"].(float64)
-	isCarregando := carro["isCarregando"].(bool)
-	if !isCarregando {
-		sendErrorResponse(conn, "Carro não está carregando")
-		return
+	sendResponse(conn, finalizarCarregamento(carroID, pontoID))
+}
+
+// Encerra a medição no ponto, libera a fila e fatura a sessão. Usada quando o
+// carro pede o fim e quando a sessão atinge um limite definido no início.
+func finalizarCarregamento(carroID, pontoID string) Message {
+	// O estado do carregamento é o registrado pelo servidor, não o informado pelo carro
+	carregamentoMutex.Lock()
+	currentCarID, exists := carrosEmCarregamento[pontoID]
+	carregamentoMutex.Unlock()
+	if !exists || currentCarID != carroID {
+		return mensagemErro("Carro não está carregando")
 	}
 
 	// Buscar o endereço do ponto de recarga
-	var enderecoPonto string
-	for _, endereco := range pontosDeRecarga {
-		if strings.Contains(endereco, pontoID) {
-			enderecoPonto = endereco
-			break
-		}
-	}
+	enderecoPonto := enderecoDoPonto(pontoID)
 	if enderecoPonto == "" {
-		sendErrorResponse(conn, "Ponto de recarga não encontrado")
-		return
+		return mensagemErro(msgPontoNaoEncontrado)
 	}
 
 	// Verificar com o ponto se o carro é o primeiro da fila
-	connPonto, err := net.Dial("tcp", enderecoPonto)
-	if err != nil {
-		sendErrorResponse(conn, fmt.Sprintf("Erro ao conectar ao ponto: %v", err))
-		return
-	}
-	defer connPonto.Close()
-
-	msgVerificacao := Message{
+	respostaVerificacao, err := trocarMensagem(enderecoPonto, Message{
 		Action: "VERIFICAR_PRIORIDADE",
 		Content: map[string]interface{}{
 			"carroID": carroID,
 		},
+	}, timeoutTransacao)
+	if err != nil {
+		return mensagemErro(fmt.Sprintf("Erro ao verificar prioridade no ponto: %v", err))
 	}
-	sendResponse(connPonto, msgVerificacao)
 
-	respostaStr, err := bufio.NewReader(connPonto).ReadString('\n')
+	// Encerrar a medição no ponto antes de liberar a fila
+	medicao, err := finalizarSessaoNoPonto(enderecoPonto, carroID)
 	if err != nil {
-		sendErrorResponse(conn, "Erro ao ler resposta do ponto (verificação de prioridade)")
-		return
+		return mensagemErro(fmt.Sprintf("Erro ao obter medição do ponto: %v", err))
 	}
 
-	var respostaVerificacao Message
-	if err := json.Unmarshal([]byte(respostaStr), &respostaVerificacao); err != nil {
-		sendErrorResponse(conn, "Resposta inválida do ponto (verificação de prioridade)")
-		return
+	// Com a medição em mãos, o ponto é liberado e a sessão faturada, mesmo
+	// que o encerramento da reserva abaixo falhe
+	carregamentoMutex.Lock()
+	if currentCarID, exists := carrosEmCarregamento[pontoID]; !exists || currentCarID != carroID {
+		carregamentoMutex.Unlock()
+		return mensagemErro("Carregamento não encontrado")
 	}
+	delete(carrosEmCarregamento, pontoID)
+	carregamentoMutex.Unlock()
 
-	// Se for o primeiro da fila, solicita encerramento da reserva
-	if respostaVerificacao.Action == "PRIMEIRO_DA_FILA" {
-		// Nova conexão para encerrar reserva
-		connPontoEncerrar, err := net.Dial("tcp", enderecoPonto)
-		if err != nil {
-			sendErrorResponse(conn, "Erro ao conectar ao ponto para encerrar reserva")
-			return
-		}
-		defer connPontoEncerrar.Close()
+	detalhe := tarifaDoPonto(pontoID).calcular(medicao.Inicio, medicao.Fim, medicao.EnergiaKWh, medicao.MinutosOciosos)
 
-		msgEncerrar := Message{
-			Action: "ENCERRAR_RESERVA",
-			Content: map[string]interface{}{
-				"carroID": carroID,
-			},
-		}
-		sendResponse(connPontoEncerrar, msgEncerrar)
+	// A potência liberada passa para as outras sessões do site
+	if _, site := siteDoPonto(pontoID); site != nil {
+		go site.encerrarSessao(pontoID, carroID)
 	}
 
-	// Atualiza registro do carregamento
-	carregamentoMutex.Lock()
-	defer carregamentoMutex.Unlock()
-
-	if currentCarID, exists := carrosEmCarregamento[pontoID]; !exists || currentCarID != carroID {
-		sendErrorResponse(conn, "Carregamento não encontrado")
-		return
+	// Se for o primeiro da fila, solicita encerramento da reserva
+	if respostaVerificacao.Action == "PRIMEIRO_DA_FILA" {
+		encerrarReservaNoPonto(enderecoPonto, carroID)
 	}
 
-	valor := calcularValorConta(tempo)
-	delete(carrosEmCarregamento, pontoID)
+	sessao, err := razao.finalizarSessao(carroID, pontoID, medicao, detalhe)
+	if err != nil {
+		return mensagemErro(err.Error())
+	}
+	descontos := razao.aplicarBeneficios(sessao.ID)
+	debitado, pendente := razao.debitarCarteira(sessao.ID)
 
 	response := Message{
 		Action: "CARREGAMENTO_FINALIZADO",
 		Content: map[string]interface{}{
-			"valor": valor,
+			"historicoID":       sessao.ID,
+			"recibo":            sessao.Recibo,
+			"valor":             detalhe.Total - somaDescontos(descontos),
+			"valor_bruto":       detalhe.Total,
+			"descontos":         descontos,
+			"detalhamento":      detalhe,
+			"inicio":            medicao.Inicio,
+			"fim":               medicao.Fim,
+			"duracao_segundos":  medicao.Fim.Sub(medicao.Inicio).Seconds(),
+			"energia_kwh":       medicao.EnergiaKWh,
+			"debitado_carteira": debitado,
+			"valor_pendente":    pendente,
+			"moeda":             moeda,
 		},
 	}
+	if medicao.SocFinal > 0 {
+		response.Content["soc_inicial"] = medicao.SocInicial
+		response.Content["soc_final"] = medicao.SocFinal
+	}
+	if medicao.Motivo != "" {
+		response.Content["motivo"] = medicao.Motivo
+	}
+	if medicao.MinutosOciosos > 0 {
+		response.Content["minutos_ociosos"] = medicao.MinutosOciosos
+	}
 
 	fmt.Println(response)
-	sendResponse(conn, response)
+	return response
 }
 
-func obterInformacoesPonto(endereco string) PontoRecarga {
-	conn, err := net.Dial("tcp", endereco)
+// Medição de uma sessão feita pelo ponto de recarga
+type MedicaoSessao struct {
+	Inicio     time.Time `json:"inicio"`
+	Fim        time.Time `json:"fim"`
+	EnergiaKWh float64   `json:"energia_kwh"`
+	// Estado de carga (%) calculado pelo ponto; zero se o carro não informou a bateria
+	SocInicial float64 `json:"soc_inicial,omitempty"`
+	SocFinal   float64 `json:"soc_final,omitempty"`
+	// Limite que encerrou a sessão no ponto; vazio se o carro pediu o fim
+	Motivo string `json:"motivo,omitempty"`
+	// Tempo conectado depois do limite ou da bateria cheia, cobrado como ociosidade
+	MinutosOciosos float64 `json:"minutos_ociosos,omitempty"`
+}
+
+// Retira o carro da fila do ponto. Uma falha só é registrada: a sessão já
+// foi faturada, e o carro pode ser removido da fila depois.
+func encerrarReservaNoPonto(enderecoPonto, carroID string) {
+	resposta, err := trocarMensagem(enderecoPonto, Message{
+		Action: "ENCERRAR_RESERVA",
+		Content: map[string]interface{}{
+			"carroID": carroID,
+		},
+	}, timeoutTransacao)
 	if err != nil {
-		fmt.Printf("Erro ao conectar ao ponto %s: %v\n", endereco, err)
-		return PontoRecarga{}
+		fmt.Printf("Erro ao encerrar a reserva do carro %s no ponto %s: %v\n", carroID, enderecoPonto, err)
+		return
 	}
-	defer conn.Close()
-
-	// Enviar comando LISTAR_PONTOS como JSON
-	msg := Message{
-		Action:  "LISTAR_PONTOS",
-		Content: map[string]interface{}{},
+	if sucesso, _ := resposta.Content["sucesso"].(bool); !sucesso {
+		fmt.Printf("Reserva do carro %s não encerrada no ponto %s: %v\n", carroID, enderecoPonto, resposta.Content["mensagem"])
 	}
-	sendResponse(conn, msg)
+}
 
-	// Ler resposta
-	response, err := bufio.NewReader(conn).ReadString('\n')
+// Pede ao ponto que encerre a sessão do carro e devolva os valores medidos
+func finalizarSessaoNoPonto(enderecoPonto, carroID string) (MedicaoSessao, error) {
+	resposta, err := trocarMensagem(enderecoPonto, Message{
+		Action:  "FINALIZAR_SESSAO",
+		Content: map[string]interface{}{"carroID": carroID},
+	}, timeoutTransacao)
 	if err != nil {
-		fmt.Printf("Erro ao ler resposta do ponto %s: %v\n", endereco, err)
-		return PontoRecarga{}
+		return MedicaoSessao{}, err
+	}
+	if resposta.Action != "SESSAO_FINALIZADA" {
+		return MedicaoSessao{}, fmt.Errorf("%v", resposta.Content["mensagem"])
+	}
+
+	inicio, errInicio := lerHorario(resposta.Content, "inicio")
+	fim, errFim := lerHorario(resposta.Content, "fim")
+	energia, okEnergia := resposta.Content["energia_kwh"].(float64)
+	motivo, _ := resposta.Content["motivo"].(string)
+	if errInicio != nil || errFim != nil || !okEnergia {
+		return MedicaoSessao{}, fmt.Errorf("medição inválida")
+	}
+	return MedicaoSessao{
+		Inicio:         inicio,
+		Fim:            fim,
+		EnergiaKWh:     energia,
+		SocInicial:     lerFloat(resposta.Content, "soc_inicial", 0),
+		SocFinal:       lerFloat(resposta.Content, "soc_final", 0),
+		Motivo:         motivo,
+		MinutosOciosos: lerFloat(resposta.Content, "ocioso_segundos", 0) / 60,
+	}, nil
+}
+
+// Encontra o endereço de um ponto de recarga gerenciado por este servidor.
+// O ID do ponto é o próprio endereço, então a comparação é exata: um ID
+// parcial como "charger" não pode casar com "charger2:6002".
+func enderecoDoPonto(pontoID string) string {
+	if pontoID == "" {
+		return ""
 	}
+	for _, endereco := range enderecosDosPontos() {
+		if endereco == pontoID {
+			return endereco
+		}
+	}
+	return ""
+}
 
-	// Decodificar resposta JSON
-	var msgResp Message
-	if err := json.Unmarshal([]byte(response), &msgResp); err != nil {
-		fmt.Printf("Resposta inválida do ponto %s: %v\n", endereco, err)
+// Consulta todos os pontos de recarga conhecidos, ignorando os que não responderem
+func obterTodosOsPontos() []PontoRecarga {
+	var pontos []PontoRecarga
+	for _, ponto := range consultarPontos(enderecosDosPontos()) {
+		if ponto.ID != "" { // Verifica se obteve resposta válida
+			pontos = append(pontos, ponto)
+		}
+	}
+	return pontos
+}
+
+// Consulta os pontos em paralelo, até consultasSimultaneas por vez. O
+// resultado segue a ordem dos endereços, vazio para quem não respondeu.
+func consultarPontos(enderecos []string) []PontoRecarga {
+	pontos := make([]PontoRecarga, len(enderecos))
+	vagas := make(chan struct{}, consultasSimultaneas)
+	var wg sync.WaitGroup
+	for i, endereco := range enderecos {
+		wg.Add(1)
+		vagas <- struct{}{}
+		go func(i int, endereco string) {
+			defer wg.Done()
+			defer func() { <-vagas }()
+			pontos[i] = obterInformacoesPonto(endereco)
+		}(i, endereco)
+	}
+	wg.Wait()
+	return pontos
+}
+
+func obterInformacoesPonto(endereco string) PontoRecarga {
+	// Enviar comando LISTAR_PONTOS como JSON; um ponto lento ou mudo não
+	// segura a consulta além de timeoutConsultaPonto
+	msgResp, err := trocarMensagem(endereco, Message{
+		Action:  "LISTAR_PONTOS",
+		Content: map[string]interface{}{},
+	}, timeoutConsultaPonto)
+	if err != nil {
+		fmt.Printf("Erro ao consultar o ponto %s: %v\n", endereco, err)
 		return PontoRecarga{}
 	}
 
@@ -411,17 +832,40 @@ func obterInformacoesPonto(endereco string) PontoRecarga {
 		return PontoRecarga{}
 	}
 
+	id, okID := msgResp.Content["ID"].(string)
+	latitude, okLat := msgResp.Content["latitude"].(float64)
+	longitude, okLon := msgResp.Content["longitude"].(float64)
+	if !okID || !okLat || !okLon || id == "" {
+		fmt.Printf("Resposta incompleta do ponto %s: %v\n", endereco, msgResp.Content)
+		return PontoRecarga{}
+	}
+
 	content := msgResp.Content
 	fila := convertInterfaceToStringSlice(content["fila"])
 	tamanhoFila := len(fila)
 	fmt.Println("Fila do ponto de recarga:", tamanhoFila)
-	return PontoRecarga{
-		ID:          content["ID"].(string),
-		Latitude:    content["latitude"].(float64),
-		Longitude:   content["longitude"].(float64),
+	ponto := PontoRecarga{
+		ID:          id,
+		Latitude:    latitude,
+		Longitude:   longitude,
 		Fila:        fila,
 		TamanhoFila: tamanhoFila,
-	}
+		PotenciaKW:  lerFloat(content, "potencia_kw", potenciaPadraoKW),
+		Tarifa:      tarifaDoPonto(id),
+	}
+	// Dados cadastrais opcionais, informados pelos pontos configurados
+	ponto.Nome, _ = content["nome"].(string)
+	ponto.Endereco, _ = content["endereco"].(string)
+	if conectores, ok := content["conectores"]; ok {
+		ponto.Conectores = convertInterfaceToStringSlice(conectores)
+	}
+	ponto.Metadados, _ = content["metadados"].(map[string]interface{})
+	catalogo.aplicar(&ponto)
+	if siteID, site := siteDoPonto(ponto.ID); site != nil {
+		ponto.Site = siteID
+		ponto.PotenciaKW = math.Min(ponto.PotenciaKW, site.potenciaParaNovaSessao(ponto.ID))
+	}
+	return ponto
 }
 func convertInterfaceToStringSlice(data interface{}) []string {
 	if data == nil {
@@ -447,6 +891,23 @@ func convertInterfaceToStringSlice(data interface{}) []string {
 	return result
 }
 
+// Lê um campo numérico opcional do conteúdo da mensagem
+func lerFloat(content map[string]interface{}, chave string, padrao float64) float64 {
+	if valor, ok := content[chave].(float64); ok {
+		return valor
+	}
+	return padrao
+}
+
+// Lê um horário enviado em JSON no formato RFC 3339
+func lerHorario(content map[string]interface{}, chave string) (time.Time, error) {
+	texto, ok := content[chave].(string)
+	if !ok {
+		return time.Time{}, fmt.Errorf("campo %s ausente", chave)
+	}
+	return time.Parse(time.RFC3339Nano, texto)
+}
+
 func calcularDistancia(lat1, lon1, lat2, lon2 float64) float64 {
 	const R = 6371 // Raio da Terra em km
 	dLat := (lat2 - lat1) * (math.Pi / 180)
@@ -460,10 +921,6 @@ func calcularDistancia(lat1, lon1, lat2, lon2 float64) float64 {
 	return R * c
 }
 
-func calcularValorConta(tempoDecorrido float64) float64 {
-	return tempoDecorrido * 0.5
-}
-
 func sendResponse(conn net.Conn, response Message) {
 	jsonResponse, err := json.Marshal(response)
 	if err != nil {
@@ -473,12 +930,52 @@ func sendResponse(conn net.Conn, response Message) {
 	fmt.Fprintln(conn, string(jsonResponse))
 }
 
+// Envia uma mensagem a outro nó e aguarda uma única resposta dentro do prazo
+func trocarMensagem(endereco string, msg Message, timeout time.Duration) (Message, error) {
+	conn, err := net.DialTimeout("tcp", endereco, timeout)
+	if err != nil {
+		return Message{}, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	sendResponse(conn, msg)
+	linha, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return Message{}, err
+	}
+
+	var resposta Message
+	if err := json.Unmarshal([]byte(linha), &resposta); err != nil {
+		return Message{}, err
+	}
+	return resposta, nil
+}
+
+// Lê uma lista separada por vírgulas de uma variável de ambiente
+func lerListaEnv(nome string, padrao []string) []string {
+	valor := strings.TrimSpace(os.Getenv(nome))
+	if valor == "" {
+		return padrao
+	}
+	var lista []string
+	for _, item := range strings.Split(valor, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			lista = append(lista, item)
+		}
+	}
+	return lista
+}
+
 func sendErrorResponse(conn net.Conn, message string) {
-	response := Message{
+	sendResponse(conn, mensagemErro(message))
+}
+
+func mensagemErro(message string) Message {
+	return Message{
 		Action: "ERRO",
 		Content: map[string]interface{}{
 			"mensagem": message,
 		},
 	}
-	sendResponse(conn, response)
 }
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Estratégias de divisão da potência do site entre as sessões em andamento
+const (
+	estrategiaIgual        = "IGUAL"         // Partes iguais
+	estrategiaPrioridade   = "PRIORIDADE"    // Partes proporcionais à prioridade do plano do carro
+	estrategiaOrdemChegada = "ORDEM_CHEGADA" // Quem começou antes recebe tudo o que aceita
+)
+
+// Diferença mínima (kW) para que uma nova alocação seja enviada ao ponto
+const toleranciaAlocacao = 0.01
+
+// Site: pontos de recarga que dividem a mesma ligação à rede, com potência
+// máxima somada. O servidor distribui essa potência entre as sessões ativas.
+type Site struct {
+	Nome          string   `json:"nome"`
+	PotenciaMaxKW float64  `json:"potencia_max_kw"`
+	Estrategia    string   `json:"estrategia"`
+	Pontos        []string `json:"pontos"`
+
+	// Protege as sessões. As mensagens aos pontos são trocadas sem ele, para
+	// que um ponto lento não trave o início e o fim das sessões do site.
+	mu      sync.Mutex
+	sessoes map[string]*sessaoSite // pontoID -> sessão em andamento
+}
+
+// Sessão em andamento em um ponto do site
+type sessaoSite struct {
+	carroID   string
+	inicio    time.Time
+	demandaKW float64 // Potência máxima que a sessão aceita
+	peso      float64
+	iniciando bool // Reservando a potência com que vai começar no ponto
+
+	alocadaKW  float64 // Última potência aceita pelo ponto
+	desejadaKW float64 // Última potência planejada; um aumento fica reservado até a resposta
+
+	envio sync.Mutex // Mantém na ordem as mensagens enviadas ao ponto
+}
+
+// Potência que a sessão pode estar usando: a aceita pelo ponto ou, durante
+// um aumento, a que foi pedida
+func (sessao *sessaoSite) ocupadaKW() float64 {
+	return math.Max(sessao.alocadaKW, sessao.desejadaKW)
+}
+
+type ConfiguracaoSites struct {
+	Sites map[string]*Site `json:"sites"` // ID -> site
+}
+
+var sites = carregarSites(os.Getenv("SITES_ARQUIVO"))
+
+// Lê a configuração de sites do arquivo JSON; sem ela cada ponto é independente
+func carregarSites(caminho string) ConfiguracaoSites {
+	if caminho == "" {
+		caminho = "sites.json"
+	}
+	config := ConfiguracaoSites{Sites: make(map[string]*Site)}
+
+	dados, err := os.ReadFile(caminho)
+	if err != nil {
+		fmt.Printf("Arquivo de sites %s não encontrado, pontos sem limite de site\n", caminho)
+		return config
+	}
+	if err := json.Unmarshal(dados, &config); err != nil {
+		fmt.Printf("Erro ao ler sites de %s: %v. Pontos sem limite de site\n", caminho, err)
+		return ConfiguracaoSites{Sites: make(map[string]*Site)}
+	}
+	for id, site := range config.Sites {
+		if site.PotenciaMaxKW <= 0 {
+			fmt.Printf("Site %s sem potência máxima, ignorado\n", id)
+			delete(config.Sites, id)
+			continue
+		}
+		switch site.Estrategia {
+		case estrategiaIgual, estrategiaPrioridade, estrategiaOrdemChegada:
+		case "":
+			site.Estrategia = estrategiaIgual
+		default:
+			fmt.Printf("Estratégia %q do site %s desconhecida, usando %s\n", site.Estrategia, id, estrategiaIgual)
+			site.Estrategia = estrategiaIgual
+		}
+		site.sessoes = make(map[string]*sessaoSite)
+	}
+	fmt.Printf("Sites carregados de %s (%d sites)\n", caminho, len(config.Sites))
+	return config
+}
+
+// Site ao qual o ponto pertence; vazio e nil se o ponto for independente
+func siteDoPonto(pontoID string) (string, *Site) {
+	for id, site := range sites.Sites {
+		for _, ponto := range site.Pontos {
+			if ponto == pontoID {
+				return id, site
+			}
+		}
+	}
+	return "", nil
+}
+
+// Divide a potência do site entre as sessões conforme a estratégia. Deve ser
+// chamada com s.mu travado.
+func (s *Site) distribuirTravado() map[string]float64 {
+	alocacao := make(map[string]float64)
+	restante := s.PotenciaMaxKW
+
+	if s.Estrategia == estrategiaOrdemChegada {
+		for _, pontoID := range s.pontosPorChegadaTravado() {
+			alocacao[pontoID] = math.Min(s.sessoes[pontoID].demandaKW, restante)
+			restante -= alocacao[pontoID]
+		}
+		return alocacao
+	}
+
+	// Partes proporcionais ao peso; a sobra de quem aceita menos que a sua
+	// parte é redistribuída entre os demais
+	pendentes := make(map[string]*sessaoSite)
+	for pontoID, sessao := range s.sessoes {
+		pendentes[pontoID] = sessao
+	}
+	for len(pendentes) > 0 {
+		pesoTotal := 0.0
+		for _, sessao := range pendentes {
+			pesoTotal += s.pesoDe(sessao)
+		}
+		saturou := false
+		for pontoID, sessao := range pendentes {
+			if parte := restante * s.pesoDe(sessao) / pesoTotal; sessao.demandaKW <= parte {
+				alocacao[pontoID] = sessao.demandaKW
+				restante -= sessao.demandaKW
+				delete(pendentes, pontoID)
+				saturou = true
+			}
+		}
+		if !saturou {
+			for pontoID, sessao := range pendentes {
+				alocacao[pontoID] = restante * s.pesoDe(sessao) / pesoTotal
+			}
+			break
+		}
+	}
+	return alocacao
+}
+
+func (s *Site) pesoDe(sessao *sessaoSite) float64 {
+	if s.Estrategia == estrategiaPrioridade {
+		return sessao.peso
+	}
+	return 1
+}
+
+// Envia aos pontos a nova divisão da potência, reduzindo as sessões antes de
+// aumentar as outras para não passar do limite do site. Um ponto que recusa
+// a redução continua contado com a potência anterior, e os aumentos ficam
+// limitados ao que sobrou de fato. s.mu é travado só para planejar e
+// registrar as respostas, nunca durante as mensagens.
+func (s *Site) redistribuir() {
+	s.mu.Lock()
+	reducoes := s.reducoesTravado()
+	s.mu.Unlock()
+	s.limitarPontos(reducoes)
+
+	s.mu.Lock()
+	aumentos := s.aumentosTravado()
+	s.mu.Unlock()
+	s.limitarPontos(aumentos)
+}
+
+// Parte de cada sessão na divisão atual, limitada ao que ela aceita. Deve ser
+// chamada com s.mu travado.
+func (s *Site) alvoTravado() map[string]float64 {
+	alvo := s.distribuirTravado()
+	for pontoID, kw := range alvo {
+		// Acima da demanda a alocação não muda o que o ponto entrega
+		alvo[pontoID] = math.Min(kw, s.sessoes[pontoID].demandaKW)
+	}
+	return alvo
+}
+
+// Sessões que devem receber menos potência. Deve ser chamada com s.mu travado.
+func (s *Site) reducoesTravado() map[string]float64 {
+	reducoes := make(map[string]float64)
+	for pontoID, kw := range s.alvoTravado() {
+		sessao := s.sessoes[pontoID]
+		if !sessao.iniciando && sessao.ocupadaKW()-kw >= toleranciaAlocacao {
+			sessao.desejadaKW = kw
+			reducoes[pontoID] = kw
+		}
+	}
+	return reducoes
+}
+
+// Distribui a potência livre: primeiro às sessões que vão começar, que a
+// recebem direto em INICIAR_SESSAO, e depois aos aumentos, por ordem de
+// chegada. Os aumentos ficam reservados até o ponto responder. Deve ser
+// chamada com s.mu travado.
+func (s *Site) aumentosTravado() map[string]float64 {
+	alvo := s.alvoTravado()
+	livre := s.PotenciaMaxKW
+	for _, sessao := range s.sessoes {
+		livre -= sessao.ocupadaKW()
+	}
+
+	pontos := s.pontosPorChegadaTravado()
+	for _, pontoID := range pontos {
+		if sessao := s.sessoes[pontoID]; sessao.iniciando {
+			kw := math.Max(0, math.Min(alvo[pontoID], sessao.alocadaKW+livre))
+			livre -= kw - sessao.alocadaKW
+			sessao.alocadaKW, sessao.desejadaKW = kw, kw
+		}
+	}
+
+	aumentos := make(map[string]float64)
+	for _, pontoID := range pontos {
+		sessao := s.sessoes[pontoID]
+		if sessao.iniciando {
+			continue
+		}
+		kw := math.Min(alvo[pontoID], sessao.ocupadaKW()+math.Max(0, livre))
+		if kw-sessao.ocupadaKW() < toleranciaAlocacao {
+			if sessao.desejadaKW < sessao.alocadaKW && kw >= sessao.alocadaKW-toleranciaAlocacao {
+				sessao.desejadaKW = sessao.alocadaKW // Redução pendente que deixou de ser necessária
+			}
+			continue
+		}
+		livre -= kw - sessao.ocupadaKW()
+		sessao.desejadaKW = kw
+		aumentos[pontoID] = kw
+	}
+	return aumentos
+}
+
+// Envia as novas potências aos pontos ao mesmo tempo e registra as aceitas.
+// As mensagens a um mesmo ponto saem uma de cada vez, e cada uma leva a
+// potência planejada mais recente.
+func (s *Site) limitarPontos(potencias map[string]float64) {
+	var wg sync.WaitGroup
+	for pontoID := range potencias {
+		s.mu.Lock()
+		sessao := s.sessoes[pontoID]
+		s.mu.Unlock()
+		if sessao == nil {
+			continue
+		}
+
+		wg.Add(1)
+		go func(pontoID string, sessao *sessaoSite) {
+			defer wg.Done()
+			sessao.envio.Lock()
+			defer sessao.envio.Unlock()
+
+			s.mu.Lock()
+			kw := sessao.desejadaKW
+			atual := s.sessoes[pontoID] == sessao && math.Abs(kw-sessao.alocadaKW) >= toleranciaAlocacao
+			s.mu.Unlock()
+			if !atual {
+				return // Sessão encerrada ou já na potência pedida
+			}
+
+			err := limitarPotenciaNoPonto(pontoID, sessao.carroID, kw)
+
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if err != nil {
+				fmt.Printf("Erro ao limitar a potência do ponto %s: %v\n", pontoID, err)
+				if sessao.desejadaKW == kw && kw > sessao.alocadaKW {
+					sessao.desejadaKW = sessao.alocadaKW // Libera o aumento reservado
+				}
+				return
+			}
+			sessao.alocadaKW = kw
+		}(pontoID, sessao)
+	}
+	wg.Wait()
+}
+
+// Pontos com sessão, de quem começou antes para quem começou depois. Deve
+// ser chamada com s.mu travado.
+func (s *Site) pontosPorChegadaTravado() []string {
+	pontos := make([]string, 0, len(s.sessoes))
+	for pontoID := range s.sessoes {
+		pontos = append(pontos, pontoID)
+	}
+	sort.Slice(pontos, func(i, j int) bool {
+		return s.sessoes[pontos[i]].inicio.Before(s.sessoes[pontos[j]].inicio)
+	})
+	return pontos
+}
+
+// Registra a sessão que vai começar, reduz as outras e devolve quanto o
+// ponto pode entregar ao iniciar. Se alguma redução falhar, a sessão recebe
+// só o que sobrou, que pode ser 0 kW.
+func (s *Site) reservarSessao(pontoID, carroID string, demandaKW, peso float64) float64 {
+	s.mu.Lock()
+	sessao := &sessaoSite{
+		carroID:   carroID,
+		inicio:    time.Now(),
+		demandaKW: demandaKW,
+		peso:      peso,
+		iniciando: true,
+	}
+	s.sessoes[pontoID] = sessao
+	s.mu.Unlock()
+
+	s.redistribuir()
+
+	// A partir daqui a potência inicial está decidida e segue em
+	// INICIAR_SESSAO; mudanças posteriores vão por LIMITAR_POTENCIA
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sessao.iniciando = false
+	alvo := s.alvoTravado()[pontoID]
+	if sessao.alocadaKW < alvo-toleranciaAlocacao {
+		fmt.Printf("Sessão no ponto %s começa com %.1f kW: a potência das outras sessões não foi reduzida\n", pontoID, sessao.alocadaKW)
+	}
+	return sessao.alocadaKW
+}
+
+// Atualiza a sessão com o que o ponto informou ao iniciá-la e devolve a
+// potência com que ela começou. A redistribuição que pode aumentá-la segue
+// em segundo plano.
+func (s *Site) confirmarSessao(pontoID string, inicio time.Time, potenciaMaxKW float64) float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sessao := s.sessoes[pontoID]
+	sessao.inicio = inicio
+	if potenciaMaxKW > 0 {
+		sessao.demandaKW = potenciaMaxKW
+		// O ponto já entrega no máximo a própria potência
+		sessao.alocadaKW = math.Min(sessao.alocadaKW, potenciaMaxKW)
+		sessao.desejadaKW = sessao.alocadaKW
+	}
+	go s.redistribuir()
+	return sessao.alocadaKW
+}
+
+// Retira a sessão do carro e redistribui a potência entre as restantes
+func (s *Site) encerrarSessao(pontoID, carroID string) {
+	s.mu.Lock()
+	sessao, existe := s.sessoes[pontoID]
+	if !existe || sessao.carroID != carroID {
+		s.mu.Unlock()
+		return
+	}
+	delete(s.sessoes, pontoID)
+	s.mu.Unlock()
+
+	s.redistribuir()
+}
+
+// Potência que um carro que começasse a carregar agora no ponto receberia
+func (s *Site) potenciaParaNovaSessao(pontoID string) float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	anterior, ocupado := s.sessoes[pontoID]
+	s.sessoes[pontoID] = &sessaoSite{inicio: time.Now(), demandaKW: math.Inf(1), peso: 1}
+	potencia := s.distribuirTravado()[pontoID]
+	if ocupado {
+		s.sessoes[pontoID] = anterior
+	} else {
+		delete(s.sessoes, pontoID)
+	}
+	return potencia
+}
+
+// Pede ao ponto que passe a entregar no máximo a potência alocada
+func limitarPotenciaNoPonto(pontoID, carroID string, kw float64) error {
+	enderecoPonto := enderecoDoPonto(pontoID)
+	if enderecoPonto == "" {
+		return fmt.Errorf(msgPontoNaoEncontrado)
+	}
+	resposta, err := trocarMensagem(enderecoPonto, Message{
+		Action:  "LIMITAR_POTENCIA",
+		Content: map[string]interface{}{"carroID": carroID, "potencia_kw": kw},
+	}, timeoutTransacao)
+	if err != nil {
+		return err
+	}
+	if resposta.Action != "POTENCIA_LIMITADA" {
+		return fmt.Errorf("%v", resposta.Content["mensagem"])
+	}
+	fmt.Printf("Ponto %s limitado a %.1f kW\n", pontoID, kw)
+	return nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"time"
+)
+
+// Tarifa aplicada a uma sessão de carregamento. Os componentes são somados:
+// taxa fixa por sessão, preço por kWh, preço por minuto conectado e multa
+// por minuto ocioso após o fim da recarga.
+type Tarifa struct {
+	Nome                 string         `json:"nome"`
+	TaxaSessao           float64        `json:"taxa_sessao"`
+	PrecoKWh             float64        `json:"preco_kwh"`
+	PrecoMinuto          float64        `json:"preco_minuto"`
+	Faixas               []FaixaHorario `json:"faixas,omitempty"`
+	TaxaOciosidade       float64        `json:"taxa_ociosidade_minuto"`
+	ToleranciaOciosidade float64        `json:"tolerancia_ociosidade_minutos"`
+	AliquotaImpostos     float64        `json:"aliquota_impostos"`        // Percentual de tributos já incluso nos preços
+	Arredondamento       string         `json:"arredondamento,omitempty"` // Regra aplicada a cada componente da conta
+}
+
+// Faixa de horário de uso ("HH:MM"), com multiplicador sobre energia e tempo.
+// Faixas que terminam antes de começar atravessam a meia-noite.
+type FaixaHorario struct {
+	Inicio        string  `json:"inicio"`
+	Fim           string  `json:"fim"`
+	Multiplicador float64 `json:"multiplicador"`
+}
+
+type ConfiguracaoTarifas struct {
+	Padrao Tarifa            `json:"padrao"`
+	Pontos map[string]Tarifa `json:"pontos"` // pontoID -> tarifa específica
+}
+
+// Valores que compõem a conta de uma sessão
+type DetalheCobranca struct {
+	Tarifa     string   `json:"tarifa"`
+	TaxaSessao Dinheiro `json:"taxa_sessao"`
+	Energia    Dinheiro `json:"energia"`
+	Tempo      Dinheiro `json:"tempo"`
+	Ociosidade Dinheiro `json:"ociosidade"`
+	Total      Dinheiro `json:"total"`
+	Impostos   Dinheiro `json:"impostos"` // Parcela do total referente a tributos
+	Moeda      string   `json:"moeda"`
+}
+
+// Equivalente à antiga cobrança fixa de 0,5 por segundo
+var tarifaPadrao = Tarifa{Nome: "Padrão", PrecoMinuto: 30}
+
+var tarifas = carregarTarifas(os.Getenv("TARIFAS_ARQUIVO"))
+
+// Lê a configuração de tarifas do arquivo JSON, usando a tarifa padrão se ele não existir
+func carregarTarifas(caminho string) ConfiguracaoTarifas {
+	if caminho == "" {
+		caminho = "tarifas.json"
+	}
+	config := ConfiguracaoTarifas{Padrao: tarifaPadrao}
+
+	dados, err := os.ReadFile(caminho)
+	if err != nil {
+		fmt.Printf("Arquivo de tarifas %s não encontrado, usando tarifa padrão\n", caminho)
+		return config
+	}
+	if err := json.Unmarshal(dados, &config); err != nil {
+		fmt.Printf("Erro ao ler tarifas de %s: %v. Usando tarifa padrão\n", caminho, err)
+		return ConfiguracaoTarifas{Padrao: tarifaPadrao}
+	}
+	fmt.Printf("Tarifas carregadas de %s (%d pontos com tarifa própria)\n", caminho, len(config.Pontos))
+	return config
+}
+
+// Tarifa do ponto: a do catálogo, se houver, ou a do arquivo de tarifas
+func tarifaDoPonto(pontoID string) Tarifa {
+	if tarifa, ok := catalogo.tarifa(pontoID); ok {
+		return tarifa
+	}
+	return tarifaConfigurada(pontoID)
+}
+
+func tarifaConfigurada(pontoID string) Tarifa {
+	if tarifa, ok := tarifas.Pontos[pontoID]; ok {
+		return tarifa
+	}
+	return tarifas.Padrao
+}
+
+// Calcula a conta de uma sessão. A energia é considerada distribuída
+// uniformemente no tempo, para que cada minuto receba o multiplicador da
+// faixa de horário em que ocorreu. Cada componente é arredondado pela regra
+// da tarifa, e o total é a soma exata dos componentes arredondados.
+func (t Tarifa) calcular(inicio, fim time.Time, energiaKWh, minutosOciosos float64) DetalheCobranca {
+	var energia, tempo, ociosidade float64
+
+	duracao := fim.Sub(inicio)
+	if duracao > 0 {
+		energiaPorMinuto := energiaKWh / duracao.Minutes()
+		for instante := inicio; instante.Before(fim); instante = instante.Add(time.Minute) {
+			minutos := math.Min(1, fim.Sub(instante).Minutes())
+			multiplicador := t.multiplicador(instante)
+			energia += energiaPorMinuto * minutos * t.PrecoKWh * multiplicador
+			tempo += minutos * t.PrecoMinuto * multiplicador
+		}
+	}
+
+	if minutosOciosos > t.ToleranciaOciosidade {
+		ociosidade = (minutosOciosos - t.ToleranciaOciosidade) * t.TaxaOciosidade
+	}
+
+	detalhe := DetalheCobranca{
+		Tarifa:     t.Nome,
+		TaxaSessao: dinheiroDeFloat(t.TaxaSessao, t.Arredondamento),
+		Energia:    dinheiroDeFloat(energia, t.Arredondamento),
+		Tempo:      dinheiroDeFloat(tempo, t.Arredondamento),
+		Ociosidade: dinheiroDeFloat(ociosidade, t.Arredondamento),
+		Moeda:      moeda,
+	}
+	detalhe.Total = detalhe.TaxaSessao + detalhe.Energia + detalhe.Tempo + detalhe.Ociosidade
+
+	// Tributos inclusos são informativos e não alteram o total
+	detalhe.Impostos = Dinheiro(math.Round(float64(detalhe.Total) * t.AliquotaImpostos / 100))
+	return detalhe
+}
+
+func (t Tarifa) multiplicador(instante time.Time) float64 {
+	minutoDoDia := instante.Hour()*60 + instante.Minute()
+	for _, faixa := range t.Faixas {
+		inicio, errInicio := minutoDoDiaHHMM(faixa.Inicio)
+		fim, errFim := minutoDoDiaHHMM(faixa.Fim)
+		if errInicio != nil || errFim != nil {
+			continue
+		}
+		dentro := minutoDoDia >= inicio && minutoDoDia < fim
+		if fim <= inicio {
+			dentro = minutoDoDia >= inicio || minutoDoDia < fim
+		}
+		if dentro {
+			return faixa.Multiplicador
+		}
+	}
+	return 1
+}
+
+func minutoDoDiaHHMM(horario string) (int, error) {
+	hora, err := time.Parse("15:04", horario)
+	if err != nil {
+		return 0, err
+	}
+	return hora.Hour()*60 + hora.Minute(), nil
+}
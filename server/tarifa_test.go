@@ -0,0 +1,117 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTarifaCalcular(t *testing.T) {
+	horario := func(hora, minuto int) time.Time {
+		return time.Date(2024, 3, 10, hora, minuto, 0, 0, time.UTC)
+	}
+	pico := []FaixaHorario{{Inicio: "18:00", Fim: "21:00", Multiplicador: 1.5}}
+	madrugada := []FaixaHorario{{Inicio: "22:00", Fim: "06:00", Multiplicador: 0.5}}
+
+	casos := []struct {
+		nome     string
+		tarifa   Tarifa
+		inicio   time.Time
+		fim      time.Time
+		energia  float64
+		ociosos  float64
+		esperado DetalheCobranca
+	}{
+		{
+			nome:     "só tempo",
+			tarifa:   Tarifa{PrecoMinuto: 0.5},
+			inicio:   horario(10, 0),
+			fim:      horario(10, 10),
+			esperado: DetalheCobranca{Tempo: 500, Total: 500},
+		},
+		{
+			nome:     "taxa de sessão e energia",
+			tarifa:   Tarifa{TaxaSessao: 2, PrecoKWh: 1.5},
+			inicio:   horario(10, 0),
+			fim:      horario(11, 0),
+			energia:  10,
+			esperado: DetalheCobranca{TaxaSessao: 200, Energia: 1500, Total: 1700},
+		},
+		{
+			nome:     "sessão vazia cobra só a taxa",
+			tarifa:   Tarifa{TaxaSessao: 2, PrecoKWh: 1.5, PrecoMinuto: 1},
+			inicio:   horario(10, 0),
+			fim:      horario(10, 0),
+			esperado: DetalheCobranca{TaxaSessao: 200, Total: 200},
+		},
+		{
+			nome:     "metade da sessão no horário de pico",
+			tarifa:   Tarifa{PrecoKWh: 1, PrecoMinuto: 0.1, Faixas: pico},
+			inicio:   horario(17, 30),
+			fim:      horario(18, 30),
+			energia:  20,
+			esperado: DetalheCobranca{Energia: 2500, Tempo: 750, Total: 3250},
+		},
+		{
+			nome:     "faixa que atravessa a meia-noite",
+			tarifa:   Tarifa{PrecoMinuto: 1, Faixas: madrugada},
+			inicio:   horario(21, 0),
+			fim:      horario(23, 0),
+			esperado: DetalheCobranca{Tempo: 9000, Total: 9000},
+		},
+		{
+			nome:     "fração de minuto",
+			tarifa:   Tarifa{PrecoMinuto: 1},
+			inicio:   horario(10, 0),
+			fim:      horario(10, 2).Add(30 * time.Second),
+			esperado: DetalheCobranca{Tempo: 250, Total: 250},
+		},
+		{
+			nome:     "ociosidade além da tolerância",
+			tarifa:   Tarifa{TaxaOciosidade: 2, ToleranciaOciosidade: 5},
+			inicio:   horario(10, 0),
+			fim:      horario(10, 0),
+			ociosos:  15,
+			esperado: DetalheCobranca{Ociosidade: 2000, Total: 2000},
+		},
+		{
+			nome:     "ociosidade dentro da tolerância",
+			tarifa:   Tarifa{TaxaOciosidade: 2, ToleranciaOciosidade: 5},
+			inicio:   horario(10, 0),
+			fim:      horario(10, 0),
+			ociosos:  5,
+			esperado: DetalheCobranca{},
+		},
+		{
+			nome:     "cada componente arredondado para baixo",
+			tarifa:   Tarifa{TaxaSessao: 1.009, PrecoKWh: 1.009, Arredondamento: arredondamentoParaBaixo},
+			inicio:   horario(10, 0),
+			fim:      horario(10, 1),
+			energia:  1,
+			esperado: DetalheCobranca{TaxaSessao: 100, Energia: 100, Total: 200},
+		},
+		{
+			nome:     "cada componente arredondado para cima",
+			tarifa:   Tarifa{TaxaSessao: 1.001, PrecoKWh: 1.001, Arredondamento: arredondamentoParaCima},
+			inicio:   horario(10, 0),
+			fim:      horario(10, 1),
+			energia:  1,
+			esperado: DetalheCobranca{TaxaSessao: 101, Energia: 101, Total: 202},
+		},
+		{
+			nome:     "impostos inclusos não alteram o total",
+			tarifa:   Tarifa{TaxaSessao: 10, AliquotaImpostos: 18},
+			inicio:   horario(10, 0),
+			fim:      horario(10, 0),
+			esperado: DetalheCobranca{TaxaSessao: 1000, Total: 1000, Impostos: 180},
+		},
+	}
+
+	for _, caso := range casos {
+		t.Run(caso.nome, func(t *testing.T) {
+			caso.esperado.Moeda = moeda
+			if detalhe := caso.tarifa.calcular(caso.inicio, caso.fim, caso.energia, caso.ociosos); detalhe != caso.esperado {
+				t.Errorf("cobrança %+v, esperada %+v", detalhe, caso.esperado)
+			}
+		})
+	}
+}
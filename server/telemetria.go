@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// Prazo máximo sem receber leitura do ponto antes de encerrar o acompanhamento
+	timeoutTelemetria = 30 * time.Second
+	// Horizonte e passo da projeção do custo entre uma leitura e a seguinte
+	horizonteProjecao = time.Minute
+	passoProjecao     = 100 * time.Millisecond
+	// Folga para a demora entre decidir o fim e o ponto parar o medidor
+	folgaFinalizacao = 200 * time.Millisecond
+)
+
+// Motivo do encerramento automático verificado pelo próprio servidor, que é
+// quem conhece a tarifa. SOC_ALVO e ENERGIA_MAXIMA são verificados pelo ponto.
+const limiteCustoMaximo = "CUSTO_MAXIMO"
+
+// Limites pedidos pelo carro no início da sessão; zero desativa cada um
+type LimitesCarregamento struct {
+	SocAlvo       float64  `json:"soc_alvo,omitempty"`
+	EnergiaMaxKWh float64  `json:"energia_max_kwh,omitempty"`
+	CustoMaximo   Dinheiro `json:"custo_maximo,omitempty"`
+}
+
+// Acompanha uma sessão em andamento: lê as leituras do medidor enviadas pelo
+// ponto, repassa aos carros inscritos e finaliza a sessão quando um limite é atingido
+type monitorSessao struct {
+	carroID     string
+	pontoID     string
+	historicoID string
+	siteID      string
+	inicio      time.Time
+	limites     LimitesCarregamento
+
+	mu         sync.Mutex
+	assinantes map[chan Message]bool
+}
+
+var (
+	monitores      = make(map[string]*monitorSessao) // pontoID -> monitor da sessão em andamento
+	monitoresMutex sync.Mutex
+)
+
+// Lê e valida os limites enviados em INICIO_CARREGAMENTO
+func lerLimitesCarregamento(content map[string]interface{}, pontoID string) (LimitesCarregamento, error) {
+	limites := LimitesCarregamento{
+		SocAlvo:       lerFloat(content, "soc_alvo", 0),
+		EnergiaMaxKWh: lerFloat(content, "energia_max_kwh", 0),
+	}
+	if limites.SocAlvo < 0 || limites.SocAlvo > 100 {
+		return limites, fmt.Errorf("SOC alvo deve estar entre 0 e 100%%")
+	}
+	if soc, ok := content["soc"].(float64); ok && limites.SocAlvo > 0 && limites.SocAlvo <= soc {
+		return limites, fmt.Errorf("SOC alvo de %.0f%% já atingido", limites.SocAlvo)
+	}
+	if limites.EnergiaMaxKWh < 0 {
+		return limites, fmt.Errorf("Energia máxima inválida")
+	}
+
+	if _, informado := content["custo_maximo"]; informado {
+		custo, ok := lerDinheiro(content, "custo_maximo")
+		if !ok || custo <= 0 {
+			return limites, fmt.Errorf("Custo máximo inválido")
+		}
+		if err := verificarMoeda(content); err != nil {
+			return limites, err
+		}
+		agora := time.Now()
+		if minimo := tarifaDoPonto(pontoID).calcular(agora, agora, 0, 0).Total; custo <= minimo {
+			return limites, fmt.Errorf("Custo máximo deve ser maior que a taxa da sessão (%s %s)", moeda, minimo)
+		}
+		limites.CustoMaximo = custo
+	}
+	return limites, nil
+}
+
+// Começa a acompanhar a sessão recém-iniciada no ponto
+func iniciarMonitor(carroID, pontoID, historicoID, siteID, enderecoPonto string, inicio time.Time, limites LimitesCarregamento) {
+	m := &monitorSessao{
+		carroID:     carroID,
+		pontoID:     pontoID,
+		historicoID: historicoID,
+		siteID:      siteID,
+		inicio:      inicio,
+		limites:     limites,
+		assinantes:  make(map[chan Message]bool),
+	}
+	monitoresMutex.Lock()
+	monitores[pontoID] = m
+	monitoresMutex.Unlock()
+
+	go m.executar(enderecoPonto)
+}
+
+func (m *monitorSessao) executar(enderecoPonto string) {
+	defer m.encerrar()
+
+	connPonto, err := net.DialTimeout("tcp", enderecoPonto, timeoutTransacao)
+	if err != nil {
+		fmt.Printf("Erro ao acompanhar a sessão %s no ponto %s: %v\n", m.historicoID, m.pontoID, err)
+		return
+	}
+	defer connPonto.Close()
+	sendResponse(connPonto, Message{
+		Action:  "ACOMPANHAR_SESSAO",
+		Content: map[string]interface{}{"carroID": m.carroID},
+	})
+
+	reader := bufio.NewReader(connPonto)
+	for {
+		connPonto.SetReadDeadline(time.Now().Add(timeoutTelemetria))
+		linha, err := reader.ReadString('\n')
+		if err != nil {
+			fmt.Printf("Telemetria do ponto %s interrompida: %v\n", m.pontoID, err)
+			return
+		}
+
+		var leitura Message
+		if err := json.Unmarshal([]byte(linha), &leitura); err != nil {
+			continue
+		}
+		switch leitura.Action {
+		case "LEITURA_MEDIDOR":
+			m.publicar(m.telemetria(leitura))
+			if m.limites.CustoMaximo > 0 {
+				if espera, atingido := m.tempoAteCustoMaximo(leitura); atingido {
+					time.Sleep(espera)
+					m.finalizarPorLimite(limiteCustoMaximo)
+				}
+			}
+		case "LIMITE_ATINGIDO":
+			m.publicar(m.telemetria(leitura))
+			motivo, _ := leitura.Content["motivo"].(string)
+			m.finalizarPorLimite(motivo)
+		default: // SESSAO_ENCERRADA: a sessão foi finalizada
+			return
+		}
+	}
+}
+
+// Leitura do ponto no formato enviado ao carro
+func (m *monitorSessao) telemetria(leitura Message) Message {
+	leitura.Action = "TELEMETRIA"
+	leitura.Content["pontoID"] = m.pontoID
+	leitura.Content["historicoID"] = m.historicoID
+	if m.siteID != "" {
+		leitura.Content["site"] = m.siteID
+	}
+	if m.limites != (LimitesCarregamento{}) {
+		leitura.Content["limites"] = m.limites
+	}
+	if m.limites.CustoMaximo > 0 {
+		leitura.Content["custo_parcial"] = m.custoAtual(leitura)
+		leitura.Content["moeda"] = moeda
+	}
+	return leitura
+}
+
+// Quanto a sessão custaria se terminasse no instante da leitura
+func (m *monitorSessao) custoAtual(leitura Message) Dinheiro {
+	return m.custoProjetado(leitura, 0)
+}
+
+// Custo da sessão um tempo depois da leitura, mantida a potência atual. Se o
+// carro já parou de receber energia, esse tempo conta como ociosidade.
+func (m *monitorSessao) custoProjetado(leitura Message, depois time.Duration) Dinheiro {
+	instante, err := lerHorario(leitura.Content, "instante")
+	if err != nil {
+		instante = time.Now()
+	}
+	energia := lerFloat(leitura.Content, "energia_kwh", 0) + lerFloat(leitura.Content, "potencia_kw", 0)*depois.Hours()
+	ociosos := lerFloat(leitura.Content, "ocioso_segundos", 0) / 60
+	if ociosos > 0 {
+		ociosos += depois.Minutes()
+	}
+	return tarifaDoPonto(m.pontoID).calcular(m.inicio, instante.Add(depois), energia, ociosos).Total
+}
+
+// Quanto esperar, a partir da leitura, para finalizar antes de o custo passar
+// do máximo. Falso se o máximo não for alcançado antes das próximas leituras.
+func (m *monitorSessao) tempoAteCustoMaximo(leitura Message) (time.Duration, bool) {
+	for depois := time.Duration(0); depois <= horizonteProjecao; depois += passoProjecao {
+		if m.custoProjetado(leitura, depois+folgaFinalizacao) > m.limites.CustoMaximo {
+			return depois, depois < intervaloTelemetriaEstimado(leitura)
+		}
+	}
+	return 0, false
+}
+
+// Intervalo entre leituras do ponto; sem a informação, assume o padrão dos pontos
+func intervaloTelemetriaEstimado(leitura Message) time.Duration {
+	if segundos := lerFloat(leitura.Content, "intervalo_segundos", 0); segundos > 0 {
+		return time.Duration(segundos * float64(time.Second))
+	}
+	return 2 * time.Second
+}
+
+// Finaliza e fatura a sessão como se o carro tivesse pedido, avisando os inscritos
+func (m *monitorSessao) finalizarPorLimite(motivo string) {
+	fmt.Printf("Sessão %s atingiu o limite %s, finalizando\n", m.historicoID, motivo)
+	resposta := finalizarCarregamento(m.carroID, m.pontoID)
+	if resposta.Action != "CARREGAMENTO_FINALIZADO" {
+		// O carro pode ter pedido o fim ao mesmo tempo
+		fmt.Printf("Sessão %s não finalizada pelo limite: %v\n", m.historicoID, resposta.Content["mensagem"])
+		return
+	}
+	resposta.Content["motivo"] = motivo
+	m.publicar(resposta)
+}
+
+func (m *monitorSessao) publicar(msg Message) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for assinante := range m.assinantes {
+		select {
+		case assinante <- msg:
+		default: // Carro lento: descarta a leitura em vez de atrasar o monitor
+		}
+	}
+}
+
+func (m *monitorSessao) inscrever() chan Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	assinante := make(chan Message, 16)
+	if m.assinantes == nil { // Monitor já encerrado
+		close(assinante)
+		return assinante
+	}
+	m.assinantes[assinante] = true
+	return assinante
+}
+
+func (m *monitorSessao) cancelarInscricao(assinante chan Message) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.assinantes[assinante] {
+		delete(m.assinantes, assinante)
+		close(assinante)
+	}
+}
+
+func (m *monitorSessao) encerrar() {
+	monitoresMutex.Lock()
+	if monitores[m.pontoID] == m {
+		delete(monitores, m.pontoID)
+	}
+	monitoresMutex.Unlock()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for assinante := range m.assinantes {
+		close(assinante)
+	}
+	m.assinantes = nil
+}
+
+// Repassa ao carro, na mesma conexão, as leituras do medidor durante a sessão.
+// Se a sessão for finalizada por um limite, o CARREGAMENTO_FINALIZADO também
+// chega por aqui. A conexão é encerrada quando a sessão termina.
+func handleAcompanharCarregamento(conn net.Conn, content map[string]interface{}) {
+	carroID, okCarro := content["carroID"].(string)
+	pontoID, okPonto := content["pontoID"].(string)
+	if !okCarro || !okPonto {
+		sendErrorResponse(conn, "Dados inválidos para acompanhar o carregamento")
+		return
+	}
+
+	monitoresMutex.Lock()
+	m, existe := monitores[pontoID]
+	monitoresMutex.Unlock()
+	if !existe || m.carroID != carroID {
+		sendErrorResponse(conn, "Carro não está carregando")
+		return
+	}
+
+	fmt.Printf("Carro %s acompanhando a sessão %s no ponto %s\n", carroID, m.historicoID, pontoID)
+	assinante := m.inscrever()
+	defer m.cancelarInscricao(assinante)
+
+	for msg := range assinante {
+		dados, _ := json.Marshal(msg)
+		if _, err := fmt.Fprintln(conn, string(dados)); err != nil {
+			fmt.Printf("Carro %s deixou de acompanhar a sessão %s\n", carroID, m.historicoID)
+			return
+		}
+	}
+	sendResponse(conn, Message{
+		Action:  "TELEMETRIA_ENCERRADA",
+		Content: map[string]interface{}{"pontoID": pontoID, "historicoID": m.historicoID},
+	})
+}
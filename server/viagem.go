@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+)
+
+const (
+	socReservaMinimo = 10.0 // Margem de bateria (%) que nunca deve ser consumida no trajeto
+	socMaximoParada  = 90.0 // Nível máximo (%) até o qual o carro carrega em uma parada
+	potenciaPadraoKW = 50.0 // Potência de recarga assumida quando não informada
+
+	// Curva de carga CC/CV, a mesma usada pelos pontos na medição: potência
+	// constante até socInicioCV e queda linear até fracaoMinimaCV em 100%
+	socInicioCV    = 80.0
+	fracaoMinimaCV = 0.05
+)
+
+type ParadaViagem struct {
+	PontoID           string  `json:"pontoID"`
+	Latitude          float64 `json:"latitude"`
+	Longitude         float64 `json:"longitude"`
+	DistanciaTrecho   float64 `json:"distancia_trecho"`
+	SocChegada        float64 `json:"soc_chegada"`
+	SocSaida          float64 `json:"soc_saida"`
+	TempoCarregamento float64 `json:"tempo_carregamento"` // Em minutos
+}
+
+// Modelo simples de consumo do veículo usado no planejamento
+type ModeloConsumo struct {
+	CapacidadeKWh float64
+	ConsumoKWhKm  float64
+	PotenciaMaxKW float64
+}
+
+// Converte uma distância em pontos percentuais de bateria
+func (m ModeloConsumo) socNecessario(distancia float64) float64 {
+	return distancia * m.ConsumoKWhKm / m.CapacidadeKWh * 100
+}
+
+// Minutos para carregar de socDe a socAte com a potência máxima informada,
+// seguindo a curva CC/CV em passos de 1%
+func (m ModeloConsumo) tempoRecarga(socDe, socAte, potenciaKW float64) float64 {
+	horas := 0.0
+	for soc := socDe; soc < socAte; soc++ {
+		passo := math.Min(1, socAte-soc)
+		potencia := potenciaKW
+		if soc >= socInicioCV {
+			potencia *= math.Max((100-soc)/(100-socInicioCV), fracaoMinimaCV)
+		}
+		horas += passo / 100 * m.CapacidadeKWh / potencia
+	}
+	return horas * 60
+}
+
+// Distância que pode ser percorrida a partir de um SOC sem violar a reserva
+func (m ModeloConsumo) alcance(soc float64) float64 {
+	if soc <= socReservaMinimo {
+		return 0
+	}
+	return (soc - socReservaMinimo) / 100 * m.CapacidadeKWh / m.ConsumoKWhKm
+}
+
+// Energia restante e consumo informados pelo carro ao listar os pontos
+type Autonomia struct {
+	EnergiaKWh    float64
+	ConsumoKWhKm  float64
+	CapacidadeKWh float64 // Opcional; sem ela o SOC de chegada não é calculado
+}
+
+// Situação do carro ao chegar a um ponto, pela distância do trajeto, com a energia atual
+type AlcancePonto struct {
+	Alcancavel        bool     `json:"alcancavel"`
+	EnergiaChegadaKWh float64  `json:"energia_chegada_kwh"`
+	SocChegada        *float64 `json:"soc_chegada,omitempty"` // Só com a capacidade conhecida
+}
+
+// Lê a autonomia do carro: a energia restante vem de "energia_kwh" ou de
+// "bateria" (%) com "capacidade_kwh". Falso se o carro não informou os dados.
+func lerAutonomia(content map[string]interface{}) (Autonomia, bool, error) {
+	autonomia := Autonomia{
+		ConsumoKWhKm:  lerFloat(content, "consumo_kwh_km", 0),
+		CapacidadeKWh: lerFloat(content, "capacidade_kwh", 0),
+	}
+	energia, okEnergia := content["energia_kwh"].(float64)
+	if bateria, ok := content["bateria"].(float64); !okEnergia && ok && autonomia.CapacidadeKWh > 0 {
+		energia, okEnergia = bateria/100*autonomia.CapacidadeKWh, true
+	}
+	_, okConsumo := content["consumo_kwh_km"]
+	if !okEnergia && !okConsumo {
+		return autonomia, false, nil
+	}
+	if !okEnergia || energia < 0 || autonomia.ConsumoKWhKm <= 0 || autonomia.CapacidadeKWh < 0 {
+		return autonomia, false, fmt.Errorf("Energia restante ou consumo inválidos")
+	}
+	autonomia.EnergiaKWh = energia
+	return autonomia, true, nil
+}
+
+// Energia que deve sobrar na chegada: a reserva mínima, se a capacidade for conhecida
+func (a Autonomia) reservaKWh() float64 {
+	return socReservaMinimo / 100 * a.CapacidadeKWh
+}
+
+// Distância que pode ser percorrida sem consumir a reserva
+func (a Autonomia) alcance() float64 {
+	return math.Max(0, a.EnergiaKWh-a.reservaKWh()) / a.ConsumoKWhKm
+}
+
+func (a Autonomia) chegada(distancia float64) AlcancePonto {
+	energia := a.EnergiaKWh - distancia*a.ConsumoKWhKm
+	alcance := AlcancePonto{
+		Alcancavel:        energia >= a.reservaKWh(),
+		EnergiaChegadaKWh: math.Max(0, energia),
+	}
+	if a.CapacidadeKWh > 0 {
+		soc := alcance.EnergiaChegadaKWh / a.CapacidadeKWh * 100
+		alcance.SocChegada = &soc
+	}
+	return alcance
+}
+
+func handlePlanejarViagem(conn net.Conn, request Message) {
+	fmt.Println("Cliente solicitou planejamento de viagem.")
+	content := request.Content
+
+	modelo := ModeloConsumo{
+		CapacidadeKWh: lerFloat(content, "capacidade_kwh", 0),
+		ConsumoKWhKm:  lerFloat(content, "consumo_kwh_km", 0),
+		PotenciaMaxKW: lerFloat(content, "potencia_max_kw", potenciaPadraoKW),
+	}
+	if modelo.CapacidadeKWh <= 0 || modelo.ConsumoKWhKm <= 0 || modelo.PotenciaMaxKW <= 0 {
+		sendErrorResponse(conn, "Modelo de consumo inválido")
+		return
+	}
+
+	latitude, okLat := content["latitude"].(float64)
+	longitude, okLon := content["longitude"].(float64)
+	destinoLat, okDestLat := content["destino_latitude"].(float64)
+	destinoLon, okDestLon := content["destino_longitude"].(float64)
+	bateria, okBat := content["bateria"].(float64)
+	if !okLat || !okLon || !okDestLat || !okDestLon || !okBat {
+		sendErrorResponse(conn, "Dados da viagem incompletos")
+		return
+	}
+	if bateria < 0 || bateria > 100 {
+		sendErrorResponse(conn, "Bateria deve estar entre 0 e 100%")
+		return
+	}
+
+	paradas, socFinal, err := planejarViagem(latitude, longitude, destinoLat, destinoLon, bateria, modelo, obterTodosOsPontos())
+	if err != nil {
+		sendErrorResponse(conn, err.Error())
+		return
+	}
+
+	response := Message{
+		Action: "PLANO_VIAGEM",
+		Content: map[string]interface{}{
+			"paradas":             paradas,
+			"distancia_total":     calcularDistancia(latitude, longitude, destinoLat, destinoLon),
+			"soc_chegada_destino": socFinal,
+		},
+	}
+	sendResponse(conn, response)
+}
+
+// Monta a sequência de paradas escolhendo, a cada trecho, o ponto alcançável
+// mais próximo do destino. Retorna as paradas e o SOC estimado na chegada.
+func planejarViagem(lat, lon, destinoLat, destinoLon, soc float64, modelo ModeloConsumo, pontos []PontoRecarga) ([]ParadaViagem, float64, error) {
+	paradas := []ParadaViagem{}
+	visitados := make(map[string]bool)
+
+	for {
+		distDestino := calcularDistancia(lat, lon, destinoLat, destinoLon)
+		if distDestino <= modelo.alcance(soc) {
+			return paradas, soc - modelo.socNecessario(distDestino), nil
+		}
+
+		melhor := -1
+		melhorRestante := distDestino
+		for i, ponto := range pontos {
+			// Pontos sem potência para um novo carro, como os que o limite
+			// do site deixou sem nada, não servem de parada
+			if visitados[ponto.ID] || ponto.PotenciaKW <= 0 {
+				continue
+			}
+			trecho := calcularDistancia(lat, lon, ponto.Latitude, ponto.Longitude)
+			restante := calcularDistancia(ponto.Latitude, ponto.Longitude, destinoLat, destinoLon)
+			if trecho <= modelo.alcance(soc) && restante < melhorRestante {
+				melhor = i
+				melhorRestante = restante
+			}
+		}
+		if melhor == -1 {
+			return nil, 0, fmt.Errorf("Destino inalcançável com os pontos de recarga disponíveis")
+		}
+
+		ponto := pontos[melhor]
+		visitados[ponto.ID] = true
+		trecho := calcularDistancia(lat, lon, ponto.Latitude, ponto.Longitude)
+		socChegada := soc - modelo.socNecessario(trecho)
+
+		// Carrega apenas o necessário para chegar ao destino, limitado ao máximo
+		// da parada. Quem já chega acima desse máximo sai com o que tinha.
+		socSaida := socReservaMinimo + modelo.socNecessario(melhorRestante)
+		socSaida = math.Max(socChegada, math.Min(socSaida, socMaximoParada))
+
+		potencia := math.Min(modelo.PotenciaMaxKW, ponto.PotenciaKW)
+		paradas = append(paradas, ParadaViagem{
+			PontoID:           ponto.ID,
+			Latitude:          ponto.Latitude,
+			Longitude:         ponto.Longitude,
+			DistanciaTrecho:   trecho,
+			SocChegada:        socChegada,
+			SocSaida:          socSaida,
+			TempoCarregamento: modelo.tempoRecarga(socChegada, socSaida, potencia),
+		})
+
+		lat, lon, soc = ponto.Latitude, ponto.Longitude, socSaida
+	}
+}